@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	gvlcachev2 "github.com/ezoic/gvlcache/gvlcacheV2"
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix starts the name of every environment variable the config is read from. A flag's variable is its name
+// in upper case with dashes as underscores, so -read-timeout is read from GVLCACHE_READ_TIMEOUT.
+const envPrefix = "GVLCACHE_"
+
+// bustTokensEnv holds the bust tokens. Like the other credentials they can't be given as a flag.
+const bustTokensEnv = envPrefix + "BUST_TOKENS"
+
+// ServerConfig is a struct representing an the configurations for this server. It is read from the file given
+// with -config (YAML, or JSON which YAML also reads), then from the environment, then from flags, each source
+// overriding the ones before. Durations are written like 30s or 1h.
+type ServerConfig struct {
+	BindIPAddr    string `yaml:"bindIPAddr"`    // The ip address for server to bind to.
+	BindIPPort    int    `yaml:"bindIPPort"`    // The port for the server ot listen to.
+	L4gConfig     string `yaml:"l4gConfig"`     // Path of the configuration file for l4g
+	CertPath      string `yaml:"certPath"`      // Path where cert public key is, the server speaks HTTPS when it and KeyPath are set
+	KeyPath       string `yaml:"keyPath"`       // Path where cert private key is
+	MinTLSVersion string `yaml:"minTLSVersion"` // The oldest TLS version accepted: 1.0, 1.1, 1.2 or 1.3
+
+	ReadTimeout         time.Duration `yaml:"readTimeout"`         // How long reading a whole request may take
+	ReadHeaderTimeout   time.Duration `yaml:"readHeaderTimeout"`   // How long reading the request headers may take
+	WriteTimeout        time.Duration `yaml:"writeTimeout"`        // How long writing the response may take
+	IdleTimeout         time.Duration `yaml:"idleTimeout"`         // How long a keep-alive connection may sit idle
+	MaxHeaderBytes      int           `yaml:"maxHeaderBytes"`      // The largest request headers accepted
+	DrainDelay          time.Duration `yaml:"drainDelay"`          // How long readiness fails before the server stops accepting connections
+	ShutdownGracePeriod time.Duration `yaml:"shutdownGracePeriod"` // How long in-flight requests get to finish on shutdown
+
+	Upstream UpstreamConfig `yaml:"upstream"`
+	Cache    CacheConfig    `yaml:"cache"`
+	TCF      TCFConfig      `yaml:"tcf"`
+	Auth     AuthConfig     `yaml:"auth"`
+}
+
+// UpstreamConfig says where vendor lists are fetched from
+type UpstreamConfig struct {
+	URL                     string        `yaml:"url"`                     // The latest vendor list
+	ArchiveURLFormat        string        `yaml:"archiveURLFormat"`        // Past versions of the list, with %d for the version
+	BreakerFailureThreshold int           `yaml:"breakerFailureThreshold"` // Failed fetches in a row before IAB is left alone
+	BreakerCooldown         time.Duration `yaml:"breakerCooldown"`         // How long IAB is left alone
+}
+
+// CacheConfig sets up where lists are cached and for how long they are served
+type CacheConfig struct {
+	Backend              string        `yaml:"backend"`              // Only memcached is supported
+	SnapshotDir          string        `yaml:"snapshotDir"`          // Where the L1 snapshot is kept across restarts
+	StaleWhileRevalidate time.Duration `yaml:"staleWhileRevalidate"` // How long an expired list is served while it is refreshed
+	StaleIfError         time.Duration `yaml:"staleIfError"`         // How long an expired list is served when IAB is down
+	MaxSnapshotAge       time.Duration `yaml:"maxSnapshotAge"`       // How old the snapshot gets before /healthz fails
+	VersionGCInterval    time.Duration `yaml:"versionGCInterval"`    // How often old versions are removed, 0 to never
+}
+
+// TCFConfig sets up the TCF endpoints
+type TCFConfig struct {
+	RestrictionsDir string `yaml:"restrictionsDir"` // Where publisher restriction configs are stored, shared by every instance
+}
+
+// AuthConfig holds the credentials callers of the admin endpoints present. The lists are only read from the
+// config file, the bust tokens from the file or GVLCACHE_BUST_TOKENS.
+type AuthConfig struct {
+	BustCacheTokens string             `yaml:"bustCacheTokens"` // caller=token pairs separated by commas, granted the bust scope
+	Tokens          []TokenConfig      `yaml:"tokens"`          // Bearer tokens
+	HMACKeys        []HMACKeyConfig    `yaml:"hmacKeys"`        // Shared secrets requests are signed with
+	ClientCAPath    string             `yaml:"clientCAPath"`    // The CAs client certificates must chain to, over HTTPS
+	ClientCerts     []ClientCertConfig `yaml:"clientCerts"`     // The client certificates allowed, by SHA-256 fingerprint
+}
+
+// TokenConfig is a bearer token and the scopes it grants
+type TokenConfig struct {
+	Name   string   `yaml:"name"`
+	Token  string   `yaml:"token"`
+	Scopes []string `yaml:"scopes"`
+}
+
+// HMACKeyConfig is a key requests are signed with and the scopes it grants
+type HMACKeyConfig struct {
+	Name   string   `yaml:"name"`
+	KeyID  string   `yaml:"keyId"`
+	Secret string   `yaml:"secret"`
+	Scopes []string `yaml:"scopes"`
+}
+
+// ClientCertConfig is a client certificate and the scopes it grants
+type ClientCertConfig struct {
+	Name        string   `yaml:"name"`
+	Fingerprint string   `yaml:"fingerprint"` // hex SHA-256 of the DER certificate
+	Scopes      []string `yaml:"scopes"`
+}
+
+// defaultServerConfig is the configuration the server runs with when nothing overrides it
+func defaultServerConfig() ServerConfig {
+	return ServerConfig{
+		BindIPPort:          8054,
+		L4gConfig:           "/var/go/src/github.com/ezoic/gvlcache/l4gconfig.xml",
+		MinTLSVersion:       "1.2",
+		ReadTimeout:         15 * time.Second,
+		ReadHeaderTimeout:   5 * time.Second,
+		WriteTimeout:        30 * time.Second,
+		IdleTimeout:         2 * time.Minute,
+		MaxHeaderBytes:      64 << 10,
+		DrainDelay:          5 * time.Second,
+		ShutdownGracePeriod: 20 * time.Second,
+		Upstream: UpstreamConfig{
+			// The dummy IAB server, fetching the real list is rate limited to once per caching period
+			URL:                     "http://127.0.0.1:8055/v2/vendor-list.json",
+			ArchiveURLFormat:        gvlcachev2.ArchiveURLFormat,
+			BreakerFailureThreshold: gvlcachev2.BreakerFailureThreshold,
+			BreakerCooldown:         gvlcachev2.BreakerCooldown,
+		},
+		Cache: CacheConfig{
+			Backend:              "memcached",
+			SnapshotDir:          "/var/lib/gvlcache",
+			StaleWhileRevalidate: gvlcachev2.StaleWhileRevalidate,
+			StaleIfError:         gvlcachev2.StaleIfError,
+			MaxSnapshotAge:       gvlcachev2.MaxSnapshotAge,
+			VersionGCInterval:    time.Hour,
+		},
+		TCF: TCFConfig{
+			RestrictionsDir: "/var/lib/gvlcache/restrictions",
+		},
+	}
+}
+
+// flagSet binds a flag to every field of the config, with the field's current value as the default
+func (config *ServerConfig) flagSet() *flag.FlagSet {
+	flags := flag.NewFlagSet("gvlcache", flag.ContinueOnError)
+	flags.StringVar(&config.BindIPAddr, "bind-ip-addr", config.BindIPAddr, "the ip address to listen on, all of them when empty")
+	flags.IntVar(&config.BindIPPort, "bind-ip-port", config.BindIPPort, "the port to listen on")
+	flags.StringVar(&config.L4gConfig, "l4g-config", config.L4gConfig, "path of the l4g configuration")
+	flags.StringVar(&config.CertPath, "cert-path", config.CertPath, "path of the TLS certificate, HTTPS is served when it is set")
+	flags.StringVar(&config.KeyPath, "key-path", config.KeyPath, "path of the TLS private key")
+	flags.StringVar(&config.MinTLSVersion, "min-tls-version", config.MinTLSVersion, "the oldest TLS version accepted")
+	flags.DurationVar(&config.ReadTimeout, "read-timeout", config.ReadTimeout, "how long reading a request may take")
+	flags.DurationVar(&config.ReadHeaderTimeout, "read-header-timeout", config.ReadHeaderTimeout, "how long reading request headers may take")
+	flags.DurationVar(&config.WriteTimeout, "write-timeout", config.WriteTimeout, "how long writing a response may take")
+	flags.DurationVar(&config.IdleTimeout, "idle-timeout", config.IdleTimeout, "how long a keep-alive connection may sit idle")
+	flags.IntVar(&config.MaxHeaderBytes, "max-header-bytes", config.MaxHeaderBytes, "the largest request headers accepted")
+	flags.DurationVar(&config.DrainDelay, "drain-delay", config.DrainDelay, "how long readiness fails before shutting down")
+	flags.DurationVar(&config.ShutdownGracePeriod, "shutdown-grace-period", config.ShutdownGracePeriod, "how long in-flight requests get on shutdown")
+	flags.StringVar(&config.Upstream.URL, "upstream-url", config.Upstream.URL, "the URL of the latest vendor list")
+	flags.StringVar(&config.Upstream.ArchiveURLFormat, "archive-url-format", config.Upstream.ArchiveURLFormat, "the URL of past vendor lists, with %d for the version")
+	flags.IntVar(&config.Upstream.BreakerFailureThreshold, "breaker-failure-threshold", config.Upstream.BreakerFailureThreshold, "failed fetches in a row before IAB is left alone")
+	flags.DurationVar(&config.Upstream.BreakerCooldown, "breaker-cooldown", config.Upstream.BreakerCooldown, "how long IAB is left alone after repeated failures")
+	flags.StringVar(&config.Cache.Backend, "cache-backend", config.Cache.Backend, "the cache backend, memcached")
+	flags.StringVar(&config.Cache.SnapshotDir, "snapshot-dir", config.Cache.SnapshotDir, "where the L1 snapshot is kept across restarts")
+	flags.DurationVar(&config.Cache.StaleWhileRevalidate, "stale-while-revalidate", config.Cache.StaleWhileRevalidate, "how long an expired list is served while it is refreshed")
+	flags.DurationVar(&config.Cache.StaleIfError, "stale-if-error", config.Cache.StaleIfError, "how long an expired list is served when IAB is down")
+	flags.DurationVar(&config.Cache.MaxSnapshotAge, "max-snapshot-age", config.Cache.MaxSnapshotAge, "how old the snapshot gets before /healthz fails")
+	flags.DurationVar(&config.Cache.VersionGCInterval, "version-gc-interval", config.Cache.VersionGCInterval, "how often old versions are removed, 0 to never")
+	flags.StringVar(&config.TCF.RestrictionsDir, "restrictions-dir", config.TCF.RestrictionsDir, "where publisher restriction configs are stored")
+	return flags
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// configPath finds the -config flag before the other flags are parsed, since the file has to be read first
+func configPath(args []string, getenv func(string) string) string {
+	for i, arg := range args {
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == "config" && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(name, "config=") {
+			return strings.TrimPrefix(name, "config=")
+		}
+	}
+	return getenv(envPrefix + "CONFIG")
+}
+
+// loadConfig layers the file, the environment and the flags over the defaults. It reports whether
+// -print-config was given.
+func loadConfig(args []string, getenv func(string) string) (ServerConfig, bool, error) {
+	config := defaultServerConfig()
+	if path := configPath(args, getenv); path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return config, false, fmt.Errorf("reading the config file: %v", err)
+		}
+		if err := yaml.UnmarshalStrict(b, &config); err != nil {
+			return config, false, fmt.Errorf("config file %s: %v", path, err)
+		}
+	}
+
+	flags := config.flagSet()
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if value := getenv(envName(f.Name)); value != "" && err == nil {
+			if setErr := flags.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("%s: %v", envName(f.Name), setErr)
+			}
+		}
+	})
+	if err != nil {
+		return config, false, err
+	}
+	// Credentials have no flag, so that they never show up in the process list
+	if tokens := getenv(bustTokensEnv); tokens != "" {
+		config.Auth.BustCacheTokens = tokens
+	}
+
+	flags.String("config", "", "path of a YAML or JSON config file, also read from "+envPrefix+"CONFIG")
+	printConfig := flags.Bool("print-config", false, "print the effective configuration and exit")
+	if err := flags.Parse(args); err != nil {
+		return config, false, err
+	}
+	if flags.NArg() > 0 {
+		return config, false, fmt.Errorf("unexpected arguments %v", flags.Args())
+	}
+	return config, *printConfig, config.validate()
+}
+
+// validate reports every problem of the config at once
+func (config ServerConfig) validate() error {
+	problems := []string{}
+	if config.BindIPPort <= 0 || config.BindIPPort > 65535 {
+		problems = append(problems, fmt.Sprintf("bindIPPort %d is not a port", config.BindIPPort))
+	}
+	if (config.CertPath == "") != (config.KeyPath == "") {
+		problems = append(problems, "certPath and keyPath must be set together")
+	}
+	if _, err := parseTLSVersion(config.MinTLSVersion); err != nil {
+		problems = append(problems, "minTLSVersion: "+err.Error())
+	}
+	for name, timeout := range map[string]time.Duration{
+		"readTimeout":         config.ReadTimeout,
+		"readHeaderTimeout":   config.ReadHeaderTimeout,
+		"writeTimeout":        config.WriteTimeout,
+		"idleTimeout":         config.IdleTimeout,
+		"shutdownGracePeriod": config.ShutdownGracePeriod,
+	} {
+		if timeout <= 0 {
+			problems = append(problems, fmt.Sprintf("%s must be positive", name))
+		}
+	}
+	if config.MaxHeaderBytes <= 0 {
+		problems = append(problems, "maxHeaderBytes must be positive")
+	}
+	if config.DrainDelay < 0 {
+		problems = append(problems, "drainDelay must not be negative")
+	}
+
+	if parsed, err := url.Parse(config.Upstream.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		problems = append(problems, fmt.Sprintf("upstream.url %q is not an http or https URL", config.Upstream.URL))
+	}
+	if strings.Count(config.Upstream.ArchiveURLFormat, "%d") != 1 {
+		problems = append(problems, "upstream.archiveURLFormat must hold %d once, for the version")
+	}
+	if config.Upstream.BreakerFailureThreshold <= 0 || config.Upstream.BreakerCooldown <= 0 {
+		problems = append(problems, "upstream.breakerFailureThreshold and upstream.breakerCooldown must be positive")
+	}
+
+	if config.Cache.Backend != "memcached" {
+		problems = append(problems, fmt.Sprintf("cache.backend %q is not supported, use memcached", config.Cache.Backend))
+	}
+	if config.Cache.SnapshotDir == "" {
+		problems = append(problems, "cache.snapshotDir must be set")
+	}
+	for name, ttl := range map[string]time.Duration{
+		"cache.staleWhileRevalidate": config.Cache.StaleWhileRevalidate,
+		"cache.staleIfError":         config.Cache.StaleIfError,
+		"cache.versionGCInterval":    config.Cache.VersionGCInterval,
+	} {
+		if ttl < 0 {
+			problems = append(problems, fmt.Sprintf("%s must not be negative", name))
+		}
+	}
+	if config.Cache.MaxSnapshotAge <= 0 {
+		problems = append(problems, "cache.maxSnapshotAge must be positive")
+	}
+	if config.TCF.RestrictionsDir == "" {
+		problems = append(problems, "tcf.restrictionsDir must be set")
+	}
+
+	if _, err := gvlcachev2.ParseBustCacheTokens(config.Auth.BustCacheTokens); err != nil {
+		problems = append(problems, "auth.bustCacheTokens: "+err.Error())
+	}
+	problems = append(problems, config.Auth.validate()...)
+	if len(config.Auth.ClientCerts) > 0 && (config.CertPath == "" || config.Auth.ClientCAPath == "") {
+		problems = append(problems, "auth.clientCerts needs certPath and auth.clientCAPath to be set")
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+}
+
+// apply hands the settings of the config to gvlcacheV2
+func (config ServerConfig) apply() {
+	gvlcachev2.UpstreamURL = config.Upstream.URL
+	gvlcachev2.ArchiveURLFormat = config.Upstream.ArchiveURLFormat
+	gvlcachev2.BreakerFailureThreshold = config.Upstream.BreakerFailureThreshold
+	gvlcachev2.BreakerCooldown = config.Upstream.BreakerCooldown
+	gvlcachev2.SnapshotDir = config.Cache.SnapshotDir
+	gvlcachev2.RestrictionsDir = config.TCF.RestrictionsDir
+	gvlcachev2.StaleWhileRevalidate = config.Cache.StaleWhileRevalidate
+	gvlcachev2.StaleIfError = config.Cache.StaleIfError
+	gvlcachev2.MaxSnapshotAge = config.Cache.MaxSnapshotAge
+}
+
+// validate reports the credentials that are missing a part or grant unknown scopes
+func (auth AuthConfig) validate() []string {
+	problems := []string{}
+	checkScopes := func(what string, scopes []string) {
+		if len(scopes) == 0 {
+			problems = append(problems, what+" grants no scopes")
+		}
+		for _, scope := range scopes {
+			if !gvlcachev2.ValidScope(scope) {
+				problems = append(problems, fmt.Sprintf("%s: %q is not a scope, use read, bust, promote or admin", what, scope))
+			}
+		}
+	}
+	for i, token := range auth.Tokens {
+		what := fmt.Sprintf("auth.tokens[%d]", i)
+		if token.Name == "" || token.Token == "" {
+			problems = append(problems, what+" needs a name and a token")
+		}
+		checkScopes(what, token.Scopes)
+	}
+	for i, key := range auth.HMACKeys {
+		what := fmt.Sprintf("auth.hmacKeys[%d]", i)
+		if key.Name == "" || key.KeyID == "" || key.Secret == "" {
+			problems = append(problems, what+" needs a name, a keyId and a secret")
+		}
+		checkScopes(what, key.Scopes)
+	}
+	for i, cert := range auth.ClientCerts {
+		what := fmt.Sprintf("auth.clientCerts[%d]", i)
+		if decoded, err := hex.DecodeString(cert.Fingerprint); cert.Name == "" || err != nil || len(decoded) != sha256.Size {
+			problems = append(problems, what+" needs a name and the hex SHA-256 fingerprint of the certificate")
+		}
+		checkScopes(what, cert.Scopes)
+	}
+	return problems
+}
+
+// authenticator builds the authentication of the admin endpoints from the credentials. The bust tokens are
+// bearer tokens granted the bust scope.
+func (auth AuthConfig) authenticator() (*gvlcachev2.Auth, error) {
+	bustTokens, err := gvlcachev2.ParseBustCacheTokens(auth.BustCacheTokens)
+	if err != nil {
+		return nil, err
+	}
+	tokens := gvlcachev2.BearerTokens{}
+	for token, caller := range bustTokens {
+		tokens[token] = gvlcachev2.Principal{Name: caller, Scopes: []string{gvlcachev2.ScopeBust}}
+	}
+	for _, token := range auth.Tokens {
+		tokens[token.Token] = gvlcachev2.Principal{Name: token.Name, Scopes: token.Scopes}
+	}
+	keys := map[string]gvlcachev2.HMACKey{}
+	for _, key := range auth.HMACKeys {
+		keys[key.KeyID] = gvlcachev2.HMACKey{Secret: key.Secret, Principal: gvlcachev2.Principal{Name: key.Name, Scopes: key.Scopes}}
+	}
+	certs := gvlcachev2.ClientCerts{}
+	for _, cert := range auth.ClientCerts {
+		certs[strings.ToLower(cert.Fingerprint)] = gvlcachev2.Principal{Name: cert.Name, Scopes: cert.Scopes}
+	}
+	return &gvlcachev2.Auth{Authenticators: []gvlcachev2.Authenticator{certs, gvlcachev2.NewHMACKeys(keys), tokens}}, nil
+}
+
+// print writes the config as YAML, with the credentials left out
+func (config ServerConfig) print(w io.Writer) error {
+	if config.Auth.BustCacheTokens != "" {
+		config.Auth.BustCacheTokens = "<redacted>"
+	}
+	tokens := make([]TokenConfig, len(config.Auth.Tokens))
+	for i, token := range config.Auth.Tokens {
+		token.Token = "<redacted>"
+		tokens[i] = token
+	}
+	config.Auth.Tokens = tokens
+	keys := make([]HMACKeyConfig, len(config.Auth.HMACKeys))
+	for i, key := range config.Auth.HMACKeys {
+		key.Secret = "<redacted>"
+		keys[i] = key
+	}
+	config.Auth.HMACKeys = keys
+	b, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
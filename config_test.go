@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func env(values map[string]string) func(string) string {
+	return func(name string) string { return values[name] }
+}
+
+func TestLoadConfigLayersFileEnvAndFlags(t *testing.T) {
+	path := writeConfigFile(t, "gvlcache.yaml", `
+bindIPPort: 9000
+readTimeout: 10s
+writeTimeout: 40s
+upstream:
+  url: https://vendor-list.consensu.org/v2/vendor-list.json
+cache:
+  staleIfError: 48h
+auth:
+  bustCacheTokens: ops=secret
+`)
+	config, printConfig, err := loadConfig(
+		[]string{"-config", path, "-write-timeout", "50s"},
+		env(map[string]string{"GVLCACHE_BIND_IP_PORT": "9100", "GVLCACHE_WRITE_TIMEOUT": "45s"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if printConfig {
+		t.Errorf("print-config was not asked for")
+	}
+	if config.ReadTimeout != 10*time.Second || config.Cache.StaleIfError != 48*time.Hour || config.Auth.BustCacheTokens != "ops=secret" {
+		t.Errorf("file values were not read: %+v", config)
+	}
+	if config.BindIPPort != 9100 {
+		t.Errorf("port = %d, want the environment to override the file", config.BindIPPort)
+	}
+	if config.WriteTimeout != 50*time.Second {
+		t.Errorf("write timeout = %v, want the flag to override the environment", config.WriteTimeout)
+	}
+	if config.IdleTimeout != defaultServerConfig().IdleTimeout {
+		t.Errorf("idle timeout = %v, want the default", config.IdleTimeout)
+	}
+}
+
+func TestLoadConfigReadsJSONAndConfigFromEnv(t *testing.T) {
+	path := writeConfigFile(t, "gvlcache.json", `{"bindIPPort": 9200, "cache": {"snapshotDir": "/tmp/gvl"}}`)
+	config, _, err := loadConfig([]string{"--print-config"}, env(map[string]string{"GVLCACHE_CONFIG": path}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.BindIPPort != 9200 || config.Cache.SnapshotDir != "/tmp/gvl" {
+		t.Errorf("config = %+v", config)
+	}
+}
+
+func TestLoadConfigReportsEveryProblem(t *testing.T) {
+	path := writeConfigFile(t, "gvlcache.yaml", `
+bindIPPort: 70000
+certPath: /etc/cert.pem
+minTLSVersion: "1.4"
+upstream:
+  url: ftp://example.com
+cache:
+  backend: redis
+`)
+	_, _, err := loadConfig([]string{"-config=" + path}, env(map[string]string{"GVLCACHE_BUST_TOKENS": "no-caller"}))
+	if err == nil {
+		t.Fatal("an invalid config was accepted")
+	}
+	for _, problem := range []string{"bindIPPort", "certPath and keyPath", "minTLSVersion", "upstream.url", "cache.backend", "auth.bustCacheTokens"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("%q is not reported in %v", problem, err)
+		}
+	}
+
+	for _, c := range []struct {
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{[]string{"-config", writeConfigFile(t, "typo.yaml", "bindIPPrt: 80\n")}, nil, "bindIPPrt"},
+		{nil, map[string]string{"GVLCACHE_READ_TIMEOUT": "soon"}, "GVLCACHE_READ_TIMEOUT"},
+		{[]string{"-no-such-flag"}, nil, "no-such-flag"},
+		{[]string{"-bust-tokens", "ops=secret"}, nil, "bust-tokens"},
+		{[]string{"-config", "/does/not/exist.yaml"}, nil, "config file"},
+	} {
+		if _, _, err := loadConfig(c.args, env(c.env)); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%v %v: err = %v, want it to mention %q", c.args, c.env, err, c.want)
+		}
+	}
+}
+
+func TestPrintConfigRedactsTokens(t *testing.T) {
+	config := defaultServerConfig()
+	config.Auth.BustCacheTokens = "ops=secret"
+	config.Auth.Tokens = []TokenConfig{{Name: "dashboard", Token: "secret-token", Scopes: []string{"read"}}}
+	config.Auth.HMACKeys = []HMACKeyConfig{{Name: "cron", KeyID: "k1", Secret: "secret-key", Scopes: []string{"bust"}}}
+	b := &bytes.Buffer{}
+	if err := config.print(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, credential := range []string{"ops=secret", "secret-token", "secret-key"} {
+		if strings.Contains(b.String(), credential) {
+			t.Errorf("printed config holds %s:\n%s", credential, b)
+		}
+	}
+	if !strings.Contains(b.String(), "readTimeout: 15s") {
+		t.Errorf("printed config:\n%s", b)
+	}
+
+	// The printed config can be read back as a config file
+	printed := ServerConfig{}
+	if err := yaml.UnmarshalStrict(b.Bytes(), &printed); err != nil || printed.ReadTimeout != config.ReadTimeout {
+		t.Errorf("printed config does not read back: %v", err)
+	}
+}
+
+func TestLoadConfigAuth(t *testing.T) {
+	fingerprint := strings.Repeat("ab", 32)
+	path := writeConfigFile(t, "auth.yaml", `
+certPath: /etc/gvlcache/cert.pem
+keyPath: /etc/gvlcache/key.pem
+auth:
+  bustCacheTokens: ops=legacy
+  tokens:
+    - {name: dashboard, token: t1, scopes: [read]}
+  hmacKeys:
+    - {name: cron, keyId: k1, secret: s1, scopes: [bust, promote]}
+  clientCAPath: /etc/gvlcache/clients.pem
+  clientCerts:
+    - {name: deploy, fingerprint: `+fingerprint+`, scopes: [admin]}
+`)
+	config, _, err := loadConfig([]string{"-config", path}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := config.Auth.authenticator()
+	if err != nil || len(auth.Authenticators) != 3 {
+		t.Fatalf("authenticator = %+v, %v", auth, err)
+	}
+
+	invalid := writeConfigFile(t, "invalid.yaml", `
+auth:
+  tokens:
+    - {name: dashboard, token: t1, scopes: [write]}
+    - {name: nobody, token: t2}
+  clientCerts:
+    - {name: deploy, fingerprint: abc, scopes: [admin]}
+`)
+	_, _, err = loadConfig([]string{"-config", invalid}, env(nil))
+	for _, want := range []string{`"write" is not a scope`, "auth.tokens[1] grants no scopes", "auth.clientCerts[0] needs", "needs certPath"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %v, want it to mention %q", err, want)
+		}
+	}
+}
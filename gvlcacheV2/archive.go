@@ -0,0 +1,139 @@
+package gvlcachev2
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	l4g "github.com/ezoic/log4go"
+)
+
+// ArchiveURLFormat is where IAB publishes every past version of the vendor list, with the version filled in
+var ArchiveURLFormat = "https://vendor-list.consensu.org/v2/archives/vendor-list-v%d.json"
+
+// versionNotFoundError is returned when neither the cache nor IAB's archive has a version of the list
+type versionNotFoundError struct {
+	VendorListVersion int
+}
+
+func (err versionNotFoundError) Error() string {
+	return fmt.Sprintf("vendor list version %d does not exist", err.VendorListVersion)
+}
+
+// archiveCacheSize is how many past versions are kept decoded in this process. TC strings mostly name one of the
+// last few versions, and a decoded list is a few megabytes.
+const archiveCacheSize = 16
+
+// missingVersionTTL is how long IAB's answer that a version does not exist is believed. A version one past the
+// latest can appear at any time, so it is not believed for long.
+const missingVersionTTL = 10 * time.Minute
+
+// archivedVersion is an entry of the archive cache: a decoded list, or the time until which its version is known
+// not to exist
+type archivedVersion struct {
+	vendorListVersion int
+	gvl               *GVLVersionTwoValue
+	missingUntil      time.Time
+}
+
+// The archive cache holds the versions fetchArchivedVersion returned most recently, in front of memcached and
+// IAB. The front of the list is the most recently used.
+var (
+	archiveMu      sync.Mutex
+	archiveLRU     = list.New()
+	archiveEntries = map[int]*list.Element{}
+)
+
+// cachedArchivedVersion looks a version up in the archive cache. ok is false when the cache knows nothing of it.
+func cachedArchivedVersion(vendorListVersion int, now time.Time) (gvl *GVLVersionTwoValue, ok bool, err error) {
+	archiveMu.Lock()
+	defer archiveMu.Unlock()
+	element, ok := archiveEntries[vendorListVersion]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := element.Value.(*archivedVersion)
+	if entry.gvl == nil && !now.Before(entry.missingUntil) {
+		archiveLRU.Remove(element)
+		delete(archiveEntries, vendorListVersion)
+		return nil, false, nil
+	}
+	archiveLRU.MoveToFront(element)
+	if entry.gvl == nil {
+		return nil, true, versionNotFoundError{VendorListVersion: vendorListVersion}
+	}
+	return entry.gvl, true, nil
+}
+
+// cacheArchivedVersion puts an entry in the archive cache, evicting the least recently used entry when it is full
+func cacheArchivedVersion(entry *archivedVersion) {
+	archiveMu.Lock()
+	defer archiveMu.Unlock()
+	if element, ok := archiveEntries[entry.vendorListVersion]; ok {
+		element.Value = entry
+		archiveLRU.MoveToFront(element)
+		return
+	}
+	archiveEntries[entry.vendorListVersion] = archiveLRU.PushFront(entry)
+	for archiveLRU.Len() > archiveCacheSize {
+		oldest := archiveLRU.Back()
+		archiveLRU.Remove(oldest)
+		delete(archiveEntries, oldest.Value.(*archivedVersion).vendorListVersion)
+	}
+}
+
+// dropArchivedVersions empties the archive cache, or removes one version from it when vendorListVersion is set
+func dropArchivedVersions(vendorListVersion int) {
+	archiveMu.Lock()
+	defer archiveMu.Unlock()
+	for version, element := range archiveEntries {
+		if vendorListVersion == 0 || version == vendorListVersion {
+			archiveLRU.Remove(element)
+			delete(archiveEntries, version)
+		}
+	}
+}
+
+// fetchArchivedVersion returns a version of the list from the L1 snapshot, the archive cache or memcached when it
+// is there, and from IAB's archive otherwise. Versions fetched from the archive are stored so the next call doesn't
+// need IAB, and so are the versions IAB does not have, for missingVersionTTL.
+func fetchArchivedVersion(vendorListVersion int) (*GVLVersionTwoValue, error) {
+	if snap := currentSnapshot(defaultLanguage); snap != nil && snap.GVL.VendorListVersion == vendorListVersion {
+		return snap.GVL, nil
+	}
+	if gvl, ok, err := cachedArchivedVersion(vendorListVersion, time.Now()); ok {
+		return gvl, err
+	}
+	if gvl, err := loadVersion(gvlSpecificationVersion, vendorListVersion, defaultLanguage); err == nil {
+		cacheArchivedVersion(&archivedVersion{vendorListVersion: vendorListVersion, gvl: gvl})
+		return gvl, nil
+	}
+
+	if !archiveCircuit.allow() {
+		recordUpstreamFetch("circuit_open", time.Now(), 0)
+		return nil, errCircuitOpen
+	}
+	gvl := &GVLVersionTwoValue{}
+	_, err := gvl.getGVLVersionTwoValueFromURL(fmt.Sprintf(ArchiveURLFormat, vendorListVersion))
+	if statusErr, ok := err.(upstreamStatusError); ok && statusErr.StatusCode == http.StatusNotFound {
+		// A version IAB does not have is not a failure of IAB
+		archiveCircuit.record(nil)
+		cacheArchivedVersion(&archivedVersion{vendorListVersion: vendorListVersion, missingUntil: time.Now().Add(missingVersionTTL)})
+		return nil, versionNotFoundError{VendorListVersion: vendorListVersion}
+	}
+	archiveCircuit.record(err)
+	if err != nil {
+		return nil, err
+	}
+	if gvl.VendorListVersion != vendorListVersion {
+		return nil, fmt.Errorf("the archive of version %d holds version %d", vendorListVersion, gvl.VendorListVersion)
+	}
+	if err := archiveVersion(gvl, defaultLanguage); err != nil {
+		// The list is still good for this call, it will just be fetched again next time
+		l4g.Warn("Could not store archived GVL version %d: %v", vendorListVersion, err)
+	}
+	cacheArchivedVersion(&archivedVersion{vendorListVersion: vendorListVersion, gvl: gvl})
+	return gvl, nil
+}
@@ -0,0 +1,211 @@
+package gvlcachev2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ezoic/gvlcache/tcstring"
+	l4g "github.com/ezoic/log4go"
+)
+
+// The kinds of finding an audit reports
+const (
+	findingUnknownVendor            = "unknownVendor"
+	findingDeletedVendor            = "deletedVendor"
+	findingUndeclaredConsent        = "consentForUndeclaredPurposes"
+	findingLINotPermitted           = "legitimateInterestNotPermitted"
+	findingLINotDeclared            = "legitimateInterestNotDeclared"
+	findingUndeclaredSpecialFeature = "specialFeatureNotDeclared"
+)
+
+// AuditFinding is something in a TC string that the version of the vendor list it names does not back
+type AuditFinding struct {
+	Kind             string `json:"kind"`
+	Field            string `json:"field"`
+	VendorID         int    `json:"vendorId,omitempty"`
+	PurposeIDs       []int  `json:"purposeIds,omitempty"`
+	SpecialFeatureID int    `json:"specialFeatureId,omitempty"`
+	Message          string `json:"message"`
+}
+
+// TCFAudit is a decoded TC string with what is wrong with it
+type TCFAudit struct {
+	VendorListVersion int                `json:"vendorListVersion"`
+	Created           time.Time          `json:"created"`
+	CmpID             int                `json:"cmpId"`
+	Clean             bool               `json:"clean"`
+	Findings          []AuditFinding     `json:"findings"`
+	Decoded           *tcstring.TCString `json:"decoded"`
+}
+
+// Summary is the audit in plain text, one line per finding
+func (audit *TCFAudit) Summary() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "TC string for vendor list version %d, created %s by CMP %d\n", audit.VendorListVersion, audit.Created.Format(time.RFC3339), audit.CmpID)
+	if audit.Clean {
+		fmt.Fprintln(b, "No problems found.")
+		return b.String()
+	}
+	if len(audit.Findings) == 1 {
+		fmt.Fprintln(b, "1 problem found:")
+	} else {
+		fmt.Fprintf(b, "%d problems found:\n", len(audit.Findings))
+	}
+	for _, finding := range audit.Findings {
+		fmt.Fprintf(b, "- %s: %s\n", finding.Field, finding.Message)
+	}
+	return b.String()
+}
+
+// AuditTCString decodes a TC string and checks it against the version of the vendor list it names
+func AuditTCString(tcString string) (*TCFAudit, error) {
+	tc, err := tcstring.Decode(tcString)
+	if err != nil {
+		return nil, err
+	}
+	gvl, err := fetchArchivedVersion(tc.VendorListVersion)
+	if err != nil {
+		return nil, err
+	}
+	return auditTCString(tc, gvl), nil
+}
+
+// declaresOnConsent reports whether a vendor can process for a purpose on consent: declared on consent, or on
+// legitimate interest and flexible, so that a publisher can require consent instead
+func (vendor GVLVersionTwoVendor) declaresOnConsent(purposeID int) bool {
+	return containsInt(vendor.Purposes, purposeID) || containsInt(vendor.LegIntPurposes, purposeID) && containsInt(vendor.FlexiblePurposes, purposeID)
+}
+
+// declaresOnLegitimateInterest is declaresOnConsent the other way around
+func (vendor GVLVersionTwoVendor) declaresOnLegitimateInterest(purposeID int) bool {
+	return containsInt(vendor.LegIntPurposes, purposeID) || containsInt(vendor.Purposes, purposeID) && containsInt(vendor.FlexiblePurposes, purposeID)
+}
+
+// auditTCString checks tc against gvl as it stood when the string was created. Purpose legitimate interest and
+// special feature opt-ins are checked against every vendor of the list that was not deleted by then.
+func auditTCString(tc *tcstring.TCString, gvl *GVLVersionTwoValue) *TCFAudit {
+	audit := &TCFAudit{VendorListVersion: tc.VendorListVersion, Created: tc.Created, CmpID: tc.CmpID, Findings: []AuditFinding{}, Decoded: tc}
+	add := func(finding AuditFinding) {
+		audit.Findings = append(audit.Findings, finding)
+	}
+
+	// Restricting or allowing a vendor that was deleted is harmless
+	type vendorField struct {
+		name           string
+		ids            tcstring.IDs
+		deletedAllowed bool
+	}
+	vendorFields := []vendorField{
+		{"vendorConsents", tc.VendorConsents, false},
+		{"vendorLegitimateInterests", tc.VendorLegitimateInterests, false},
+		{"disclosedVendors", tc.DisclosedVendors, false},
+		{"allowedVendors", tc.AllowedVendors, true},
+	}
+	for i, restriction := range tc.PublisherRestrictions {
+		vendorFields = append(vendorFields, vendorField{fmt.Sprintf("pubRestrictions[%d]", i), restriction.Vendors, true})
+	}
+	for _, field := range vendorFields {
+		for _, id := range field.ids {
+			vendor, ok := gvl.Vendors[id]
+			switch {
+			case !ok:
+				add(AuditFinding{Kind: findingUnknownVendor, Field: field.name, VendorID: id,
+					Message: fmt.Sprintf("vendor %d is not in vendor list version %d", id, gvl.VendorListVersion)})
+			case !field.deletedAllowed && vendor.deletedBy(tc.Created):
+				add(AuditFinding{Kind: findingDeletedVendor, Field: field.name, VendorID: id,
+					Message: fmt.Sprintf("vendor %d (%s) was deleted on %s, before the string was created", id, vendor.Name, vendor.DeletedDate)})
+			}
+		}
+	}
+
+	for _, id := range tc.VendorConsents {
+		vendor, ok := gvl.Vendors[id]
+		if !ok {
+			continue
+		}
+		undeclared := []int{}
+		for _, purpose := range tc.PurposesConsent {
+			if !vendor.declaresOnConsent(purpose) {
+				undeclared = append(undeclared, purpose)
+			}
+		}
+		if len(undeclared) > 0 {
+			add(AuditFinding{Kind: findingUndeclaredConsent, Field: "vendorConsents", VendorID: id, PurposeIDs: undeclared,
+				Message: fmt.Sprintf("vendor %d (%s) has consent for purposes %v it does not declare on consent", id, vendor.Name, undeclared)})
+		}
+	}
+
+	current := []GVLVersionTwoVendor{}
+	for _, id := range sortedKeys(gvl.Vendors) {
+		if vendor := gvl.Vendors[id]; !vendor.deletedBy(tc.Created) {
+			current = append(current, vendor)
+		}
+	}
+	for _, purpose := range tc.PurposesLITransparency {
+		if !legitimateInterestAllowed(purpose, tc.TCFPolicyVersion) {
+			add(AuditFinding{Kind: findingLINotPermitted, Field: "purposesLITransparency", PurposeIDs: []int{purpose},
+				Message: fmt.Sprintf("purpose %d can't be processed on legitimate interest under policy version %d", purpose, tc.TCFPolicyVersion)})
+			continue
+		}
+		declared := false
+		for _, vendor := range current {
+			declared = declared || vendor.declaresOnLegitimateInterest(purpose)
+		}
+		if !declared {
+			add(AuditFinding{Kind: findingLINotDeclared, Field: "purposesLITransparency", PurposeIDs: []int{purpose},
+				Message: fmt.Sprintf("no vendor declares purpose %d on legitimate interest", purpose)})
+		}
+	}
+	for _, feature := range tc.SpecialFeatureOptIns {
+		declared := false
+		for _, vendor := range current {
+			declared = declared || containsInt(vendor.SpecialFeatures, feature)
+		}
+		if !declared {
+			add(AuditFinding{Kind: findingUndeclaredSpecialFeature, Field: "specialFeatureOptIns", SpecialFeatureID: feature,
+				Message: fmt.Sprintf("the user opted in to special feature %d, which no vendor declares", feature)})
+		}
+	}
+
+	audit.Clean = len(audit.Findings) == 0
+	return audit
+}
+
+// auditRequest is the body of HandleTCFAudit
+type auditRequest struct {
+	TCString string `json:"tcString"`
+}
+
+// HandleTCFAudit checks the TC string of the body against the version of the vendor list it names. The audit is
+// JSON unless plain text is asked for with ?format=text or an Accept header of text/plain.
+func HandleTCFAudit(rw http.ResponseWriter, req *http.Request) {
+	request := auditRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil || request.TCString == "" {
+		writeError(rw, req, validationFailed("The request body must be JSON with a tcString."))
+		return
+	}
+
+	audit, err := AuditTCString(request.TCString)
+	decodeErr := &tcstring.DecodeError{}
+	if errors.As(err, &decodeErr) {
+		writeError(rw, req, validationFailed(fmt.Sprintf("The TC string can't be read: %v", err)))
+		return
+	}
+	if err != nil {
+		l4g.Error(err)
+		writeError(rw, req, upstreamUnavailable(err, http.StatusBadGateway, "There was an error fetching the vendor list the TC string was made for."))
+		return
+	}
+
+	if req.URL.Query().Get("format") == "text" || strings.HasPrefix(req.Header.Get("Accept"), "text/plain") {
+		rw.Header().Add("Content-Type", "text/plain; charset=utf-8")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte(audit.Summary()))
+		return
+	}
+	writeJSON(rw, http.StatusOK, audit)
+}
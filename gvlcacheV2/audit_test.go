@@ -0,0 +1,81 @@
+package gvlcachev2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ezoic/gvlcache/tcstring"
+)
+
+func TestAuditTCStringFindsWhatTheListDoesNotBack(t *testing.T) {
+	tc := tcfTestString()
+	tc.PurposesConsent = tcstring.IDs{1}
+	if audit := auditTCString(tc, evaluateTestGVL()); !audit.Clean || len(audit.Findings) != 0 {
+		t.Errorf("clean string: %+v", audit.Findings)
+	}
+
+	tc = tcfTestString()
+	tc.VendorConsents = tcstring.IDs{8, 12, 744, 999}
+	tc.PurposesLITransparency = tcstring.IDs{1, 2, 3}
+	tc.SpecialFeatureOptIns = tcstring.IDs{1, 2}
+	audit := auditTCString(tc, evaluateTestGVL())
+	want := []AuditFinding{
+		{Kind: findingDeletedVendor, Field: "vendorConsents", VendorID: 12},
+		{Kind: findingUnknownVendor, Field: "vendorConsents", VendorID: 999},
+		{Kind: findingUndeclaredConsent, Field: "vendorConsents", VendorID: 8, PurposeIDs: []int{3}},
+		{Kind: findingUndeclaredConsent, Field: "vendorConsents", VendorID: 12, PurposeIDs: []int{3}},
+		{Kind: findingLINotPermitted, Field: "purposesLITransparency", PurposeIDs: []int{1}},
+		{Kind: findingLINotDeclared, Field: "purposesLITransparency", PurposeIDs: []int{3}},
+		{Kind: findingUndeclaredSpecialFeature, Field: "specialFeatureOptIns", SpecialFeatureID: 1},
+	}
+	for i := range audit.Findings {
+		audit.Findings[i].Message = ""
+	}
+	if audit.Clean || !reflect.DeepEqual(audit.Findings, want) {
+		t.Errorf("findings =\n%+v\nwant\n%+v", audit.Findings, want)
+	}
+}
+
+func postAudit(target string, body string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	HandleTCFAudit(rw, httptest.NewRequest(http.MethodPost, target, strings.NewReader(body)))
+	return rw
+}
+
+func TestHandleTCFAuditReportsAsJSONAndText(t *testing.T) {
+	useArchive(t, evaluateTestGVL())
+	tc := tcfTestString()
+	tc.VendorConsents = tcstring.IDs{8, 999}
+	encoded, err := tcstring.Encode(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"tcString":"` + encoded + `"}`
+
+	rw := postAudit("/tcf/audit", body)
+	audit := TCFAudit{}
+	json.NewDecoder(rw.Body).Decode(&audit)
+	if rw.Code != http.StatusOK || audit.VendorListVersion != 29 || audit.Clean || len(audit.Findings) != 2 || audit.Decoded == nil {
+		t.Errorf("status = %d, audit = %+v", rw.Code, audit)
+	}
+
+	rw = postAudit("/tcf/audit?format=text", body)
+	text := rw.Body.String()
+	if !strings.HasPrefix(rw.Header().Get("Content-Type"), "text/plain") || !strings.Contains(text, "2 problems found") ||
+		!strings.Contains(text, "vendor 999 is not in vendor list version 29") {
+		t.Errorf("text report:\n%s", text)
+	}
+
+	for body, status := range map[string]int{
+		`{"tcString":"not a tc string"}`: http.StatusBadRequest,
+		`{}`:                             http.StatusBadRequest,
+	} {
+		if rw := postAudit("/tcf/audit", body); rw.Code != status {
+			t.Errorf("%s: status = %d, want %d", body, rw.Code, status)
+		}
+	}
+}
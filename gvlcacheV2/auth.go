@@ -0,0 +1,281 @@
+package gvlcachev2
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	l4g "github.com/ezoic/log4go"
+)
+
+// The scopes a caller can be granted. ScopeAdmin grants every other scope.
+const (
+	ScopeRead    = "read"
+	ScopeBust    = "bust"
+	ScopePromote = "promote"
+	ScopeAdmin   = "admin"
+)
+
+// The headers of an HMAC-signed request
+const (
+	hmacAuthScheme  = "GVL-HMAC"
+	timestampHeader = "X-GVL-Timestamp"
+)
+
+// MaxClockSkew is how far the timestamp of a signed request may be from the server's clock. Signatures are
+// remembered for that long, so a captured request can't be replayed either.
+var MaxClockSkew = 5 * time.Minute
+
+// maxSignedBodyBytes bounds the body read to check a signature, before the caller is known. The admin endpoints
+// take small JSON bodies.
+const maxSignedBodyBytes = 64 << 10
+
+// Principal is the caller a request was authenticated as
+type Principal struct {
+	Name   string
+	Scopes []string
+	Method string // bearer, hmac or mtls
+}
+
+func (principal *Principal) can(scope string) bool {
+	for _, granted := range principal.Scopes {
+		if granted == scope || granted == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidScope reports whether scope is one of the scopes a caller can be granted
+func ValidScope(scope string) bool {
+	switch scope {
+	case ScopeRead, ScopeBust, ScopePromote, ScopeAdmin:
+		return true
+	}
+	return false
+}
+
+// Authenticator identifies the caller of a request from one kind of credential. It returns a nil principal and
+// no error when the request carries no credential of its kind, and an error when the credential is not valid.
+type Authenticator interface {
+	Authenticate(req *http.Request) (*Principal, error)
+}
+
+// BearerTokens authenticates "Authorization: Bearer <token>" requests, keyed by token
+type BearerTokens map[string]Principal
+
+// Authenticate compares the token against every known one in constant time
+func (tokens BearerTokens) Authenticate(req *http.Request) (*Principal, error) {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, nil
+	}
+	presented := []byte(strings.TrimPrefix(header, "Bearer "))
+	for token, principal := range tokens {
+		if subtle.ConstantTimeCompare(presented, []byte(token)) == 1 {
+			principal.Method = "bearer"
+			return &principal, nil
+		}
+	}
+	return nil, errors.New("unknown bearer token")
+}
+
+// HMACKey is a shared secret a caller signs requests with
+type HMACKey struct {
+	Secret    string
+	Principal Principal
+}
+
+// HMACKeys authenticates signed requests, keyed by key id. A signed request carries
+//
+//	X-GVL-Timestamp: <unix seconds>
+//	Authorization: GVL-HMAC keyId=<key id>,signature=<hex HMAC-SHA256>
+//
+// where the signature covers the method, the path with its query, the timestamp and the SHA-256 of the body, each
+// on its own line. See SignRequest.
+type HMACKeys struct {
+	Keys map[string]HMACKey
+
+	mu   sync.Mutex
+	seen map[string]time.Time // signatures accepted within MaxClockSkew
+}
+
+// NewHMACKeys returns an authenticator for the keys
+func NewHMACKeys(keys map[string]HMACKey) *HMACKeys {
+	return &HMACKeys{Keys: keys, seen: map[string]time.Time{}}
+}
+
+func stringToSign(req *http.Request, timestamp string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return strings.Join([]string{req.Method, req.URL.RequestURI(), timestamp, hex.EncodeToString(bodyHash[:])}, "\n")
+}
+
+func sign(secret string, message string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest adds the headers HMACKeys checks to a request that is about to be sent
+func SignRequest(req *http.Request, keyID string, secret string, now time.Time) error {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set("Authorization", fmt.Sprintf("%s keyId=%s,signature=%s", hmacAuthScheme, keyID, sign(secret, stringToSign(req, timestamp, body))))
+	return nil
+}
+
+// Authenticate checks the signature and the timestamp, and refuses a signature it has accepted before
+func (keys *HMACKeys) Authenticate(req *http.Request) (*Principal, error) {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, hmacAuthScheme+" ") {
+		return nil, nil
+	}
+	params := map[string]string{}
+	for _, field := range strings.Split(strings.TrimPrefix(header, hmacAuthScheme+" "), ",") {
+		if parts := strings.SplitN(strings.TrimSpace(field), "=", 2); len(parts) == 2 {
+			params[parts[0]] = parts[1]
+		}
+	}
+	key, ok := keys.Keys[params["keyId"]]
+	if !ok {
+		return nil, fmt.Errorf("unknown HMAC key %q", params["keyId"])
+	}
+
+	timestamp := req.Header.Get(timestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errors.New("the signed request has no valid " + timestampHeader)
+	}
+	now := time.Now()
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return nil, fmt.Errorf("the request timestamp is %v off", skew.Round(time.Second))
+	}
+
+	var body []byte
+	if req.Body != nil {
+		if body, err = ioutil.ReadAll(io.LimitReader(req.Body, maxSignedBodyBytes+1)); err != nil {
+			return nil, err
+		}
+		if len(body) > maxSignedBodyBytes {
+			return nil, fmt.Errorf("the signed body is over %d bytes", maxSignedBodyBytes)
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	expected := sign(key.Secret, stringToSign(req, timestamp, body))
+	if !hmac.Equal([]byte(expected), []byte(params["signature"])) {
+		return nil, errors.New("the request signature does not match")
+	}
+
+	keys.mu.Lock()
+	defer keys.mu.Unlock()
+	for signature, acceptedAt := range keys.seen {
+		if now.Sub(acceptedAt) > 2*MaxClockSkew {
+			delete(keys.seen, signature)
+		}
+	}
+	if _, replayed := keys.seen[expected]; replayed {
+		return nil, errors.New("the signed request was replayed")
+	}
+	keys.seen[expected] = now
+
+	principal := key.Principal
+	principal.Method = "hmac"
+	return &principal, nil
+}
+
+// ClientCertFingerprint is the hex SHA-256 of a certificate, as ClientCerts is keyed
+func ClientCertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// ClientCerts authenticates mTLS clients whose verified certificate is in the allowlist, keyed by fingerprint
+type ClientCerts map[string]Principal
+
+// Authenticate only accepts certificates the TLS handshake verified against the client CAs
+func (certs ClientCerts) Authenticate(req *http.Request) (*Principal, error) {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil, nil
+	}
+	if len(req.TLS.VerifiedChains) == 0 {
+		return nil, errors.New("the client certificate was not verified")
+	}
+	fingerprint := ClientCertFingerprint(req.TLS.PeerCertificates[0])
+	principal, ok := certs[fingerprint]
+	if !ok {
+		return nil, fmt.Errorf("client certificate %s (%s) is not allowed", fingerprint, req.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+	principal.Method = "mtls"
+	return &principal, nil
+}
+
+type principalContextKey struct{}
+
+// principalOf returns the caller the request was authenticated as, nil when it went through no authentication
+func principalOf(req *http.Request) *Principal {
+	principal, _ := req.Context().Value(principalContextKey{}).(*Principal)
+	return principal
+}
+
+// Auth authenticates requests with the first of its authenticators that finds a credential of its kind
+type Auth struct {
+	Authenticators []Authenticator
+}
+
+// deny logs why a request was refused and answers it
+func deny(rw http.ResponseWriter, req *http.Request, failure apiError, reason string) {
+	l4g.Warn("Denied %s %s from %s (request %s): %s", req.Method, req.URL.Path, req.RemoteAddr, requestIDOf(rw, req), reason)
+	writeError(rw, req, failure)
+}
+
+// Require lets a request through only when its caller was granted scope. A request without credentials is
+// answered 401, one whose caller lacks the scope 403.
+func (auth *Auth) Require(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			var principal *Principal
+			for _, authenticator := range auth.Authenticators {
+				found, err := authenticator.Authenticate(req)
+				if err != nil {
+					deny(rw, req, apiError{status: http.StatusUnauthorized, code: CodeUnauthorized, message: "The credentials are not valid."}, err.Error())
+					return
+				}
+				if found != nil {
+					principal = found
+					break
+				}
+			}
+			if principal == nil {
+				deny(rw, req, apiError{status: http.StatusUnauthorized, code: CodeUnauthorized, message: "Credentials are required."}, "no credentials")
+				return
+			}
+			if !principal.can(scope) {
+				deny(rw, req, apiError{status: http.StatusForbidden, code: CodeForbidden, message: fmt.Sprintf("The %s scope is required.", scope)},
+					fmt.Sprintf("%s (%s) lacks the %s scope", principal.Name, principal.Method, scope))
+				return
+			}
+			next.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), principalContextKey{}, principal)))
+		})
+	}
+}
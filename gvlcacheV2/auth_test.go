@@ -0,0 +1,164 @@
+package gvlcachev2
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func authTestAuth() *Auth {
+	return &Auth{Authenticators: []Authenticator{
+		ClientCerts{ClientCertFingerprint(authTestCert("allowed")): {Name: "deploy", Scopes: []string{ScopeBust}}},
+		NewHMACKeys(map[string]HMACKey{"k1": {Secret: "shh", Principal: Principal{Name: "cron", Scopes: []string{ScopeBust}}}}),
+		BearerTokens{
+			"reader": {Name: "dashboard", Scopes: []string{ScopeRead}},
+			"root":   {Name: "ops", Scopes: []string{ScopeAdmin}},
+		},
+	}}
+}
+
+func authTestCert(commonName string) *x509.Certificate {
+	return &x509.Certificate{Raw: []byte("der of " + commonName), Subject: pkix.Name{CommonName: commonName}}
+}
+
+// serveAuthorized passes req through auth requiring scope, answering with the name of the caller let through
+func serveAuthorized(auth *Auth, scope string, req *http.Request) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	auth.Require(scope)(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(principalOf(req).Name))
+	})).ServeHTTP(rw, req)
+	return rw
+}
+
+func TestRequireBearerScopes(t *testing.T) {
+	auth := authTestAuth()
+	for _, test := range []struct {
+		header string
+		scope  string
+		status int
+		code   string
+	}{
+		{"", ScopeRead, http.StatusUnauthorized, CodeUnauthorized},
+		{"Bearer nope", ScopeRead, http.StatusUnauthorized, CodeUnauthorized},
+		{"Bearer reader", ScopeRead, http.StatusOK, ""},
+		{"Bearer reader", ScopeBust, http.StatusForbidden, CodeForbidden},
+		{"Bearer root", ScopeBust, http.StatusOK, ""},
+		{"Bearer root", ScopePromote, http.StatusOK, ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/GVLV2/admin/cache", nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		rw := serveAuthorized(auth, test.scope, req)
+		if rw.Code != test.status {
+			t.Errorf("%q for %s: status = %d, want %d", test.header, test.scope, rw.Code, test.status)
+			continue
+		}
+		if test.code != "" {
+			if code := decodeError(t, rw).Code; code != test.code {
+				t.Errorf("%q for %s: code = %s, want %s", test.header, test.scope, code, test.code)
+			}
+		}
+	}
+}
+
+func signedRequest(t *testing.T, body string, at time.Time) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/GVLV2Cache/bustCache", strings.NewReader(body))
+	if err := SignRequest(req, "k1", "shh", at); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestRequireHMAC(t *testing.T) {
+	auth := authTestAuth()
+	req := signedRequest(t, `{"scope":"all"}`, time.Now())
+	if rw := serveAuthorized(auth, ScopeBust, req); rw.Code != http.StatusOK || rw.Body.String() != "cron" {
+		t.Fatalf("status = %d: %s", rw.Code, rw.Body)
+	}
+
+	// The same request sent again is a replay
+	replayed := httptest.NewRequest(http.MethodPost, "/GVLV2Cache/bustCache", strings.NewReader(`{"scope":"all"}`))
+	replayed.Header = req.Header
+	if rw := serveAuthorized(auth, ScopeBust, replayed); rw.Code != http.StatusUnauthorized {
+		t.Errorf("replay: status = %d, want 401", rw.Code)
+	}
+
+	stale := signedRequest(t, `{"scope":"all"}`, time.Now().Add(-2*MaxClockSkew))
+	if rw := serveAuthorized(auth, ScopeBust, stale); rw.Code != http.StatusUnauthorized {
+		t.Errorf("stale timestamp: status = %d, want 401", rw.Code)
+	}
+
+	tampered := signedRequest(t, `{"scope":"version","vendorListVersion":29}`, time.Now())
+	tampered.Body = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"scope":"all"}`)).Body
+	if rw := serveAuthorized(auth, ScopeBust, tampered); rw.Code != http.StatusUnauthorized {
+		t.Errorf("tampered body: status = %d, want 401", rw.Code)
+	}
+
+	unknownKey := signedRequest(t, "", time.Now())
+	unknownKey.Header.Set("Authorization", strings.Replace(unknownKey.Header.Get("Authorization"), "k1", "k2", 1))
+	if rw := serveAuthorized(auth, ScopeBust, unknownKey); rw.Code != http.StatusUnauthorized {
+		t.Errorf("unknown key: status = %d, want 401", rw.Code)
+	}
+
+	// The body is read before the caller is known, so it is only read up to a limit
+	oversized := signedRequest(t, `{"scope":"all","padding":"`+strings.Repeat("x", maxSignedBodyBytes)+`"}`, time.Now())
+	if rw := serveAuthorized(auth, ScopeBust, oversized); rw.Code != http.StatusUnauthorized {
+		t.Errorf("oversized body: status = %d, want 401", rw.Code)
+	}
+}
+
+func TestSignRequestKeepsBody(t *testing.T) {
+	req := signedRequest(t, `{"scope":"all"}`, time.Now())
+	rw := httptest.NewRecorder()
+	authTestAuth().Require(ScopeBust)(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if body, err := ioutil.ReadAll(req.Body); err != nil || string(body) != `{"scope":"all"}` {
+			t.Errorf("the handler read %q, %v", body, err)
+		}
+	})).ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("status = %d: %s", rw.Code, rw.Body)
+	}
+	if _, err := strconv.ParseInt(req.Header.Get(timestampHeader), 10, 64); err != nil {
+		t.Errorf("timestamp header = %q", req.Header.Get(timestampHeader))
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	auth := authTestAuth()
+	for _, test := range []struct {
+		cert     *x509.Certificate
+		verified bool
+		status   int
+	}{
+		{authTestCert("allowed"), true, http.StatusOK},
+		{authTestCert("allowed"), false, http.StatusUnauthorized},
+		{authTestCert("stranger"), true, http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/GVLV2Cache/bustCache", nil)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{test.cert}}
+		if test.verified {
+			req.TLS.VerifiedChains = [][]*x509.Certificate{{test.cert}}
+		}
+		if rw := serveAuthorized(auth, ScopeBust, req); rw.Code != test.status {
+			t.Errorf("%s verified=%t: status = %d, want %d", test.cert.Subject.CommonName, test.verified, rw.Code, test.status)
+		}
+	}
+}
+
+func TestBustCacheCallerFromPrincipal(t *testing.T) {
+	useMemoryCache(t)
+	req := signedRequest(t, `{"scope":"all"}`, time.Now())
+	rw := httptest.NewRecorder()
+	authTestAuth().Require(ScopeBust)(http.HandlerFunc(HandleRequestForBustingCache)).ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("status = %d: %s", rw.Code, rw.Body)
+	}
+}
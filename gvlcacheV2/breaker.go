@@ -0,0 +1,88 @@
+package gvlcachev2
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// BreakerFailureThreshold is how many fetches of the latest list in a row have to fail before IAB is left alone
+// for BreakerCooldown. Stale copies are served meanwhile, as far as StaleIfError allows.
+var (
+	BreakerFailureThreshold = 5
+	BreakerCooldown         = 30 * time.Second
+)
+
+// The states of the circuit breaker, as exported by /metrics
+const (
+	circuitClosed   = 0
+	circuitHalfOpen = 1
+	circuitOpen     = 2
+)
+
+// errCircuitOpen is returned instead of calling IAB while the breaker is open
+var errCircuitOpen = errors.New("IAB is not being called after repeated failures")
+
+// circuitBreaker stops calls to IAB after repeated failures. Once the cooldown passes, one call is let through:
+// its success closes the breaker again, its failure opens it for another cooldown.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool // a call is let through while half open
+}
+
+// upstreamCircuit guards the fetches of the latest list, and is the state /metrics exports. The archive has a
+// breaker of its own, so that its answers don't close the breaker of the latest list while that keeps failing.
+var (
+	upstreamCircuit = &circuitBreaker{}
+	archiveCircuit  = &circuitBreaker{}
+)
+
+func (breaker *circuitBreaker) stateAt(now time.Time) int {
+	switch {
+	case breaker.failures < BreakerFailureThreshold:
+		return circuitClosed
+	case now.Sub(breaker.openedAt) < BreakerCooldown:
+		return circuitOpen
+	}
+	return circuitHalfOpen
+}
+
+func (breaker *circuitBreaker) state() int {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	return breaker.stateAt(time.Now())
+}
+
+// allow reports whether IAB may be called now
+func (breaker *circuitBreaker) allow() bool {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	switch breaker.stateAt(time.Now()) {
+	case circuitClosed:
+		return true
+	case circuitHalfOpen:
+		if breaker.trial {
+			return false
+		}
+		breaker.trial = true
+		return true
+	}
+	return false
+}
+
+// record counts the outcome of a call allow let through
+func (breaker *circuitBreaker) record(err error) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	breaker.trial = false
+	if err == nil {
+		breaker.failures = 0
+		return
+	}
+	breaker.failures++
+	if breaker.failures >= BreakerFailureThreshold {
+		breaker.openedAt = time.Now()
+	}
+}
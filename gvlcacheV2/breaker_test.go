@@ -0,0 +1,80 @@
+package gvlcachev2
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensAfterRepeatedFailuresAndProbes(t *testing.T) {
+	breaker := &circuitBreaker{}
+	failure := errors.New("down")
+	for i := 0; i < BreakerFailureThreshold; i++ {
+		if !breaker.allow() {
+			t.Fatalf("call %d was refused while closed", i)
+		}
+		breaker.record(failure)
+	}
+	if breaker.state() != circuitOpen || breaker.allow() {
+		t.Fatalf("state = %d, want open", breaker.state())
+	}
+
+	breaker.openedAt = time.Now().Add(-BreakerCooldown)
+	if breaker.state() != circuitHalfOpen || !breaker.allow() {
+		t.Fatalf("state = %d, want a trial call once the cooldown passed", breaker.state())
+	}
+	if breaker.allow() {
+		t.Errorf("a second call was let through while half open")
+	}
+	breaker.record(failure)
+	if breaker.state() != circuitOpen {
+		t.Errorf("state = %d, want open again after the trial failed", breaker.state())
+	}
+
+	breaker.openedAt = time.Now().Add(-BreakerCooldown)
+	breaker.allow()
+	breaker.record(nil)
+	if breaker.state() != circuitClosed || !breaker.allow() {
+		t.Errorf("state = %d, want closed after the trial succeeded", breaker.state())
+	}
+}
+
+func TestOpenBreakerStopsCallsToIAB(t *testing.T) {
+	var fetches int32
+	useUpstream(t, func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		http.Error(rw, "down", http.StatusServiceUnavailable)
+	})
+
+	for i := 0; i < BreakerFailureThreshold+3; i++ {
+		refreshGVL()
+	}
+	if fetches != int32(BreakerFailureThreshold) {
+		t.Errorf("IAB was called %d times, want %d", fetches, BreakerFailureThreshold)
+	}
+	if _, err := refreshGVL(); err != errCircuitOpen {
+		t.Errorf("err = %v, want the breaker to be open", err)
+	}
+}
+
+func TestArchiveAnswersDoNotCloseTheBreaker(t *testing.T) {
+	// Every URL is a 404, the latest list as much as every archived version
+	useArchive(t)
+
+	for i := 0; i < BreakerFailureThreshold; i++ {
+		if _, err := refreshGVL(); err == nil {
+			t.Fatal("the latest list was fetched")
+		}
+		if _, err := fetchArchivedVersion(100 + i); !errors.As(err, &versionNotFoundError{}) {
+			t.Fatalf("version %d: err = %v", 100+i, err)
+		}
+	}
+	if state := upstreamCircuit.state(); state != circuitOpen {
+		t.Errorf("breaker of the latest list = %d, want open", state)
+	}
+	if state := archiveCircuit.state(); state != circuitClosed {
+		t.Errorf("breaker of the archive = %d, want closed", state)
+	}
+}
@@ -0,0 +1,145 @@
+package gvlcachev2
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	l4g "github.com/ezoic/log4go"
+)
+
+// The scopes a cache bust can name
+const (
+	bustScopeAll      string = "all"
+	bustScopeVersion  string = "version"
+	bustScopeLanguage string = "language"
+	bustScopeL1       string = "l1"
+)
+
+// ParseBustCacheTokens reads "caller=token" pairs separated by commas into a map of token to caller
+func ParseBustCacheTokens(pairs string) (map[string]string, error) {
+	tokens := map[string]string{}
+	for _, pair := range strings.Split(pairs, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New("bust cache tokens must be given as caller=token pairs")
+		}
+		tokens[parts[1]] = parts[0]
+	}
+	return tokens, nil
+}
+
+// bustCacheRequest is the body of a request to bust the cache
+type bustCacheRequest struct {
+	Scope             string `json:"scope"`
+	VendorListVersion int    `json:"vendorListVersion"` // only for the version scope
+	Language          string `json:"language"`          // defaults to English for the version and language scopes
+	Refetch           bool   `json:"refetch"`
+}
+
+// bustCacheResponse reports the latest version before and after the bust. A version of 0 means there was none.
+type bustCacheResponse struct {
+	Scope         string   `json:"scope"`
+	BeforeVersion int      `json:"beforeVersion"`
+	AfterVersion  int      `json:"afterVersion"`
+	RemovedKeys   []string `json:"removedKeys"`
+	Refetched     bool     `json:"refetched"`
+}
+
+// auditRecord is written to the log for every change made to the cache on behalf of a caller
+type auditRecord struct {
+	Time       time.Time         `json:"time"`
+	Caller     string            `json:"caller"`
+	RemoteAddr string            `json:"remoteAddr"`
+	Action     string            `json:"action"`
+	Request    bustCacheRequest  `json:"request"`
+	Response   bustCacheResponse `json:"response"`
+	Error      string            `json:"error,omitempty"`
+}
+
+func writeAuditRecord(record auditRecord) {
+	b, err := json.Marshal(record)
+	if err != nil {
+		l4g.Error("Could not write audit record: %v", err)
+		return
+	}
+	l4g.Info("AUDIT %s", b)
+}
+
+func (bust *bustCacheRequest) validate() error {
+	if bust.Language == "" {
+		bust.Language = defaultLanguage
+	}
+	switch bust.Scope {
+	case bustScopeAll, bustScopeLanguage, bustScopeL1:
+		return nil
+	case bustScopeVersion:
+		if bust.VendorListVersion <= 0 {
+			return errors.New("the version scope needs a vendorListVersion")
+		}
+		return nil
+	}
+	return errors.New(`scope must be one of "all", "version", "language" or "l1"`)
+}
+
+// latestVersion is the version of the list currently served for a language, or 0 when there is none
+func latestVersion(language string) int {
+	if snap := currentSnapshot(language); snap != nil {
+		return snap.GVL.VendorListVersion
+	}
+	if snap, err := loadLatestVersion(language); err == nil {
+		return snap.GVL.VendorListVersion
+	}
+	return 0
+}
+
+// bustCache removes what the request's scope names from the cache, and fetches the list again if asked to
+func bustCache(bust bustCacheRequest) (bustCacheResponse, error) {
+	result := bustCacheResponse{Scope: bust.Scope, RemovedKeys: []string{}, BeforeVersion: latestVersion(bust.Language)}
+
+	var removed []string
+	var err error
+	switch bust.Scope {
+	case bustScopeAll:
+		dropSnapshot("")
+		dropArchivedVersions(0)
+		for _, language := range languagesToCollect() {
+			var keys []string
+			keys, err = invalidateLanguage(language)
+			removed = append(removed, keys...)
+			if err != nil {
+				break
+			}
+		}
+	case bustScopeLanguage:
+		dropSnapshot(bust.Language)
+		removed, err = invalidateLanguage(bust.Language)
+	case bustScopeVersion:
+		if snap := currentSnapshot(bust.Language); snap != nil && snap.GVL.VendorListVersion == bust.VendorListVersion {
+			dropSnapshot(bust.Language)
+		}
+		dropArchivedVersions(bust.VendorListVersion)
+		removed, err = invalidateVersion(gvlSpecificationVersion, bust.VendorListVersion, bust.Language)
+	case bustScopeL1:
+		dropSnapshot(bust.Language)
+		dropArchivedVersions(0)
+	}
+	result.RemovedKeys = append(result.RemovedKeys, removed...)
+	if err != nil {
+		return result, err
+	}
+
+	if bust.Refetch {
+		if _, err := refreshGVL(); err != nil {
+			return result, err
+		}
+		result.Refetched = true
+	}
+	result.AfterVersion = latestVersion(bust.Language)
+	return result, nil
+}
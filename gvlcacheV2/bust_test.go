@@ -0,0 +1,84 @@
+package gvlcachev2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func bustRequest(t *testing.T, token string, body string) *httptest.ResponseRecorder {
+	auth := &Auth{Authenticators: []Authenticator{BearerTokens{"s3cr3t": {Name: "ops", Scopes: []string{ScopeBust}}}}}
+	req := httptest.NewRequest(http.MethodPost, "/GVLV2Cache/bustCache", strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rw := httptest.NewRecorder()
+	auth.Require(ScopeBust)(http.HandlerFunc(HandleRequestForBustingCache)).ServeHTTP(rw, req)
+	return rw
+}
+
+func TestHandleRequestForBustingCacheRequiresToken(t *testing.T) {
+	useMemoryCache(t)
+	for _, token := range []string{"", "wrong"} {
+		if rw := bustRequest(t, token, `{"scope":"all"}`); rw.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: status = %d, want 401", token, rw.Code)
+		}
+	}
+
+	// Only the principal the auth middleware sets is trusted, a bearer token on its own is not
+	req := httptest.NewRequest(http.MethodPost, "/GVLV2Cache/bustCache", strings.NewReader(`{"scope":"all"}`))
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	rw := httptest.NewRecorder()
+	HandleRequestForBustingCache(rw, req)
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("without the middleware: status = %d, want 401", rw.Code)
+	}
+}
+
+func TestHandleRequestForBustingCacheRejectsBadScope(t *testing.T) {
+	useMemoryCache(t)
+	for _, body := range []string{`{"scope":"everything"}`, `{"scope":"version"}`, `not json`} {
+		if rw := bustRequest(t, "s3cr3t", body); rw.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", body, rw.Code)
+		}
+	}
+}
+
+func TestHandleRequestForBustingCacheVersionScope(t *testing.T) {
+	var fetches int32
+	useUpstream(t, func(rw http.ResponseWriter, req *http.Request) {
+		serveGVL(testGVL(28+int(atomic.AddInt32(&fetches, 1))), 3600)(rw, req)
+	})
+	getGVL(t)
+
+	rw := bustRequest(t, "s3cr3t", `{"scope":"version","vendorListVersion":29,"refetch":true}`)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rw.Code, rw.Body)
+	}
+	result := bustCacheResponse{}
+	json.NewDecoder(rw.Body).Decode(&result)
+	if result.BeforeVersion != 29 || result.AfterVersion != 30 || !result.Refetched {
+		t.Errorf("result = %+v", result)
+	}
+	if _, err := loadVersion(2, 29, defaultLanguage); err == nil {
+		t.Error("version 29 is still in the cache")
+	}
+}
+
+func TestHandleRequestForBustingCacheAllScope(t *testing.T) {
+	useUpstream(t, serveGVL(testGVL(29), 3600))
+	getGVL(t)
+
+	rw := bustRequest(t, "s3cr3t", `{"scope":"all"}`)
+	result := bustCacheResponse{}
+	json.NewDecoder(rw.Body).Decode(&result)
+	if result.BeforeVersion != 29 || result.AfterVersion != 0 {
+		t.Errorf("result = %+v", result)
+	}
+	if currentSnapshot(defaultLanguage) != nil {
+		t.Error("the L1 snapshot survived the bust")
+	}
+}
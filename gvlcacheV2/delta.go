@@ -0,0 +1,251 @@
+package gvlcachev2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	l4g "github.com/ezoic/log4go"
+)
+
+// jsonPatchOperation is one operation of an RFC 6902 JSON Patch
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// MarshalJSON leaves value out of remove operations only. RFC 6902 requires it of add and replace even when it is
+// null.
+func (op jsonPatchOperation) MarshalJSON() ([]byte, error) {
+	if op.Op == "remove" {
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{op.Op, op.Path})
+	}
+	type operation jsonPatchOperation
+	return json.Marshal(operation(op))
+}
+
+// gvlDelta turns one version of the list into another. When the patch would be larger than the list it turns
+// into, Full is set and the list is sent instead.
+type gvlDelta struct {
+	From       int                  `json:"from"`
+	To         int                  `json:"to"`
+	Patch      []jsonPatchOperation `json:"patch"`
+	Full       bool                 `json:"full"`
+	TargetETag string               `json:"targetETag"`
+}
+
+// maxCachedDeltas bounds the deltas kept in memory. Like the subset cache it is emptied when it fills up: every
+// delta is in memcached too, and clients only ask for the few versions before the latest.
+const maxCachedDeltas = 256
+
+var (
+	deltaMu    sync.Mutex
+	deltaCache = map[string]*gvlDelta{}
+)
+
+func rememberDelta(key string, delta *gvlDelta) {
+	deltaMu.Lock()
+	defer deltaMu.Unlock()
+	if len(deltaCache) >= maxCachedDeltas {
+		deltaCache = map[string]*gvlDelta{}
+	}
+	deltaCache[key] = delta
+}
+
+func gvlDeltaKey(from int, to int, language string) string {
+	return fmt.Sprintf("%s-delta-v%d-v%d-%s", gvlCacheKeyPrefix, from, to, language)
+}
+
+// encodeGVL is the body /GVLV2 serves for the full list
+func encodeGVL(gvl *GVLVersionTwoValue) []byte {
+	b := &bytes.Buffer{}
+	json.NewEncoder(b).Encode(gvl)
+	return b.Bytes()
+}
+
+// escapePointerToken escapes one reference token of a JSON Pointer as RFC 6901 asks for
+func escapePointerToken(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
+
+// diffJSON appends the operations that turn from into to. Objects are compared key by key, anything else is
+// replaced as a whole when it differs.
+func diffJSON(path string, from interface{}, to interface{}, patch []jsonPatchOperation) []jsonPatchOperation {
+	fromObject, fromIsObject := from.(map[string]interface{})
+	toObject, toIsObject := to.(map[string]interface{})
+	if !fromIsObject || !toIsObject {
+		if !reflect.DeepEqual(from, to) {
+			patch = append(patch, jsonPatchOperation{Op: "replace", Path: path, Value: to})
+		}
+		return patch
+	}
+
+	keys := []string{}
+	for key := range fromObject {
+		keys = append(keys, key)
+	}
+	for key := range toObject {
+		if _, ok := fromObject[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		child := path + "/" + escapePointerToken(key)
+		fromValue, inFrom := fromObject[key]
+		toValue, inTo := toObject[key]
+		switch {
+		case !inTo:
+			patch = append(patch, jsonPatchOperation{Op: "remove", Path: child})
+		case !inFrom:
+			patch = append(patch, jsonPatchOperation{Op: "add", Path: child, Value: toValue})
+		default:
+			patch = diffJSON(child, fromValue, toValue, patch)
+		}
+	}
+	return patch
+}
+
+// buildDelta computes the JSON Patch between two versions of the list, as they are encoded by /GVLV2
+func buildDelta(from *GVLVersionTwoValue, to *GVLVersionTwoValue) (*gvlDelta, error) {
+	var fromDoc, toDoc interface{}
+	target := encodeGVL(to)
+	if err := json.Unmarshal(encodeGVL(from), &fromDoc); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(target, &toDoc); err != nil {
+		return nil, err
+	}
+
+	delta := &gvlDelta{
+		From:       from.VendorListVersion,
+		To:         to.VendorListVersion,
+		Patch:      diffJSON("", fromDoc, toDoc, []jsonPatchOperation{}),
+		TargetETag: etagFor(target),
+	}
+	encoded, err := json.Marshal(delta.Patch)
+	if err != nil {
+		return nil, err
+	}
+	if len(encoded) >= len(target) {
+		delta.Patch = nil
+		delta.Full = true
+	}
+	return delta, nil
+}
+
+func storeDelta(delta *gvlDelta, language string) {
+	key := gvlDeltaKey(delta.From, delta.To, language)
+	rememberDelta(key, delta)
+	if err := cache.ReplaceKeyObject(cacheBucket, key, delta, versionKeyExpiry); err != nil {
+		l4g.Warn("Could not store the GVL delta %s: %v", key, err)
+	}
+}
+
+// deltaBetween returns the delta from a version to the given list, from the cache when it was computed before
+func deltaBetween(since int, to *GVLVersionTwoValue, language string) (*gvlDelta, error) {
+	key := gvlDeltaKey(since, to.VendorListVersion, language)
+	deltaMu.Lock()
+	delta, ok := deltaCache[key]
+	deltaMu.Unlock()
+	if ok {
+		return delta, nil
+	}
+	delta = &gvlDelta{}
+	if err := cache.LoadKeyObject(cacheBucket, key, delta); err == nil && delta.TargetETag != "" {
+		rememberDelta(key, delta)
+		return delta, nil
+	}
+
+	from, err := fetchArchivedVersion(since)
+	if err != nil {
+		return nil, err
+	}
+	delta, err = buildDelta(from, to)
+	if err != nil {
+		return nil, err
+	}
+	storeDelta(delta, language)
+	return delta, nil
+}
+
+// precomputeDeltas builds the deltas from every retained version of the list to one that was just promoted, so
+// clients asking for them right after the promotion don't wait on the diff
+func precomputeDeltas(to *GVLVersionTwoValue, language string) {
+	index := gvlVersionIndex{}
+	if err := cache.LoadKeyObject(cacheBucket, gvlIndexKey(language), &index); err != nil {
+		return
+	}
+	for _, version := range index.Versions {
+		if version.VendorListVersion >= to.VendorListVersion {
+			continue
+		}
+		from, err := loadVersion(gvlSpecificationVersion, version.VendorListVersion, language)
+		if err != nil {
+			continue
+		}
+		delta, err := buildDelta(from, to)
+		if err != nil {
+			l4g.Warn("Could not build the GVL delta from version %d: %v", version.VendorListVersion, err)
+			continue
+		}
+		storeDelta(delta, language)
+	}
+}
+
+// HandleRequestForDelta returns the JSON Patch that turns the version of the list given as since into the latest
+// one, with the ETag the patched list will have. When the patch would be larger than the list, the list itself is
+// returned instead. The X-GVL-Delta header says which of the two the body is.
+func HandleRequestForDelta(rw http.ResponseWriter, req *http.Request) {
+	since, err := strconv.Atoi(req.URL.Query().Get("since"))
+	if err != nil || since <= 0 {
+		writeError(rw, req, validationFailed("since must be a vendor list version"))
+		return
+	}
+	lookup, err := lookupGVL(defaultLanguage)
+	if err != nil {
+		l4g.Error(err)
+		writeError(rw, req, latestListUnavailable(err, "There was an error returning the vendor list from IAB's server."))
+		return
+	}
+	if since > lookup.GVL.VendorListVersion {
+		writeError(rw, req, validationFailed(fmt.Sprintf("version %d is newer than the latest version %d", since, lookup.GVL.VendorListVersion)))
+		return
+	}
+	if lookup.Stale {
+		setStaleHeaders(rw, lookup)
+	}
+
+	delta, err := deltaBetween(since, lookup.GVL, defaultLanguage)
+	if err != nil {
+		l4g.Error(err)
+		writeError(rw, req, upstreamUnavailable(err, http.StatusBadGateway, "There was an error building the delta."))
+		return
+	}
+
+	rw.Header().Set("X-GVL-Target-ETag", delta.TargetETag)
+	rw.Header().Set("X-GVL-Target-Version", strconv.Itoa(delta.To))
+	if delta.Full {
+		rw.Header().Set("X-GVL-Delta", "full")
+		if err := writeCacheableJSON(rw, req, lookup, encodeGVL(lookup.GVL)); err != nil {
+			l4g.Error(err)
+		}
+		return
+	}
+	b := &bytes.Buffer{}
+	json.NewEncoder(b).Encode(delta.Patch)
+	rw.Header().Set("X-GVL-Delta", "patch")
+	if err := writeCacheableJSON(rw, req, lookup, b.Bytes()); err != nil {
+		l4g.Error(err)
+	}
+}
@@ -0,0 +1,163 @@
+package gvlcachev2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// applyPatch applies the object operations diffJSON produces to a decoded document
+func applyPatch(t *testing.T, doc interface{}, patch []jsonPatchOperation) interface{} {
+	for _, op := range patch {
+		tokens := strings.Split(op.Path, "/")[1:]
+		if len(tokens) == 0 {
+			doc = op.Value
+			continue
+		}
+		parent := doc.(map[string]interface{})
+		for _, token := range tokens[:len(tokens)-1] {
+			parent = parent[strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)].(map[string]interface{})
+		}
+		last := strings.Replace(strings.Replace(tokens[len(tokens)-1], "~1", "/", -1), "~0", "~", -1)
+		switch op.Op {
+		case "remove":
+			delete(parent, last)
+		case "add", "replace":
+			parent[last] = op.Value
+		default:
+			t.Fatalf("unexpected operation %q", op.Op)
+		}
+	}
+	return doc
+}
+
+func decodeGVL(t *testing.T, gvl *GVLVersionTwoValue) interface{} {
+	var doc interface{}
+	if err := json.Unmarshal(encodeGVL(gvl), &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestBuildDeltaPatchesToTarget(t *testing.T) {
+	from, to := diffTestVersions()
+	to.Vendors[12] = GVLVersionTwoVendor{ID: 12, Name: "New/Co~"}
+	delta, err := buildDelta(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delta.Full || delta.From != 28 || delta.To != 29 {
+		t.Fatalf("delta = %+v", delta)
+	}
+	if delta.TargetETag != etagFor(encodeGVL(to)) {
+		t.Errorf("target ETag = %s, want the ETag of the full list", delta.TargetETag)
+	}
+	if patched := applyPatch(t, decodeGVL(t, from), delta.Patch); !reflect.DeepEqual(patched, decodeGVL(t, to)) {
+		t.Errorf("the patch does not turn version 28 into version 29: %+v", delta.Patch)
+	}
+}
+
+func TestPatchOperationsCarryNullValues(t *testing.T) {
+	b, err := json.Marshal([]jsonPatchOperation{
+		{Op: "replace", Path: "/vendors/8/deletedDate", Value: nil},
+		{Op: "add", Path: "/vendors/9", Value: nil},
+		{Op: "remove", Path: "/vendors/10"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"op":"replace","path":"/vendors/8/deletedDate","value":null},{"op":"add","path":"/vendors/9","value":null},{"op":"remove","path":"/vendors/10"}]`
+	if string(b) != want {
+		t.Errorf("patch = %s\nwant %s", b, want)
+	}
+}
+
+func TestBuildDeltaFallsBackToFullList(t *testing.T) {
+	from, to := testGVL(28), testGVL(29)
+	for id := 1; id <= 20; id++ {
+		vendor := func(n int, text string) GVLVersionTwoVendor {
+			return GVLVersionTwoVendor{ID: id, Name: text, Purposes: []int{n}, SpecialPurposes: []int{n}, LegIntPurposes: []int{n},
+				FlexiblePurposes: []int{n}, Features: []int{n}, SpecialFeatures: []int{n}, PolicyURL: text, DeletedDate: text}
+		}
+		from.Vendors[id] = vendor(1, "a")
+		to.Vendors[id] = vendor(2, "b")
+	}
+	delta, err := buildDelta(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !delta.Full || delta.Patch != nil {
+		t.Errorf("delta = %+v, want the full list", delta)
+	}
+}
+
+func TestDeltaCacheIsBounded(t *testing.T) {
+	useMemoryCache(t)
+	for from := 1; from <= maxCachedDeltas+1; from++ {
+		rememberDelta(gvlDeltaKey(from, 1000, defaultLanguage), &gvlDelta{From: from, To: 1000})
+	}
+	deltaMu.Lock()
+	defer deltaMu.Unlock()
+	if len(deltaCache) > maxCachedDeltas {
+		t.Errorf("%d deltas are kept in memory", len(deltaCache))
+	}
+}
+
+func TestHandleRequestForDelta(t *testing.T) {
+	from, to := diffTestVersions()
+	useArchive(t, from)
+	snap, err := promoteVersion(to, defaultLanguage, time.Now().Add(time.Hour), gvlSource{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setSnapshot(snap)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		HandleRequestForDelta(rw, httptest.NewRequest(http.MethodGet, "/GVLV2/delta"+query, nil))
+		return rw
+	}
+	rw := get("?since=28")
+	patch := []jsonPatchOperation{}
+	json.NewDecoder(rw.Body).Decode(&patch)
+	if rw.Code != http.StatusOK || rw.Header().Get("X-GVL-Delta") != "patch" || len(patch) == 0 {
+		t.Fatalf("status = %d, headers = %v, patch = %+v", rw.Code, rw.Header(), patch)
+	}
+	if rw.Header().Get("X-GVL-Target-ETag") != getGVL(t).Header().Get("ETag") || rw.Header().Get("X-GVL-Target-Version") != "29" {
+		t.Errorf("target headers = %v", rw.Header())
+	}
+	if _, ok := deltaCache[gvlDeltaKey(28, 29, defaultLanguage)]; !ok {
+		t.Errorf("the delta was not cached")
+	}
+
+	if rw := get("?since=29"); rw.Code != http.StatusOK || strings.TrimSpace(rw.Body.String()) != "[]" {
+		t.Errorf("same version: status = %d, body = %s", rw.Code, rw.Body)
+	}
+	for query, status := range map[string]int{"": http.StatusBadRequest, "?since=30": http.StatusBadRequest, "?since=27": http.StatusNotFound} {
+		if rw := get(query); rw.Code != status {
+			t.Errorf("%q: status = %d, want %d", query, rw.Code, status)
+		}
+	}
+}
+
+func TestPromotionPrecomputesDeltas(t *testing.T) {
+	from, to := diffTestVersions()
+	served := from
+	useUpstream(t, func(rw http.ResponseWriter, req *http.Request) { serveGVL(served, 3600)(rw, req) })
+	if _, err := refreshGVL(); err != nil {
+		t.Fatal(err)
+	}
+	served = to
+	if _, err := refreshGVL(); err != nil {
+		t.Fatal(err)
+	}
+
+	delta := &gvlDelta{}
+	if err := cache.LoadKeyObject(cacheBucket, gvlDeltaKey(28, 29, defaultLanguage), delta); err != nil || delta.TargetETag == "" {
+		t.Errorf("delta from version 28 was not stored on promotion: %v", err)
+	}
+}
@@ -0,0 +1,342 @@
+package gvlcachev2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	l4g "github.com/ezoic/log4go"
+)
+
+// VersionDiff is what changed between two versions of the vendor list
+type VersionDiff struct {
+	From                int             `json:"from"`
+	To                  int             `json:"to"`
+	AddedVendors        []VendorSummary `json:"addedVendors"`
+	RemovedVendors      []VendorSummary `json:"removedVendors"`
+	NewlyDeletedVendors []VendorSummary `json:"newlyDeletedVendors"`
+	ChangedVendors      []VendorChange  `json:"changedVendors"`
+	// ChangedText lists the purposes, special purposes, features, special features and stacks whose text changed
+	ChangedText []TextChange `json:"changedText"`
+}
+
+// VendorSummary names a vendor in a diff
+type VendorSummary struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	DeletedDate string `json:"deletedDate,omitempty"`
+}
+
+// VendorChange lists the declarations of a vendor that changed. Declarations that did not change are nil.
+type VendorChange struct {
+	ID               int                    `json:"id"`
+	Name             string                 `json:"name"`
+	Purposes         *IDSetChange           `json:"purposes,omitempty"`
+	LegIntPurposes   *IDSetChange           `json:"legIntPurposes,omitempty"`
+	FlexiblePurposes *IDSetChange           `json:"flexiblePurposes,omitempty"`
+	SpecialPurposes  *IDSetChange           `json:"specialPurposes,omitempty"`
+	Features         *IDSetChange           `json:"features,omitempty"`
+	SpecialFeatures  *IDSetChange           `json:"specialFeatures,omitempty"`
+	PolicyURL        *ValueChange           `json:"policyUrl,omitempty"`
+	Overflow         *GVLVersionTwoOverflow `json:"overflow,omitempty"` // the new overflow, when it changed
+}
+
+// IDSetChange is the ids added to and removed from a list of ids
+type IDSetChange struct {
+	Added   []int `json:"added"`
+	Removed []int `json:"removed"`
+}
+
+// ValueChange is a value before and after
+type ValueChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// TextChange flags an entry whose text changed, was added or was removed
+type TextChange struct {
+	Kind   string   `json:"kind"`
+	ID     int      `json:"id"`
+	Name   string   `json:"name"`
+	Fields []string `json:"fields"` // the fields that changed, or "added" or "removed"
+}
+
+// DiffVersions fetches two versions of the vendor list and reports what changed between them
+func DiffVersions(from int, to int) (*VersionDiff, error) {
+	fromGVL, err := fetchArchivedVersion(from)
+	if err != nil {
+		return nil, err
+	}
+	toGVL, err := fetchArchivedVersion(to)
+	if err != nil {
+		return nil, err
+	}
+	return diffGVL(fromGVL, toGVL), nil
+}
+
+func diffGVL(from *GVLVersionTwoValue, to *GVLVersionTwoValue) *VersionDiff {
+	diff := &VersionDiff{
+		From:                from.VendorListVersion,
+		To:                  to.VendorListVersion,
+		AddedVendors:        []VendorSummary{},
+		RemovedVendors:      []VendorSummary{},
+		NewlyDeletedVendors: []VendorSummary{},
+		ChangedVendors:      []VendorChange{},
+		ChangedText:         []TextChange{},
+	}
+
+	for _, id := range sortedKeys(to.Vendors) {
+		vendor := to.Vendors[id]
+		old, existed := from.Vendors[id]
+		if !existed {
+			diff.AddedVendors = append(diff.AddedVendors, VendorSummary{ID: id, Name: vendor.Name, DeletedDate: vendor.DeletedDate})
+			continue
+		}
+		if vendor.DeletedDate != "" && old.DeletedDate == "" {
+			diff.NewlyDeletedVendors = append(diff.NewlyDeletedVendors, VendorSummary{ID: id, Name: vendor.Name, DeletedDate: vendor.DeletedDate})
+		}
+		if change, changed := diffVendor(old, vendor); changed {
+			diff.ChangedVendors = append(diff.ChangedVendors, change)
+		}
+	}
+	for _, id := range sortedKeys(from.Vendors) {
+		if _, ok := to.Vendors[id]; !ok {
+			diff.RemovedVendors = append(diff.RemovedVendors, VendorSummary{ID: id, Name: from.Vendors[id].Name})
+		}
+	}
+
+	diff.ChangedText = append(diff.ChangedText, diffText("purpose", textsOfPurposes(from.Purposes), textsOfPurposes(to.Purposes))...)
+	diff.ChangedText = append(diff.ChangedText, diffText("specialPurpose", textsOfSpecialPurposes(from.SpecialPurposes), textsOfSpecialPurposes(to.SpecialPurposes))...)
+	diff.ChangedText = append(diff.ChangedText, diffText("feature", textsOfFeatures(from.Features), textsOfFeatures(to.Features))...)
+	diff.ChangedText = append(diff.ChangedText, diffText("specialFeature", textsOfSpecialFeatures(from.SpecialFeatures), textsOfSpecialFeatures(to.SpecialFeatures))...)
+	diff.ChangedText = append(diff.ChangedText, diffText("stack", textsOfStacks(from.Stacks), textsOfStacks(to.Stacks))...)
+	return diff
+}
+
+func diffVendor(from GVLVersionTwoVendor, to GVLVersionTwoVendor) (VendorChange, bool) {
+	change := VendorChange{
+		ID:               to.ID,
+		Name:             to.Name,
+		Purposes:         diffIDs(from.Purposes, to.Purposes),
+		LegIntPurposes:   diffIDs(from.LegIntPurposes, to.LegIntPurposes),
+		FlexiblePurposes: diffIDs(from.FlexiblePurposes, to.FlexiblePurposes),
+		SpecialPurposes:  diffIDs(from.SpecialPurposes, to.SpecialPurposes),
+		Features:         diffIDs(from.Features, to.Features),
+		SpecialFeatures:  diffIDs(from.SpecialFeatures, to.SpecialFeatures),
+	}
+	if from.PolicyURL != to.PolicyURL {
+		change.PolicyURL = &ValueChange{From: from.PolicyURL, To: to.PolicyURL}
+	}
+	if from.Overflow != to.Overflow {
+		overflow := to.Overflow
+		change.Overflow = &overflow
+	}
+	changed := change.Purposes != nil || change.LegIntPurposes != nil || change.FlexiblePurposes != nil ||
+		change.SpecialPurposes != nil || change.Features != nil || change.SpecialFeatures != nil ||
+		change.PolicyURL != nil || change.Overflow != nil
+	return change, changed
+}
+
+// diffIDs returns nil when both lists hold the same ids
+func diffIDs(from []int, to []int) *IDSetChange {
+	inFrom, inTo := map[int]bool{}, map[int]bool{}
+	markAll(inFrom, from)
+	markAll(inTo, to)
+	change := &IDSetChange{Added: []int{}, Removed: []int{}}
+	for id := range inTo {
+		if !inFrom[id] {
+			change.Added = append(change.Added, id)
+		}
+	}
+	for id := range inFrom {
+		if !inTo[id] {
+			change.Removed = append(change.Removed, id)
+		}
+	}
+	if len(change.Added) == 0 && len(change.Removed) == 0 {
+		return nil
+	}
+	sort.Ints(change.Added)
+	sort.Ints(change.Removed)
+	return change
+}
+
+// entryText is the text of a purpose, feature or stack, field by field
+type entryText struct {
+	name   string
+	fields map[string]string
+}
+
+func diffText(kind string, from map[int]entryText, to map[int]entryText) []TextChange {
+	changes := []TextChange{}
+	ids := map[int]bool{}
+	for id := range from {
+		ids[id] = true
+	}
+	for id := range to {
+		ids[id] = true
+	}
+	sorted := []int{}
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Ints(sorted)
+
+	for _, id := range sorted {
+		old, existed := from[id]
+		current, exists := to[id]
+		switch {
+		case !existed:
+			changes = append(changes, TextChange{Kind: kind, ID: id, Name: current.name, Fields: []string{"added"}})
+		case !exists:
+			changes = append(changes, TextChange{Kind: kind, ID: id, Name: old.name, Fields: []string{"removed"}})
+		default:
+			fields := []string{}
+			for field, text := range current.fields {
+				if old.fields[field] != text {
+					fields = append(fields, field)
+				}
+			}
+			if len(fields) > 0 {
+				sort.Strings(fields)
+				changes = append(changes, TextChange{Kind: kind, ID: id, Name: current.name, Fields: fields})
+			}
+		}
+	}
+	return changes
+}
+
+func purposeText(name string, description string, descriptionLegal string) entryText {
+	return entryText{name: name, fields: map[string]string{"name": name, "description": description, "descriptionLegal": descriptionLegal}}
+}
+
+func textsOfPurposes(entries map[int]GVLVersionTwoPurpose) map[int]entryText {
+	texts := map[int]entryText{}
+	for id, e := range entries {
+		texts[id] = purposeText(e.Name, e.Description, e.DescriptionLegal)
+	}
+	return texts
+}
+
+func textsOfSpecialPurposes(entries map[int]GVLVersionTwoSpecialPurpose) map[int]entryText {
+	texts := map[int]entryText{}
+	for id, e := range entries {
+		texts[id] = purposeText(e.Name, e.Description, e.DescriptionLegal)
+	}
+	return texts
+}
+
+func textsOfFeatures(entries map[int]GVLVersionTwoFeature) map[int]entryText {
+	texts := map[int]entryText{}
+	for id, e := range entries {
+		texts[id] = purposeText(e.Name, e.Description, e.DescriptionLegal)
+	}
+	return texts
+}
+
+func textsOfSpecialFeatures(entries map[int]GVLVersionTwoSpecialFeature) map[int]entryText {
+	texts := map[int]entryText{}
+	for id, e := range entries {
+		texts[id] = purposeText(e.Name, e.Description, e.DescriptionLegal)
+	}
+	return texts
+}
+
+func textsOfStacks(entries map[int]GVLVersionTwoStack) map[int]entryText {
+	texts := map[int]entryText{}
+	for id, e := range entries {
+		texts[id] = entryText{name: e.Name, fields: map[string]string{
+			"name":            e.Name,
+			"description":     e.Description,
+			"purposes":        fmt.Sprint(e.Purposes),
+			"specialFeatures": fmt.Sprint(e.SpecialFeatures),
+		}}
+	}
+	return texts
+}
+
+func sortedKeys(vendors map[int]GVLVersionTwoVendor) []int {
+	ids := []int{}
+	for id := range vendors {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Summary is the diff in plain text, one line per change
+func (diff *VersionDiff) Summary() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "Changes from vendor list version %d to %d\n", diff.From, diff.To)
+	for _, vendor := range diff.AddedVendors {
+		fmt.Fprintf(b, "+ vendor %d %s\n", vendor.ID, vendor.Name)
+	}
+	for _, vendor := range diff.RemovedVendors {
+		fmt.Fprintf(b, "- vendor %d %s\n", vendor.ID, vendor.Name)
+	}
+	for _, vendor := range diff.NewlyDeletedVendors {
+		fmt.Fprintf(b, "x vendor %d %s deleted as of %s\n", vendor.ID, vendor.Name, vendor.DeletedDate)
+	}
+	for _, change := range diff.ChangedVendors {
+		fmt.Fprintf(b, "~ vendor %d %s\n", change.ID, change.Name)
+		for _, field := range []struct {
+			name   string
+			change *IDSetChange
+		}{
+			{"purposes", change.Purposes},
+			{"legIntPurposes", change.LegIntPurposes},
+			{"flexiblePurposes", change.FlexiblePurposes},
+			{"specialPurposes", change.SpecialPurposes},
+			{"features", change.Features},
+			{"specialFeatures", change.SpecialFeatures},
+		} {
+			if field.change != nil {
+				fmt.Fprintf(b, "    %s: added %v, removed %v\n", field.name, field.change.Added, field.change.Removed)
+			}
+		}
+		if change.PolicyURL != nil {
+			fmt.Fprintf(b, "    policyUrl: %s -> %s\n", change.PolicyURL.From, change.PolicyURL.To)
+		}
+		if change.Overflow != nil {
+			fmt.Fprintf(b, "    overflow: httpGetLimit %d\n", change.Overflow.HTTPGetLimit)
+		}
+	}
+	for _, change := range diff.ChangedText {
+		fmt.Fprintf(b, "! %s %d %s: %s\n", change.Kind, change.ID, change.Name, strings.Join(change.Fields, ", "))
+	}
+	return b.String()
+}
+
+// HandleVersionDiff reports what changed between the versions given as from and to. The report is JSON unless
+// ?format=text asks for the plain summary.
+func HandleVersionDiff(rw http.ResponseWriter, req *http.Request) {
+	from, fromErr := strconv.Atoi(req.URL.Query().Get("from"))
+	to, toErr := strconv.Atoi(req.URL.Query().Get("to"))
+	if fromErr != nil || toErr != nil || from <= 0 || to <= 0 {
+		writeError(rw, req, validationFailed("from and to must both be vendor list versions"))
+		return
+	}
+
+	diff, err := DiffVersions(from, to)
+	if err != nil {
+		l4g.Error(err)
+		writeError(rw, req, upstreamUnavailable(err, http.StatusBadGateway, "There was an error fetching the vendor lists to compare."))
+		return
+	}
+
+	if req.URL.Query().Get("format") == "text" {
+		rw.Header().Add("Content-Type", "text/plain; charset=utf-8")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte(diff.Summary()))
+		return
+	}
+	b := &bytes.Buffer{}
+	json.NewEncoder(b).Encode(diff)
+	rw.Header().Add("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(b.Bytes())
+}
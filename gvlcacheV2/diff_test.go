@@ -0,0 +1,154 @@
+package gvlcachev2
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useArchive serves the given versions as IAB's archive does and 404s for every other version. It returns the
+// number of requests the archive received.
+func useArchive(t *testing.T, versions ...*GVLVersionTwoValue) *int32 {
+	var requests int32
+	useUpstream(t, func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		for _, gvl := range versions {
+			if strings.HasSuffix(req.URL.Path, "-v"+strconv.Itoa(gvl.VendorListVersion)+".json") {
+				serveGVL(gvl, 3600)(rw, req)
+				return
+			}
+		}
+		http.NotFound(rw, req)
+	})
+	previous := ArchiveURLFormat
+	ArchiveURLFormat = UpstreamURL + "/v2/archives/vendor-list-v%d.json"
+	t.Cleanup(func() { ArchiveURLFormat = previous })
+	return &requests
+}
+
+func diffTestVersions() (*GVLVersionTwoValue, *GVLVersionTwoValue) {
+	from := subsetTestGVL()
+	from.VendorListVersion = 28
+	from.Vendors[3] = GVLVersionTwoVendor{ID: 3, Name: "Gone Ltd"}
+
+	to := subsetTestGVL()
+	to.Purposes[3] = GVLVersionTwoPurpose{ID: 3, Name: "Create a personalised ads profile", DescriptionLegal: "New legal text"}
+	vendor := to.Vendors[744]
+	vendor.Purposes = []int{1, 4}
+	vendor.PolicyURL = "https://vidazoo.example/privacy"
+	vendor.Overflow.HTTPGetLimit = 128
+	to.Vendors[744] = vendor
+	deleted := to.Vendors[8]
+	deleted.DeletedDate = "2020-06-01T00:00:00Z"
+	to.Vendors[8] = deleted
+	to.Vendors[12] = GVLVersionTwoVendor{ID: 12, Name: "New Co"}
+	return from, to
+}
+
+func TestDiffGVL(t *testing.T) {
+	diff := diffGVL(diffTestVersions())
+
+	if len(diff.AddedVendors) != 1 || diff.AddedVendors[0].ID != 12 {
+		t.Errorf("added = %+v", diff.AddedVendors)
+	}
+	if len(diff.RemovedVendors) != 1 || diff.RemovedVendors[0].ID != 3 {
+		t.Errorf("removed = %+v", diff.RemovedVendors)
+	}
+	if len(diff.NewlyDeletedVendors) != 1 || diff.NewlyDeletedVendors[0].ID != 8 {
+		t.Errorf("newly deleted = %+v", diff.NewlyDeletedVendors)
+	}
+	if len(diff.ChangedVendors) != 1 {
+		t.Fatalf("changed = %+v", diff.ChangedVendors)
+	}
+	change := diff.ChangedVendors[0]
+	if change.ID != 744 || change.Purposes == nil || change.Purposes.Added[0] != 4 || change.Purposes.Removed[0] != 3 {
+		t.Errorf("purposes change = %+v", change.Purposes)
+	}
+	if change.PolicyURL == nil || change.SpecialFeatures != nil || change.Overflow == nil || change.Overflow.HTTPGetLimit != 128 {
+		t.Errorf("change = %+v", change)
+	}
+	if len(diff.ChangedText) != 1 || diff.ChangedText[0].Fields[0] != "descriptionLegal" {
+		t.Errorf("text changes = %+v", diff.ChangedText)
+	}
+}
+
+func TestHandleVersionDiffUsesArchive(t *testing.T) {
+	from, to := diffTestVersions()
+	useArchive(t, from, to)
+
+	rw := httptest.NewRecorder()
+	HandleVersionDiff(rw, httptest.NewRequest(http.MethodGet, "/GVLV2/diff?from=28&to=29", nil))
+	diff := VersionDiff{}
+	json.NewDecoder(rw.Body).Decode(&diff)
+	if rw.Code != http.StatusOK || diff.From != 28 || diff.To != 29 || len(diff.AddedVendors) != 1 {
+		t.Errorf("status = %d, diff = %+v", rw.Code, diff)
+	}
+	if _, err := loadVersion(gvlSpecificationVersion, 28, defaultLanguage); err != nil {
+		t.Errorf("the archived version was not stored: %v", err)
+	}
+
+	rw = httptest.NewRecorder()
+	HandleVersionDiff(rw, httptest.NewRequest(http.MethodGet, "/GVLV2/diff?from=28&to=31", nil))
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("missing version: status = %d, want 404", rw.Code)
+	}
+}
+
+func TestFetchArchivedVersionCachesAnswers(t *testing.T) {
+	from, to := diffTestVersions()
+	requests := useArchive(t, from, to)
+
+	for i := 0; i < 2; i++ {
+		if gvl, err := fetchArchivedVersion(28); err != nil || gvl.VendorListVersion != 28 {
+			t.Fatalf("version 28: %v, %v", gvl, err)
+		}
+		if _, err := fetchArchivedVersion(31); !errors.As(err, &versionNotFoundError{}) {
+			t.Fatalf("version 31: err = %v", err)
+		}
+	}
+	if *requests != 2 {
+		t.Errorf("the archive was asked %d times, want once per version", *requests)
+	}
+
+	// The archive is behind a breaker of its own
+	for i := 0; i < BreakerFailureThreshold; i++ {
+		archiveCircuit.record(errors.New("IAB is down"))
+	}
+	if _, err := fetchArchivedVersion(29); err != errCircuitOpen {
+		t.Errorf("with the breaker open: err = %v", err)
+	}
+	if *requests != 2 {
+		t.Errorf("the archive was asked %d times with the breaker open", *requests)
+	}
+	if _, err := fetchArchivedVersion(28); err != nil {
+		t.Errorf("a cached version is served with the breaker open: %v", err)
+	}
+}
+
+func TestArchiveCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	useMemoryCache(t)
+	for version := 1; version <= archiveCacheSize; version++ {
+		cacheArchivedVersion(&archivedVersion{vendorListVersion: version, gvl: testGVL(version)})
+	}
+	now := time.Now()
+	cachedArchivedVersion(1, now)
+	cacheArchivedVersion(&archivedVersion{vendorListVersion: 100, missingUntil: now.Add(time.Minute)})
+	if _, ok, _ := cachedArchivedVersion(2, now); ok {
+		t.Error("version 2 was not evicted")
+	}
+	if gvl, ok, _ := cachedArchivedVersion(1, now); !ok || gvl.VendorListVersion != 1 {
+		t.Error("version 1 was evicted although it was used last")
+	}
+	if _, ok, err := cachedArchivedVersion(100, now); !ok || err == nil {
+		t.Errorf("missing version 100: ok = %v, err = %v", ok, err)
+	}
+	if _, ok, _ := cachedArchivedVersion(100, now.Add(2*time.Minute)); ok {
+		t.Error("a missing version is believed past its TTL")
+	}
+}
@@ -0,0 +1,189 @@
+package gvlcachev2
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// The codes of the error envelope. They are part of the API: clients branch on them, so existing codes must not
+// be renamed or reused for other failures.
+const (
+	// CodeUpstreamUnavailable means the list could not be fetched from IAB and there was no copy to fall back on
+	CodeUpstreamUnavailable = "UPSTREAM_UNAVAILABLE"
+	// CodeValidationFailed means the request was malformed: a bad parameter, body or id
+	CodeValidationFailed = "VALIDATION_FAILED"
+	// CodeVersionNotFound means IAB does not have the vendor list version that was asked for
+	CodeVersionNotFound = "VERSION_NOT_FOUND"
+	// CodeCacheBackendDown means memcached could not be read from or written to
+	CodeCacheBackendDown = "CACHE_BACKEND_DOWN"
+	// CodeNotFound means the vendor, purpose, feature or stack asked for is not in the list
+	CodeNotFound = "NOT_FOUND"
+	// CodeUnauthorized means the request did not carry valid credentials
+	CodeUnauthorized = "UNAUTHORIZED"
+	// CodeForbidden means the caller was not granted the scope the request needs
+	CodeForbidden = "FORBIDDEN"
+	// CodeURLTooLong means an expanded URL is longer than the vendor accepts
+	CodeURLTooLong = "URL_TOO_LONG"
+	// CodeNotReady means the instance has not loaded a list yet
+	CodeNotReady = "NOT_READY"
+	// CodeInternal is every other failure
+	CodeInternal = "INTERNAL_ERROR"
+)
+
+// upstreamRetryAfter is how long clients are told to wait before retrying a request that failed on IAB or
+// memcached
+const upstreamRetryAfter = 30 * time.Second
+
+const requestIDHeader = "X-Request-ID"
+
+type requestIDContextKey struct{}
+
+// ErrorResponse is the body of every failed request:
+//
+//	{"error": {"code": "UPSTREAM_UNAVAILABLE", "message": "...", "requestId": "...", "upstreamStatus": 503, "retryAfterSeconds": 30}}
+//
+// upstreamStatus is only set when IAB answered with an error status, and retryAfterSeconds only when retrying
+// later can help, in which case the Retry-After header is set as well.
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail describes one failed request
+type ErrorDetail struct {
+	Code              string `json:"code"`
+	Message           string `json:"message"`
+	RequestID         string `json:"requestId"`
+	UpstreamStatus    int    `json:"upstreamStatus,omitempty"`
+	RetryAfterSeconds int    `json:"retryAfterSeconds,omitempty"`
+}
+
+// apiError is a failure on its way to becoming an ErrorResponse
+type apiError struct {
+	status         int
+	code           string
+	message        string
+	upstreamStatus int
+	retryAfter     time.Duration
+}
+
+func validationFailed(message string) apiError {
+	return apiError{status: http.StatusBadRequest, code: CodeValidationFailed, message: message}
+}
+
+func notFound(message string) apiError {
+	return apiError{status: http.StatusNotFound, code: CodeNotFound, message: message}
+}
+
+func urlTooLong(message string) apiError {
+	return apiError{status: http.StatusUnprocessableEntity, code: CodeURLTooLong, message: message}
+}
+
+func internalError(message string) apiError {
+	return apiError{status: http.StatusInternalServerError, code: CodeInternal, message: message}
+}
+
+func cacheBackendDown(message string) apiError {
+	return apiError{status: http.StatusServiceUnavailable, code: CodeCacheBackendDown, message: message, retryAfter: upstreamRetryAfter}
+}
+
+// upstreamUnavailable describes err, a failure to get a list from IAB. A version IAB does not have is reported
+// as VERSION_NOT_FOUND, anything else as UPSTREAM_UNAVAILABLE with the status IAB answered with.
+func upstreamUnavailable(err error, status int, message string) apiError {
+	var missing versionNotFoundError
+	if errors.As(err, &missing) {
+		return apiError{status: http.StatusNotFound, code: CodeVersionNotFound, message: missing.Error()}
+	}
+	failure := apiError{status: status, code: CodeUpstreamUnavailable, message: message, retryAfter: upstreamRetryAfter}
+	var statusErr upstreamStatusError
+	if errors.As(err, &statusErr) {
+		failure.upstreamStatus = statusErr.StatusCode
+	}
+	return failure
+}
+
+// latestListUnavailable describes err, a failure of lookupGVL. It is a 503 when the list at hand is too old to be
+// served stale any longer, and a 502 like every other failure of IAB.
+func latestListUnavailable(err error, message string) apiError {
+	status := http.StatusBadGateway
+	var expired staleListExpiredError
+	if errors.As(err, &expired) {
+		status = http.StatusServiceUnavailable
+	}
+	return upstreamUnavailable(err, status, message)
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestIDPattern is what an X-Request-ID sent by the caller must look like to be kept. The ID ends up in the
+// logs and in the response, so anything else is replaced.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// incomingRequestID returns the X-Request-ID the caller sent when it is a short token, and a new ID otherwise
+func incomingRequestID(req *http.Request) string {
+	if id := req.Header.Get(requestIDHeader); requestIDPattern.MatchString(id) {
+		return id
+	}
+	return newRequestID()
+}
+
+// RequestID gives every request an ID, taken from the X-Request-ID header when the caller sent a valid one. The ID
+// is echoed in the response header and in error responses, so a failure a client reports can be found in the logs.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		id := incomingRequestID(req)
+		rw.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), requestIDContextKey{}, id)))
+	})
+}
+
+// requestIDOf returns the ID RequestID gave the request. Requests that did not go through it get one here.
+func requestIDOf(rw http.ResponseWriter, req *http.Request) string {
+	if id, ok := req.Context().Value(requestIDContextKey{}).(string); ok {
+		return id
+	}
+	id := incomingRequestID(req)
+	rw.Header().Set(requestIDHeader, id)
+	return id
+}
+
+// writeError answers a request with the error envelope
+func writeError(rw http.ResponseWriter, req *http.Request, failure apiError) {
+	detail := ErrorDetail{
+		Code:           failure.code,
+		Message:        failure.message,
+		RequestID:      requestIDOf(rw, req),
+		UpstreamStatus: failure.upstreamStatus,
+	}
+	if failure.retryAfter > 0 {
+		detail.RetryAfterSeconds = int(failure.retryAfter / time.Second)
+		rw.Header().Set("Retry-After", strconv.Itoa(detail.RetryAfterSeconds))
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	// Errors are never cached, whatever headers were set before the failure
+	rw.Header().Del("ETag")
+	rw.Header().Del("Last-Modified")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(failure.status)
+	json.NewEncoder(rw).Encode(ErrorResponse{Error: detail})
+}
+
+// HandleNotFound answers requests for paths the router does not know
+func HandleNotFound(rw http.ResponseWriter, req *http.Request) {
+	writeError(rw, req, notFound("There is nothing at "+req.URL.Path+"."))
+}
+
+// HandleMethodNotAllowed answers requests with a method the path does not support
+func HandleMethodNotAllowed(rw http.ResponseWriter, req *http.Request) {
+	writeError(rw, req, apiError{status: http.StatusMethodNotAllowed, code: CodeValidationFailed, message: req.Method + " is not supported on " + req.URL.Path + "."})
+}
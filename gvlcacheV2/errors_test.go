@@ -0,0 +1,91 @@
+package gvlcachev2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func decodeError(t *testing.T, rw *httptest.ResponseRecorder) ErrorDetail {
+	body := ErrorResponse{}
+	if err := json.NewDecoder(rw.Body).Decode(&body); err != nil {
+		t.Fatalf("the body is not an error envelope: %v", err)
+	}
+	if rw.Header().Get("Content-Type") != "application/json" || body.Error.RequestID == "" || body.Error.RequestID != rw.Header().Get(requestIDHeader) {
+		t.Errorf("headers = %v, error = %+v", rw.Header(), body.Error)
+	}
+	return body.Error
+}
+
+func TestUpstreamFailureReportsStatusAndRetryHint(t *testing.T) {
+	useUpstream(t, func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, "down", http.StatusServiceUnavailable)
+	})
+
+	rw := getGVL(t)
+	detail := decodeError(t, rw)
+	if rw.Code != http.StatusBadGateway || detail.Code != CodeUpstreamUnavailable || detail.UpstreamStatus != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, error = %+v", rw.Code, detail)
+	}
+	if detail.RetryAfterSeconds != 30 || rw.Header().Get("Retry-After") != "30" {
+		t.Errorf("retry hint = %d, Retry-After = %q", detail.RetryAfterSeconds, rw.Header().Get("Retry-After"))
+	}
+}
+
+func TestMissingVersionIsVersionNotFound(t *testing.T) {
+	from, to := diffTestVersions()
+	useArchive(t, from, to)
+
+	rw := httptest.NewRecorder()
+	HandleVersionDiff(rw, httptest.NewRequest(http.MethodGet, "/GVLV2/diff?from=28&to=31", nil))
+	if detail := decodeError(t, rw); rw.Code != http.StatusNotFound || detail.Code != CodeVersionNotFound || detail.RetryAfterSeconds != 0 {
+		t.Errorf("status = %d, error = %+v", rw.Code, detail)
+	}
+}
+
+func TestValidationFailureAndUnauthorized(t *testing.T) {
+	useMemoryCache(t)
+
+	rw := httptest.NewRecorder()
+	HandleVendorQuery(rw, httptest.NewRequest(http.MethodGet, "/GVLV2/vendors?basis=nope", nil))
+	if detail := decodeError(t, rw); rw.Code != http.StatusBadRequest || detail.Code != CodeValidationFailed {
+		t.Errorf("status = %d, error = %+v", rw.Code, detail)
+	}
+
+	rw = httptest.NewRecorder()
+	HandleRequestForBustingCache(rw, httptest.NewRequest(http.MethodPost, "/GVLV2Cache/bustCache", nil))
+	if detail := decodeError(t, rw); rw.Code != http.StatusUnauthorized || detail.Code != CodeUnauthorized {
+		t.Errorf("status = %d, error = %+v", rw.Code, detail)
+	}
+}
+
+func TestRequestIDIsKeptFromTheCaller(t *testing.T) {
+	handler := RequestID(http.HandlerFunc(HandleNotFound))
+	req := httptest.NewRequest(http.MethodGet, "/nothing", nil)
+	req.Header.Set(requestIDHeader, "abc123")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	if detail := decodeError(t, rw); rw.Code != http.StatusNotFound || detail.RequestID != "abc123" || detail.Code != CodeNotFound {
+		t.Errorf("status = %d, error = %+v", rw.Code, detail)
+	}
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/nothing", nil))
+	if len(rw.Header().Get(requestIDHeader)) != 16 {
+		t.Errorf("generated request ID = %q", rw.Header().Get(requestIDHeader))
+	}
+
+	// IDs that aren't short tokens are not echoed or logged
+	for _, id := range []string{"abc 123", "abc\r\nX-Injected: 1", "<script>", strings.Repeat("a", 65)} {
+		req := httptest.NewRequest(http.MethodGet, "/nothing", nil)
+		req.Header[requestIDHeader] = []string{id}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		if got := rw.Header().Get(requestIDHeader); got == id || len(got) != 16 {
+			t.Errorf("request ID %q came back as %q", id, got)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package gvlcachev2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ezoic/gvlcache/tcstring"
+	l4g "github.com/ezoic/log4go"
+)
+
+// The legal bases a vendor can process under
+const (
+	basisConsent             = "consent"
+	basisLegitimateInterest  = "legitimateInterest"
+	basisSpecialFeatureOptIn = "specialFeatureOptIn"
+)
+
+// The reasons an evaluation comes to its decision
+const (
+	reasonVendorNotInList       = "vendorNotInList"
+	reasonVendorDeleted         = "vendorDeleted"
+	reasonNotDeclared           = "notDeclared"
+	reasonLINotPermitted        = "legitimateInterestNotPermitted"
+	reasonRestrictedByPublisher = "restrictedByPublisher"
+	reasonNoConsent             = "noConsent"
+	reasonObjected              = "objected"
+	reasonConsentGiven          = "consentGiven"
+	reasonLegitimateInterest    = "legitimateInterestNotObjected"
+	reasonNotOptedIn            = "notOptedIn"
+	reasonOptedIn               = "optedIn"
+	reasonNotDisclosed          = "vendorNotDisclosed"
+	reasonNotAllowedByPublisher = "vendorNotAllowed"
+	reasonNoPublisherTC         = "noPublisherTC"
+)
+
+// EvaluationRequest asks whether a vendor may process for a purpose, or use a special feature, under a TC string.
+// Exactly one of PurposeID and SpecialFeatureID is set. Without a VendorID it asks whether the publisher may
+// process for a purpose, or for one of its custom purposes, under the string's publisher TC segment.
+type EvaluationRequest struct {
+	TCString         string `json:"tcString"`
+	VendorID         int    `json:"vendorId,omitempty"`
+	PurposeID        int    `json:"purposeId,omitempty"`
+	SpecialFeatureID int    `json:"specialFeatureId,omitempty"`
+	CustomPurposeID  int    `json:"customPurposeId,omitempty"`
+}
+
+func (request *EvaluationRequest) validate() error {
+	if request.TCString == "" {
+		return errors.New("tcString must be set")
+	}
+	if request.VendorID < 0 {
+		return errors.New("vendorId must be a vendor id")
+	}
+	if request.PurposeID < 0 || request.SpecialFeatureID < 0 || request.CustomPurposeID < 0 {
+		return errors.New("purposeId, specialFeatureId and customPurposeId must be positive")
+	}
+	if request.VendorID > 0 {
+		if request.CustomPurposeID > 0 {
+			return errors.New("customPurposeId is evaluated for the publisher, leave vendorId out")
+		}
+		if (request.PurposeID > 0) == (request.SpecialFeatureID > 0) {
+			return errors.New("exactly one of purposeId and specialFeatureId must be set")
+		}
+		return nil
+	}
+	if request.SpecialFeatureID > 0 {
+		return errors.New("specialFeatureId is evaluated for a vendor, vendorId must be set")
+	}
+	if (request.PurposeID > 0) == (request.CustomPurposeID > 0) {
+		return errors.New("exactly one of purposeId and customPurposeId must be set for the publisher")
+	}
+	return nil
+}
+
+// Evaluation is the decision for an EvaluationRequest. LegalBasis is the basis the vendor processes under, or
+// would have if the user had agreed; it is empty when the vendor can't process at all. Warnings list the
+// disclosed vendors the string's version of the list does not have.
+type Evaluation struct {
+	VendorID          int      `json:"vendorId,omitempty"`
+	PurposeID         int      `json:"purposeId,omitempty"`
+	SpecialFeatureID  int      `json:"specialFeatureId,omitempty"`
+	CustomPurposeID   int      `json:"customPurposeId,omitempty"`
+	VendorListVersion int      `json:"vendorListVersion"`
+	Allowed           bool     `json:"allowed"`
+	LegalBasis        string   `json:"legalBasis"`
+	Reason            string   `json:"reason"`
+	Warnings          []string `json:"warnings,omitempty"`
+}
+
+// Evaluate decides whether a vendor may process for a purpose, or use a special feature, under a TC string, with
+// the version of the vendor list the string was made for. Without a vendor it decides for the publisher.
+func Evaluate(request EvaluationRequest) (*Evaluation, error) {
+	if err := request.validate(); err != nil {
+		return nil, err
+	}
+	tc, err := tcstring.Decode(request.TCString)
+	if err != nil {
+		return nil, err
+	}
+	gvl, err := fetchArchivedVersion(tc.VendorListVersion)
+	if err != nil {
+		return nil, err
+	}
+	var latest *GVLVersionTwoValue
+	if snap := currentSnapshot(defaultLanguage); snap != nil {
+		latest = snap.GVL
+	}
+	return evaluate(tc, gvl, latest, request, time.Now()), nil
+}
+
+// deletedBy reports whether the vendor was deleted from the list at now. A deletion date that can't be read
+// counts as past.
+func (vendor GVLVersionTwoVendor) deletedBy(now time.Time) bool {
+	if vendor.DeletedDate == "" {
+		return false
+	}
+	deleted, err := time.Parse(time.RFC3339, vendor.DeletedDate)
+	return err != nil || !deleted.After(now)
+}
+
+// legitimateInterestAllowed reports whether a purpose may be processed under legitimate interest at all. Purpose 1
+// never can, and from policy version 4 on neither can the ad and content personalisation purposes 3 to 6.
+func legitimateInterestAllowed(purposeID int, tcfPolicyVersion int) bool {
+	if purposeID == 1 {
+		return false
+	}
+	return tcfPolicyVersion < 4 || purposeID < 3 || purposeID > 6
+}
+
+// publisherRestriction returns the restriction the publisher put on a vendor for a purpose, if any
+func publisherRestriction(tc *tcstring.TCString, purposeID int, vendorID int) (tcstring.RestrictionType, bool) {
+	for _, restriction := range tc.PublisherRestrictions {
+		if restriction.PurposeID == purposeID && restriction.Vendors.Has(vendorID) {
+			return restriction.RestrictionType, true
+		}
+	}
+	return 0, false
+}
+
+// evaluate applies the TCF v2 rules. gvl is the version of the list the string was made for, latest the list
+// being served if there is one, so that vendors deleted since are refused as well.
+func evaluate(tc *tcstring.TCString, gvl *GVLVersionTwoValue, latest *GVLVersionTwoValue, request EvaluationRequest, now time.Time) *Evaluation {
+	evaluation := &Evaluation{
+		VendorID:          request.VendorID,
+		PurposeID:         request.PurposeID,
+		SpecialFeatureID:  request.SpecialFeatureID,
+		CustomPurposeID:   request.CustomPurposeID,
+		VendorListVersion: tc.VendorListVersion,
+	}
+	if problems := vendorProblems("disclosedVendors", tc.DisclosedVendors, gvl, true); len(problems) > 0 {
+		evaluation.Warnings = problems
+	}
+	deny := func(basis string, reason string) *Evaluation {
+		evaluation.LegalBasis, evaluation.Reason = basis, reason
+		return evaluation
+	}
+	allow := func(basis string, reason string) *Evaluation {
+		evaluation.Allowed = true
+		return deny(basis, reason)
+	}
+
+	if request.VendorID == 0 {
+		return evaluatePublisher(tc, request, deny, allow)
+	}
+
+	vendor, ok := gvl.Vendors[request.VendorID]
+	if !ok {
+		return deny("", reasonVendorNotInList)
+	}
+	if vendor.deletedBy(now) {
+		return deny("", reasonVendorDeleted)
+	}
+	if latest != nil {
+		if current, ok := latest.Vendors[request.VendorID]; ok && current.deletedBy(now) {
+			return deny("", reasonVendorDeleted)
+		}
+	}
+	// Vendors the user was not shown can have neither consent nor an objection they could have made
+	if tc.DisclosedVendors != nil && !tc.DisclosedVendors.Has(request.VendorID) {
+		return deny("", reasonNotDisclosed)
+	}
+	if tc.AllowedVendors != nil && !tc.AllowedVendors.Has(request.VendorID) {
+		return deny("", reasonNotAllowedByPublisher)
+	}
+
+	if request.SpecialFeatureID > 0 {
+		if !containsInt(vendor.SpecialFeatures, request.SpecialFeatureID) {
+			return deny("", reasonNotDeclared)
+		}
+		if !tc.SpecialFeatureOptIns.Has(request.SpecialFeatureID) {
+			return deny(basisSpecialFeatureOptIn, reasonNotOptedIn)
+		}
+		return allow(basisSpecialFeatureOptIn, reasonOptedIn)
+	}
+
+	purpose := request.PurposeID
+	basis := ""
+	switch {
+	case containsInt(vendor.Purposes, purpose):
+		basis = basisConsent
+	case containsInt(vendor.LegIntPurposes, purpose):
+		basis = basisLegitimateInterest
+	default:
+		return deny("", reasonNotDeclared)
+	}
+
+	// A publisher can forbid any purpose, but only switch the basis of the purposes the vendor declared flexible
+	if restriction, ok := publisherRestriction(tc, purpose, request.VendorID); ok {
+		flexible := containsInt(vendor.FlexiblePurposes, purpose)
+		switch {
+		case restriction == tcstring.NotAllowed:
+			return deny("", reasonRestrictedByPublisher)
+		case restriction == tcstring.RequireConsent && flexible:
+			basis = basisConsent
+		case restriction == tcstring.RequireLegitimateInterest && flexible:
+			basis = basisLegitimateInterest
+		}
+	}
+	if basis == basisLegitimateInterest && !legitimateInterestAllowed(purpose, tc.TCFPolicyVersion) {
+		return deny("", reasonLINotPermitted)
+	}
+
+	if basis == basisConsent {
+		if !tc.PurposesConsent.Has(purpose) || !tc.VendorConsents.Has(request.VendorID) {
+			return deny(basis, reasonNoConsent)
+		}
+		return allow(basis, reasonConsentGiven)
+	}
+	if !tc.PurposesLITransparency.Has(purpose) || !tc.VendorLegitimateInterests.Has(request.VendorID) {
+		return deny(basis, reasonObjected)
+	}
+	return allow(basis, reasonLegitimateInterest)
+}
+
+// evaluatePublisher decides from the publisher TC segment, where the publisher records consent and legitimate
+// interest for itself. It declares no basis for its purposes, so either signal allows it.
+func evaluatePublisher(tc *tcstring.TCString, request EvaluationRequest, deny func(string, string) *Evaluation, allow func(string, string) *Evaluation) *Evaluation {
+	publisher := tc.PublisherTC
+	if publisher == nil {
+		return deny("", reasonNoPublisherTC)
+	}
+	purpose, consent, legitimateInterest := request.PurposeID, publisher.PurposesConsent, publisher.PurposesLITransparency
+	if request.CustomPurposeID > 0 {
+		purpose, consent, legitimateInterest = request.CustomPurposeID, publisher.CustomPurposesConsent, publisher.CustomPurposesLITransparency
+		if purpose > publisher.NumCustomPurposes {
+			return deny("", reasonNotDeclared)
+		}
+	}
+	switch {
+	case consent.Has(purpose):
+		return allow(basisConsent, reasonConsentGiven)
+	// Custom purposes are the publisher's own, the policy's limits on legitimate interest are for the standard ones
+	case legitimateInterest.Has(purpose) && (request.CustomPurposeID > 0 || legitimateInterestAllowed(purpose, tc.TCFPolicyVersion)):
+		return allow(basisLegitimateInterest, reasonLegitimateInterest)
+	}
+	return deny("", reasonNoConsent)
+}
+
+func containsInt(ids []int, id int) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleTCFEvaluate answers whether the vendor of a JSON EvaluationRequest, or the publisher, may process for its
+// purpose or use its special feature
+func HandleTCFEvaluate(rw http.ResponseWriter, req *http.Request) {
+	request := EvaluationRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		writeError(rw, req, validationFailed("The request body is not valid JSON."))
+		return
+	}
+	if err := request.validate(); err != nil {
+		writeError(rw, req, validationFailed(err.Error()))
+		return
+	}
+
+	evaluation, err := Evaluate(request)
+	decodeErr := &tcstring.DecodeError{}
+	if errors.As(err, &decodeErr) {
+		writeError(rw, req, validationFailed(fmt.Sprintf("The TC string can't be read: %v", err)))
+		return
+	}
+	if err != nil {
+		l4g.Error(err)
+		writeError(rw, req, upstreamUnavailable(err, http.StatusBadGateway, "There was an error fetching the vendor list the TC string was made for."))
+		return
+	}
+	b := &bytes.Buffer{}
+	json.NewEncoder(b).Encode(evaluation)
+	rw.Header().Add("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(b.Bytes())
+}
@@ -0,0 +1,177 @@
+package gvlcachev2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ezoic/gvlcache/tcstring"
+)
+
+// evaluateTestGVL declares vendor 8 with purpose 1 on consent and 2 on legitimate interest, flexible, and vendor
+// 744 with purposes 1 and 3 on consent and special feature 2
+func evaluateTestGVL() *GVLVersionTwoValue {
+	gvl := subsetTestGVL()
+	vendor := gvl.Vendors[8]
+	vendor.FlexiblePurposes = []int{2}
+	gvl.Vendors[8] = vendor
+	gvl.Vendors[12] = GVLVersionTwoVendor{ID: 12, Name: "Gone Ltd", Purposes: []int{1}, DeletedDate: "2020-01-01T00:00:00Z"}
+	return gvl
+}
+
+func TestEvaluateFollowsTCFRules(t *testing.T) {
+	now := time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)
+	consentOnly := func(tc *tcstring.TCString) { tc.VendorLegitimateInterests = tcstring.IDs{} }
+	restrict := func(purpose int, restriction tcstring.RestrictionType) func(*tcstring.TCString) {
+		return func(tc *tcstring.TCString) {
+			tc.PublisherRestrictions = []tcstring.PublisherRestriction{{PurposeID: purpose, RestrictionType: restriction, Vendors: tcstring.IDs{8, 744}}}
+		}
+	}
+	for _, test := range []struct {
+		name    string
+		change  func(*tcstring.TCString)
+		request EvaluationRequest
+		allowed bool
+		basis   string
+		reason  string
+	}{
+		{"consent given", nil, EvaluationRequest{VendorID: 8, PurposeID: 1}, true, basisConsent, reasonConsentGiven},
+		{"purpose the vendor does not declare", nil, EvaluationRequest{VendorID: 744, PurposeID: 2}, false, "", reasonNotDeclared},
+		{"vendor consent missing", func(tc *tcstring.TCString) { tc.VendorConsents = tcstring.IDs{744} },
+			EvaluationRequest{VendorID: 8, PurposeID: 1}, false, basisConsent, reasonNoConsent},
+		{"legitimate interest", nil, EvaluationRequest{VendorID: 8, PurposeID: 2}, true, basisLegitimateInterest, reasonLegitimateInterest},
+		{"objected", consentOnly, EvaluationRequest{VendorID: 8, PurposeID: 2}, false, basisLegitimateInterest, reasonObjected},
+		{"not declared", nil, EvaluationRequest{VendorID: 8, PurposeID: 3}, false, "", reasonNotDeclared},
+		{"not in list", nil, EvaluationRequest{VendorID: 999, PurposeID: 1}, false, "", reasonVendorNotInList},
+		{"deleted", func(tc *tcstring.TCString) { tc.VendorConsents = tcstring.IDs{12} },
+			EvaluationRequest{VendorID: 12, PurposeID: 1}, false, "", reasonVendorDeleted},
+		{"not allowed by the publisher", restrict(1, tcstring.NotAllowed), EvaluationRequest{VendorID: 8, PurposeID: 1}, false, "", reasonRestrictedByPublisher},
+		{"consent required on a flexible purpose", restrict(2, tcstring.RequireConsent), EvaluationRequest{VendorID: 8, PurposeID: 2},
+			false, basisConsent, reasonNoConsent},
+		{"legitimate interest required on a purpose that isn't flexible", restrict(3, tcstring.RequireLegitimateInterest),
+			EvaluationRequest{VendorID: 744, PurposeID: 3}, true, basisConsent, reasonConsentGiven},
+		{"legitimate interest under policy 4", func(tc *tcstring.TCString) { tc.TCFPolicyVersion = 4 },
+			EvaluationRequest{VendorID: 8, PurposeID: 2}, true, basisLegitimateInterest, reasonLegitimateInterest},
+		{"special feature opted in", nil, EvaluationRequest{VendorID: 744, SpecialFeatureID: 2}, true, basisSpecialFeatureOptIn, reasonOptedIn},
+		{"special feature not opted in", func(tc *tcstring.TCString) { tc.SpecialFeatureOptIns = tcstring.IDs{} },
+			EvaluationRequest{VendorID: 744, SpecialFeatureID: 2}, false, basisSpecialFeatureOptIn, reasonNotOptedIn},
+		{"special feature not declared", nil, EvaluationRequest{VendorID: 8, SpecialFeatureID: 2}, false, "", reasonNotDeclared},
+		{"not disclosed to the user", func(tc *tcstring.TCString) { tc.DisclosedVendors = tcstring.IDs{744} },
+			EvaluationRequest{VendorID: 8, PurposeID: 1}, false, "", reasonNotDisclosed},
+		{"disclosed to the user", func(tc *tcstring.TCString) { tc.DisclosedVendors = tcstring.IDs{8, 744} },
+			EvaluationRequest{VendorID: 8, PurposeID: 1}, true, basisConsent, reasonConsentGiven},
+		{"not allowed by the publisher's allowed vendors", func(tc *tcstring.TCString) { tc.AllowedVendors = tcstring.IDs{744} },
+			EvaluationRequest{VendorID: 8, PurposeID: 1}, false, "", reasonNotAllowedByPublisher},
+	} {
+		tc := tcfTestString()
+		if test.change != nil {
+			test.change(tc)
+		}
+		evaluation := evaluate(tc, evaluateTestGVL(), nil, test.request, now)
+		if evaluation.Allowed != test.allowed || evaluation.LegalBasis != test.basis || evaluation.Reason != test.reason {
+			t.Errorf("%s: %+v, want allowed=%t basis=%q reason=%s", test.name, evaluation, test.allowed, test.basis, test.reason)
+		}
+	}
+}
+
+func TestEvaluateReadsThePublisherTCSegment(t *testing.T) {
+	now := time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)
+	tc := tcfTestString()
+	if evaluation := evaluate(tc, evaluateTestGVL(), nil, EvaluationRequest{PurposeID: 1}, now); evaluation.Reason != reasonNoPublisherTC {
+		t.Errorf("without the segment: %+v", evaluation)
+	}
+
+	tc.PublisherTC = &tcstring.PublisherTC{
+		PurposesConsent:              tcstring.IDs{1},
+		PurposesLITransparency:       tcstring.IDs{1, 2},
+		NumCustomPurposes:            2,
+		CustomPurposesConsent:        tcstring.IDs{},
+		CustomPurposesLITransparency: tcstring.IDs{2},
+	}
+	for _, test := range []struct {
+		request EvaluationRequest
+		allowed bool
+		basis   string
+		reason  string
+	}{
+		{EvaluationRequest{PurposeID: 1}, true, basisConsent, reasonConsentGiven},
+		{EvaluationRequest{PurposeID: 2}, true, basisLegitimateInterest, reasonLegitimateInterest},
+		{EvaluationRequest{PurposeID: 3}, false, "", reasonNoConsent},
+		{EvaluationRequest{CustomPurposeID: 1}, false, "", reasonNoConsent},
+		{EvaluationRequest{CustomPurposeID: 2}, true, basisLegitimateInterest, reasonLegitimateInterest},
+		{EvaluationRequest{CustomPurposeID: 3}, false, "", reasonNotDeclared},
+	} {
+		evaluation := evaluate(tc, evaluateTestGVL(), nil, test.request, now)
+		if evaluation.Allowed != test.allowed || evaluation.LegalBasis != test.basis || evaluation.Reason != test.reason {
+			t.Errorf("%+v: %+v, want allowed=%t basis=%q reason=%s", test.request, evaluation, test.allowed, test.basis, test.reason)
+		}
+	}
+}
+
+func TestEvaluateRefusesVendorsDeletedSince(t *testing.T) {
+	latest := evaluateTestGVL()
+	deleted := latest.Vendors[8]
+	deleted.DeletedDate = "2020-03-25T00:00:00Z"
+	latest.Vendors[8] = deleted
+
+	request := EvaluationRequest{VendorID: 8, PurposeID: 1}
+	if evaluation := evaluate(tcfTestString(), evaluateTestGVL(), latest, request, time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)); !evaluation.Allowed {
+		t.Errorf("before the deletion: %+v", evaluation)
+	}
+	if evaluation := evaluate(tcfTestString(), evaluateTestGVL(), latest, request, time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)); evaluation.Reason != reasonVendorDeleted {
+		t.Errorf("after the deletion: %+v", evaluation)
+	}
+}
+
+func postEvaluation(body string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	HandleTCFEvaluate(rw, httptest.NewRequest(http.MethodPost, "/tcf/evaluate", strings.NewReader(body)))
+	return rw
+}
+
+func TestHandleTCFEvaluateUsesTheStringsVersion(t *testing.T) {
+	old := evaluateTestGVL()
+	old.VendorListVersion = 28
+	useArchive(t, old)
+
+	tc := tcfTestString()
+	tc.VendorListVersion = 28
+	encoded, err := tcstring.Encode(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := postEvaluation(`{"tcString":"` + encoded + `","vendorId":8,"purposeId":2}`)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rw.Code, rw.Body)
+	}
+	evaluation := Evaluation{}
+	json.NewDecoder(rw.Body).Decode(&evaluation)
+	if !evaluation.Allowed || evaluation.VendorListVersion != 28 || evaluation.LegalBasis != basisLegitimateInterest {
+		t.Errorf("evaluation = %+v", evaluation)
+	}
+
+	tc.DisclosedVendors = tcstring.IDs{8, 1000}
+	encoded, _ = tcstring.Encode(tc)
+	rw = postEvaluation(`{"tcString":"` + encoded + `","vendorId":8,"purposeId":2}`)
+	evaluation = Evaluation{}
+	json.NewDecoder(rw.Body).Decode(&evaluation)
+	if !evaluation.Allowed || len(evaluation.Warnings) != 1 || !strings.Contains(evaluation.Warnings[0], "vendor 1000") {
+		t.Errorf("with disclosed vendors: %+v", evaluation)
+	}
+
+	tc.VendorListVersion = 40
+	encoded, _ = tcstring.Encode(tc)
+	for body, status := range map[string]int{
+		`{"tcString":"` + encoded + `","vendorId":8,"purposeId":2}`:                      http.StatusNotFound,
+		`{"tcString":"not a tc string","vendorId":8,"purposeId":2}`:                      http.StatusBadRequest,
+		`{"tcString":"` + encoded + `","vendorId":8,"purposeId":2,"specialFeatureId":1}`: http.StatusBadRequest,
+		`{"tcString":"` + encoded + `","vendorId":8,"customPurposeId":1}`:                http.StatusBadRequest,
+	} {
+		if rw := postEvaluation(body); rw.Code != status {
+			t.Errorf("%s: status = %d, want %d", body, rw.Code, status)
+		}
+	}
+}
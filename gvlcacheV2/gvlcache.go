@@ -3,29 +3,47 @@ package gvlcachev2
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/ezoic/ezcache"
 	"github.com/ezoic/publisher-backend/utils"
 )
 
+const (
+	// defaultCachingPeriodInSeconds is used when IAB's response does not say how long the list can be cached for
+	defaultCachingPeriodInSeconds = 24 * 60 * 60
+)
+
+// UpstreamURL overrides the URL the latest vendor list is fetched from when it is set
+var UpstreamURL string
+
+// upstreamStatusError is returned when IAB answers with anything but a 200
+type upstreamStatusError struct {
+	StatusCode int
+}
+
+func (err upstreamStatusError) Error() string {
+	return fmt.Sprintf("IAB server responded with status %d", err.StatusCode)
+}
+
 // GVLVersionTwoValue is built to match the formatting of the GVL Version 2 based on the
 // specification set by the IAB lab https://github.com/InteractiveAdvertisingBureau/GDPR-Transparency-and-Consent-Framework/blob/master/TCFv2/IAB%20Tech%20Lab%20-%20Consent%20string%20and%20vendor%20list%20formats%20v2.md#caching-the-global-vendor-list
 type GVLVersionTwoValue struct {
-	GVLSpecificationVersion string `json:"gvlSpecificationVersion"`
-	VendorListVersion       string `json:"vendorListVersion"`
-	TCFPolicyVersion        string `json:"tcfPolicyVersion "`
+	GVLSpecificationVersion int    `json:"gvlSpecificationVersion"`
+	VendorListVersion       int    `json:"vendorListVersion"`
+	TCFPolicyVersion        int    `json:"tcfPolicyVersion"`
 	LastUpdated             string `json:"lastUpdated"`
 	// map of integer to purposes
 	Purposes map[int]GVLVersionTwoPurpose `json:"purposes"`
 	// map of integer to special purposes
 	SpecialPurposes map[int]GVLVersionTwoSpecialPurpose `json:"specialPurposes"`
 	// map of integer to features
-	Features map[int]GVLVersionTwoPurpose `json:"features"`
+	Features map[int]GVLVersionTwoFeature `json:"features"`
 	// map of intege to special features
 	SpecialFeatures map[int]GVLVersionTwoSpecialFeature `json:"specialFeatures"`
 	// map of integer to vendors
@@ -106,8 +124,8 @@ type GVLVersionTwoVendor struct {
 }
 
 type GVLVersionTwoOverflow struct {
-	//  32 or 128 are supported options
-	httpGetLimit int `json:"httpGetLimit"`
+	//  32 or 128 are supported options, in KB
+	HTTPGetLimit int `json:"httpGetLimit"`
 }
 type GVLVersionTwoStack struct {
 	ID              int    `json:"id"`
@@ -117,29 +135,47 @@ type GVLVersionTwoStack struct {
 	Description     string `json:"description"`
 }
 
-func (gvl *GVLVersionTwoValue) getGVLVersionTwoValueFromCache() bool {
-
-	err := ezcache.LoadKeyObject("middleton", gvlCacheKey, *gvl)
-	if err == nil {
-		log.Print("Successfully loaded GVL value from the cache!")
+func (gvl *GVLVersionTwoValue) isIABResponseBodyMalformed(body []byte) bool {
+	// Use what we know about what is suppose to be within the response, as well as the constraints that are
+	// suppose to be met in order to implement this
+	parsed := GVLVersionTwoValue{}
+	rule := "json"
+	if err := json.Unmarshal(body, &parsed); err == nil {
+		rule = parsed.brokenRule()
+	}
+	if rule != "" {
+		validationFailures.add(1, rule)
 		return true
 	}
-	//  There was an error returned from trying to retreive the cached value -
-	//  possibly b/c there wasn't a cached value that already existed
 	return false
 }
 
-func (gvl *GVLVersionTwoValue) isIABResponseBodyMalformed(body []byte) bool {
-	// Use what we know about what is suppose to be within the response, as well as the constraints that are
-	// suppose to be met in order to implement this
+func (gvl *GVLVersionTwoValue) isMalformed() bool {
+	return gvl.brokenRule() != ""
+}
 
-	return true
+// brokenRule names the first rule the list breaks, or is empty for a valid list
+func (gvl *GVLVersionTwoValue) brokenRule() string {
+	// A list without its version or without any vendors can't be promoted to a versioned key
+	switch {
+	case gvl.GVLSpecificationVersion != gvlSpecificationVersion:
+		return "gvlSpecificationVersion"
+	case gvl.VendorListVersion <= 0:
+		return "vendorListVersion"
+	case len(gvl.Purposes) == 0:
+		return "purposes"
+	case len(gvl.Vendors) == 0:
+		return "vendors"
+	}
+	return ""
 }
 
-func (gvl *GVLVersionTwoValue) getGVLVersionTwoValueFromIABSource() error {
+func (gvl *GVLVersionTwoValue) getGVLVersionTwoValueFromIABSource() (*http.Response, error) {
 	var url string
 
-	if utils.IsLocal() {
+	if UpstreamURL != "" {
+		url = UpstreamURL
+	} else if utils.IsLocal() {
 		// url for locally set up dummy server
 		url = "http://127.0.0.1/8085/v2/vendor-list.json"
 	} else {
@@ -148,22 +184,38 @@ func (gvl *GVLVersionTwoValue) getGVLVersionTwoValueFromIABSource() error {
 		url = "http://127.0.0.1/8085/v2/vendor-list.json"
 		// actual IAB Server URL -> https://vendorlist.consensu.org/v2/vendor-list.json
 	}
+	if !upstreamCircuit.allow() {
+		recordUpstreamFetch("circuit_open", time.Now(), 0)
+		return nil, errCircuitOpen
+	}
+	resp, err := gvl.getGVLVersionTwoValueFromURL(url)
+	upstreamCircuit.record(err)
+	return resp, err
+}
+
+// getGVLVersionTwoValueFromURL fetches a vendor list from one of IAB's URLs and checks that the whole list was received
+func (gvl *GVLVersionTwoValue) getGVLVersionTwoValueFromURL(url string) (*http.Response, error) {
+	start := time.Now()
 	client := &http.Client{}
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		log.Print(err)
-		return err
+		return nil, err
 	}
-	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Print(err)
-		return err
+		recordUpstreamFetch("network_error", start, 0)
+		return nil, err
 	}
 
 	if resp.Body != nil {
 		defer resp.Body.Close()
 	}
+	if resp.StatusCode != http.StatusOK {
+		recordUpstreamFetch("status_error", start, 0)
+		return nil, upstreamStatusError{StatusCode: resp.StatusCode}
+	}
 	// There are some constraints to be met (assuming IAB provides the correct response content), that begin to matter at this point of the code.
 	// 1. A correct GVL shall be one that matches the most recently updated and publicly available version JSON  retreivable from the link provided by IAB.
 	//    Additionally, a correct GVL is not malformed - i,e, the entire response content sent from IAB is all there.
@@ -174,14 +226,16 @@ func (gvl *GVLVersionTwoValue) getGVLVersionTwoValueFromIABSource() error {
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		log.Println("Did not succeed in created byte array representation of body.")
-		return err
+		recordUpstreamFetch("network_error", start, len(body))
+		return nil, err
 	}
 	// Error Case 1: body is nil
 	if body == nil {
 		// The slice being nil (empty for this type) means that the EOF character was the only character in the body and therefore,
 		// the server did not return a response that we could work with. Therefore, there is an issue with the third party libraries used,
 		// the link is outdated, or the IAB server is experiencing issues
-		return errors.New("Response body is not returned in call")
+		recordUpstreamFetch("malformed", start, 0)
+		return nil, errors.New("Response body is not returned in call")
 	}
 
 	// Error Case 2: body is malformed
@@ -191,45 +245,66 @@ func (gvl *GVLVersionTwoValue) getGVLVersionTwoValueFromIABSource() error {
 	// content retreived from the IAB server was correct. We have to add a check here to see if the response body was returned as defined within
 	// the technical specification.
 	if gvl.isIABResponseBodyMalformed(body) == true {
-		return errors.New("Server response body is malformed")
+		recordUpstreamFetch("malformed", start, len(body))
+		return nil, errors.New("Server response body is malformed")
 	}
 
 	// If body is neither nil nor malformed, then any correctness errors will be in terms of encoding the response content incorrectly as defined by the constraints
-	json.Unmarshal(body, &gvl)
-	return nil
+	if err := json.Unmarshal(body, gvl); err != nil {
+		recordUpstreamFetch("malformed", start, len(body))
+		return nil, err
+	}
+	recordUpstreamFetch("success", start, len(body))
+	return resp, nil
 }
 
-func (gvl *GVLVersionTwoValue) storeGVLVersion2ValueIntoCache(resp *http.Response) bool {
+func (gvl *GVLVersionTwoValue) storeGVLVersion2ValueIntoCache(resp *http.Response) *gvlSnapshot {
 	// Determine the number of seconds to cache the GVL
 	expiryTime, err := gvl.getCachingPeriodOfGVLInSeconds(resp)
 	if err != nil {
-		// There is a serious problem here and we can't cache the response
-		log.Print("Wss not able to cache the response.")
-		return false
+		// Without a caching period from IAB we still have a good list, so fall back to our own period
+		log.Printf("Was not able to read the caching period of the response, using %d seconds: %v", defaultCachingPeriodInSeconds, err)
+		expiryTime = defaultCachingPeriodInSeconds
+	}
+	expires := time.Now().UTC().Add(time.Duration(expiryTime) * time.Second)
+	source := gvlSource{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	if resp.Request != nil {
+		source.URL = resp.Request.URL.String()
 	}
 
-	// use the number of seconds to determine the cache expiry time, and use that to store the cookie
-	err = ezcache.ReplaceKeyObject("middleton", gvlCacheKey, gvl, int32(expiryTime))
+	// Write the full version under its own immutable key, and only then point the latest key at it
+	snap, err := promoteVersion(gvl, defaultLanguage, expires, source)
 	if err != nil {
+		// The list is still served from this instance, other instances will fetch it on their own
 		log.Print(err)
-		return false
+		snap = &gvlSnapshot{GVL: gvl, Language: defaultLanguage, StoredAt: time.Now().UTC(), Expires: expires, Source: source}
+	} else if previous := currentSnapshot(defaultLanguage); previous == nil || previous.GVL.VendorListVersion != gvl.VendorListVersion {
+		// A new version was promoted, so clients holding one of the retained versions will ask for a delta to it
+		precomputeDeltas(gvl, defaultLanguage)
 	}
+	setSnapshot(snap)
 
-	return true
+	return snap
 }
 
 func (gvl *GVLVersionTwoValue) getCachingPeriodOfGVLInSeconds(resp *http.Response) (int, error) {
 	// Determine the number of days to cache the GVL
-	maxAge := resp.Header.Get("cache-control")
-	if maxAge == "" {
+	cacheControl := resp.Header.Get("cache-control")
+	if cacheControl == "" {
 		return 0, errors.New("returned error for cache-control header")
 	}
-	// the return should be in the format of max-age=<some integer amount>
-	maxAgeResult := strings.Split(maxAge, "=")[1]
-	maxAgeResultInt, err := strconv.Atoi(maxAgeResult)
-	if err != nil {
-		// can't set expiry time to an integer
-		return 0, errors.New("can't set expiry time to an integer")
+	// the header can hold several directives, one of which should be in the format of max-age=<some integer amount>
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		maxAgeResultInt, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+		if err != nil {
+			// can't set expiry time to an integer
+			return 0, errors.New("can't set expiry time to an integer")
+		}
+		return maxAgeResultInt, nil
 	}
-	return maxAgeResultInt, nil
+	return 0, errors.New("cache-control header has no max-age directive")
 }
@@ -1,48 +1,107 @@
 package gvlcachev2
 
 import (
-	"bytes"
 	"encoding/json"
 	"net/http"
+	"strconv"
+	"time"
 
 	l4g "github.com/ezoic/log4go"
 )
 
-// The cache key is independant of domain, user, and its generality servers as a way to sync callers as
-// if there is only one cache key, then all callers will use the one cache key in order to retreive the
-// value from the cache. The value's presence or not will determine if another call is made to IAB's
-// server
-const (
-	gvlCacheKey string = "gvl-version2-key"
-)
+// The cache keys are independant of domain and user, and their generality servers as a way to sync callers:
+// every caller follows the same latest pointer key in order to retreive the value from the cache. The
+// pointer's presence or not will determine if another call is made to IAB's server. See store.go for how
+// the versioned keys are laid out.
 
-// HandleRequestForGVLVersion2 is the handler meant to process the GET request made for the GVL Version 2 List
+// HandleRequestForGVLVersion2 is the handler meant to process the GET and HEAD requests made for the GVL Version 2 List.
+// A vendorIds filter, given in the query string or POSTed for long lists, limits the list to those vendors.
 func HandleRequestForGVLVersion2(rw http.ResponseWriter, req *http.Request) {
-	l4g.Info("Hello")
-	gvl := GVLVersionTwoValue{}
-	isGVLInCache := gvl.getGVLVersionTwoValueFromCache()
-	l4g.Info(isGVLInCache)
-	if isGVLInCache == false {
-		err := gvl.getGVLVersionTwoValueFromIABSource()
+	subset, err := parseSubsetRequest(req)
+	if err != nil {
+		writeError(rw, req, validationFailed(err.Error()))
+		return
+	}
+
+	lookup, err := lookupGVL(defaultLanguage)
+	if err != nil {
+		l4g.Error(err)
+		writeError(rw, req, latestListUnavailable(err, "There was an error returning the vendor list from IAB's server."))
+		return
+	}
+	if lookup.Stale {
+		setStaleHeaders(rw, lookup)
+	}
+
+	var body []byte
+	if subset != nil {
+		body, err = encodedSubset(lookup.GVL, subset)
 		if err != nil {
-			http.Error(rw, "There was an error returning the vendor list from IAB's server.", http.StatusInternalServerError)
+			l4g.Error(err)
+			writeError(rw, req, internalError("There was an error returning the cached value."))
 			return
 		}
+	} else {
+		body = encodeGVL(lookup.GVL)
 	}
-
-	rw.Header().Add("Content-Type", "application/json")
-	rw.WriteHeader(http.StatusOK)
-	b := &bytes.Buffer{}
-	json.NewEncoder(b).Encode(gvl)
-	_, err := rw.Write(b.Bytes())
+	err = writeCacheableJSON(rw, req, lookup, body)
 	if err != nil {
 		l4g.Error(err)
-		http.Error(rw, "There was an error returning the cached value.", http.StatusInternalServerError)
 	}
 
 }
 
-// HandleRequestForBustingCache is the handler meant bust the cache if required
+// setStaleHeaders marks a response as served past the expiry of the cached list
+func setStaleHeaders(rw http.ResponseWriter, lookup *gvlLookup) {
+	rw.Header().Set("Age", strconv.Itoa(int(lookup.age(time.Now())/time.Second)))
+	if lookup.RevalidationFailed {
+		rw.Header().Set("Warning", `111 - "Revalidation Failed"`)
+	} else {
+		rw.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+	rw.Header().Set("X-GVL-Stale", "true")
+}
+
+// HandleRequestForBustingCache is the handler meant bust the cache if required. The JSON body names the scope to
+// bust (all, version, language or l1) and whether to fetch the list from IAB again right away.
 func HandleRequestForBustingCache(rw http.ResponseWriter, req *http.Request) {
-	// 1. Bust the cache and remove all content from it
+	principal := principalOf(req)
+	if principal == nil || !principal.can(ScopeBust) {
+		l4g.Warn("Refused to bust the cache for unauthenticated caller %s", req.RemoteAddr)
+		writeError(rw, req, apiError{status: http.StatusUnauthorized, code: CodeUnauthorized, message: "Credentials granted the bust scope are required to bust the cache."})
+		return
+	}
+
+	bust := bustCacheRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&bust); err != nil {
+		writeError(rw, req, validationFailed("The request body is not valid JSON."))
+		return
+	}
+	if err := bust.validate(); err != nil {
+		writeError(rw, req, validationFailed(err.Error()))
+		return
+	}
+
+	result, err := bustCache(bust)
+	record := auditRecord{
+		Time:       time.Now().UTC(),
+		Caller:     principal.Name,
+		RemoteAddr: req.RemoteAddr,
+		Action:     "bustCache",
+		Request:    bust,
+		Response:   result,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	writeAuditRecord(record)
+	if err != nil {
+		l4g.Error(err)
+		writeError(rw, req, cacheBackendDown("There was an error busting the cache."))
+		return
+	}
+
+	rw.Header().Add("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(result)
 }
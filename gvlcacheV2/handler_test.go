@@ -1 +1,149 @@
 package gvlcachev2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useUpstream points the package at a fake IAB server for the duration of the test and starts from an empty cache
+func useUpstream(t *testing.T, handler http.HandlerFunc) {
+	useMemoryCache(t)
+	server := httptest.NewServer(handler)
+	previous := UpstreamURL
+	UpstreamURL = server.URL
+	upstreamCircuit = &circuitBreaker{}
+	archiveCircuit = &circuitBreaker{}
+	snapshotMu.Lock()
+	snapshots = map[string]*gvlSnapshot{}
+	snapshotMu.Unlock()
+	t.Cleanup(func() {
+		waitForRefresh(t)
+		server.Close()
+		UpstreamURL = previous
+	})
+}
+
+// waitForRefresh waits for a background refresh to finish so it doesn't outlive the test that started it
+func waitForRefresh(t *testing.T) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		refreshMu.Lock()
+		running := inflight != nil
+		refreshMu.Unlock()
+		if !running {
+			return
+		}
+	}
+	t.Error("background refresh did not finish")
+}
+
+// serveGVL answers like IAB does, with the list and how long it can be cached for
+func serveGVL(gvl *GVLVersionTwoValue, maxAge int) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(maxAge))
+		json.NewEncoder(rw).Encode(gvl)
+	}
+}
+
+func getGVL(t *testing.T) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	HandleRequestForGVLVersion2(rw, httptest.NewRequest(http.MethodGet, "/GVLV2", nil))
+	return rw
+}
+
+// expireCachedGVL moves the expiry of the cached list into the past, both in L1 and in memcached
+func expireCachedGVL(t *testing.T, ago time.Duration) {
+	snap := currentSnapshot(defaultLanguage)
+	if snap == nil {
+		t.Fatal("no snapshot to expire")
+	}
+	expired := *snap
+	expired.Expires = time.Now().Add(-ago)
+	setSnapshot(&expired)
+
+	pointer := gvlLatestPointer{}
+	if err := cache.LoadKeyObject(cacheBucket, gvlLatestKey(defaultLanguage), &pointer); err != nil {
+		t.Fatal(err)
+	}
+	pointer.Expires = expired.Expires
+	cache.ReplaceKeyObject(cacheBucket, gvlLatestKey(defaultLanguage), pointer, 0)
+}
+
+func TestHandleRequestForGVLVersion2ServesFreshList(t *testing.T) {
+	var fetches int32
+	gvl := testGVL(29)
+	useUpstream(t, func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		serveGVL(gvl, 3600)(rw, req)
+	})
+
+	for i := 0; i < 2; i++ {
+		rw := getGVL(t)
+		if rw.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rw.Code)
+		}
+		if rw.Header().Get("X-GVL-Stale") != "" {
+			t.Error("fresh response is marked stale")
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("IAB was called %d times, want 1", fetches)
+	}
+}
+
+func TestHandleRequestForGVLVersion2ServesStaleWhileRevalidating(t *testing.T) {
+	var fetches int32
+	refreshed := make(chan struct{}, 1)
+	useUpstream(t, func(rw http.ResponseWriter, req *http.Request) {
+		version := 28 + int(atomic.AddInt32(&fetches, 1))
+		serveGVL(testGVL(version), 3600)(rw, req)
+		if version > 29 {
+			refreshed <- struct{}{}
+		}
+	})
+	getGVL(t)
+	expireCachedGVL(t, time.Minute)
+
+	rw := getGVL(t)
+	if rw.Header().Get("X-GVL-Stale") != "true" || rw.Header().Get("Age") == "" {
+		t.Errorf("stale response headers = %v", rw.Header())
+	}
+	if warning := rw.Header().Get("Warning"); warning != `110 - "Response is Stale"` {
+		t.Errorf("Warning = %q", warning)
+	}
+	select {
+	case <-refreshed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no background refresh was started")
+	}
+}
+
+func TestHandleRequestForGVLVersion2ServesStaleIfError(t *testing.T) {
+	up := int32(1)
+	gvl := testGVL(29)
+	useUpstream(t, func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			http.Error(rw, "down", http.StatusServiceUnavailable)
+			return
+		}
+		serveGVL(gvl, 3600)(rw, req)
+	})
+	getGVL(t)
+	atomic.StoreInt32(&up, 0)
+
+	expireCachedGVL(t, StaleWhileRevalidate+time.Minute)
+	rw := getGVL(t)
+	if rw.Code != http.StatusOK || rw.Header().Get("Warning") != `111 - "Revalidation Failed"` {
+		t.Errorf("status = %d, headers = %v", rw.Code, rw.Header())
+	}
+
+	expireCachedGVL(t, StaleIfError+time.Minute)
+	rw = getGVL(t)
+	if detail := decodeError(t, rw); rw.Code != http.StatusServiceUnavailable || detail.Code != CodeUpstreamUnavailable || detail.UpstreamStatus != http.StatusServiceUnavailable {
+		t.Errorf("status past the stale-if-error window = %d, error = %+v, want 503", rw.Code, detail)
+	}
+}
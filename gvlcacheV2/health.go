@@ -0,0 +1,98 @@
+package gvlcachev2
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// MaxSnapshotAge is how old the L1 snapshot can get before /healthz reports the instance as unhealthy
+var MaxSnapshotAge = 8 * 24 * time.Hour
+
+const healthCheckKey string = gvlCacheKeyPrefix + "-healthcheck"
+
+// healthReport is the body of /healthz
+type healthReport struct {
+	Status    string              `json:"status"`
+	Reasons   []string            `json:"reasons,omitempty"`
+	Memcached memcachedHealth     `json:"memcached"`
+	Snapshot  *snapshotHealthInfo `json:"snapshot"`
+}
+
+// fail marks the report with status, unless it already has a worse one, and says why
+func (report *healthReport) fail(status string, reason string) {
+	if report.Status != "unhealthy" {
+		report.Status = status
+	}
+	report.Reasons = append(report.Reasons, reason)
+}
+
+type memcachedHealth struct {
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+type snapshotHealthInfo struct {
+	VendorListVersion int  `json:"vendorListVersion"`
+	AgeSeconds        int  `json:"ageSeconds"`
+	Expired           bool `json:"expired"`
+}
+
+// checkMemcached writes a key and reads it back, since a plain read can't tell a miss from an unreachable server
+func checkMemcached() error {
+	written := time.Now().UTC()
+	if err := cache.ReplaceKeyObject(cacheBucket, healthCheckKey, written, 60); err != nil {
+		return err
+	}
+	var read time.Time
+	return cache.LoadKeyObject(cacheBucket, healthCheckKey, &read)
+}
+
+// isReady reports whether warmup has run, a list has been loaded for the instance to serve and it is not shutting
+// down
+func isReady() bool {
+	return hasWarmedUp() && !isDraining() && currentSnapshot(defaultLanguage) != nil
+}
+
+// HandleReadiness answers 200 once a valid vendor list is loaded, and 503 until then or once the instance drains
+func HandleReadiness(rw http.ResponseWriter, req *http.Request) {
+	if !isReady() {
+		writeError(rw, req, apiError{status: http.StatusServiceUnavailable, code: CodeNotReady, message: "not ready", retryAfter: upstreamRetryAfter})
+		return
+	}
+	rw.Write([]byte("ready"))
+}
+
+// HandleHealth reports whether the process is alive, memcached is reachable and the L1 snapshot is recent enough.
+// Without a snapshot the instance has nothing to serve, and is degraded.
+func HandleHealth(rw http.ResponseWriter, req *http.Request) {
+	now := time.Now()
+	report := healthReport{Status: "ok"}
+	if err := checkMemcached(); err != nil {
+		report.fail("unhealthy", "memcached is not reachable")
+		report.Memcached.Error = err.Error()
+	} else {
+		report.Memcached.Reachable = true
+	}
+	snap := currentSnapshot(defaultLanguage)
+	if snap == nil {
+		report.fail("degraded", "no snapshot loaded")
+	} else {
+		report.Snapshot = &snapshotHealthInfo{
+			VendorListVersion: snap.GVL.VendorListVersion,
+			AgeSeconds:        int(snap.age(now) / time.Second),
+			Expired:           !snap.isFresh(now),
+		}
+		if snap.age(now) > MaxSnapshotAge {
+			report.fail("unhealthy", "the snapshot is older than the maximum snapshot age")
+		}
+	}
+
+	rw.Header().Add("Content-Type", "application/json")
+	if report.Status == "ok" {
+		rw.WriteHeader(http.StatusOK)
+	} else {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(rw).Encode(report)
+}
@@ -0,0 +1,94 @@
+package gvlcachev2
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// etagFor returns a strong entity tag for a response body. Every distinct body gets its own tag, so a subset of
+// the list is validated separately from the full list.
+func etagFor(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// lastModifiedOf is the list's lastUpdated, which is when IAB last changed it
+func lastModifiedOf(gvl *GVLVersionTwoValue) (time.Time, bool) {
+	lastUpdated, err := time.Parse(time.RFC3339, gvl.LastUpdated)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return lastUpdated.UTC().Truncate(time.Second), true
+}
+
+// maxAgeOf is what is left of the cached list's freshness, so that browsers and CDNs stop caching the response
+// when we would stop caching the list
+func maxAgeOf(lookup *gvlLookup, now time.Time) int {
+	if lookup.Stale || !lookup.isFresh(now) {
+		return 0
+	}
+	return int(lookup.Expires.Sub(now) / time.Second)
+}
+
+// etagMatches implements the weak comparison If-None-Match calls for
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// isNotModified evaluates the conditional headers of a request. If-Modified-Since is only looked at when the
+// request has no If-None-Match.
+func isNotModified(req *http.Request, etag string, lastModified time.Time, hasLastModified bool) bool {
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, etag)
+	}
+	if !hasLastModified {
+		return false
+	}
+	ifModifiedSince, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.After(ifModifiedSince)
+}
+
+// writeCacheableJSON writes a JSON body taken from the cached list along with its validators and freshness. It
+// answers conditional requests that still match with 304 Not Modified and HEAD requests without a body. Shared
+// caches don't key on the body of a POST, so a POST is answered with no-store and no validators.
+func writeCacheableJSON(rw http.ResponseWriter, req *http.Request, lookup *gvlLookup, body []byte) error {
+	if req.Method == http.MethodPost {
+		rw.Header().Set("Cache-Control", "no-store")
+	} else {
+		etag := etagFor(body)
+		lastModified, hasLastModified := lastModifiedOf(lookup.GVL)
+
+		rw.Header().Set("ETag", etag)
+		if hasLastModified {
+			rw.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		}
+		rw.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(maxAgeOf(lookup, time.Now())))
+
+		if isNotModified(req, etag, lastModified, hasLastModified) {
+			rw.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+	}
+
+	rw.Header().Add("Content-Type", "application/json")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	rw.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodHead {
+		return nil
+	}
+	_, err := rw.Write(body)
+	return err
+}
@@ -0,0 +1,77 @@
+package gvlcachev2
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func requestGVL(method string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/GVLV2", nil)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rw := httptest.NewRecorder()
+	HandleRequestForGVLVersion2(rw, req)
+	return rw
+}
+
+func TestHandleRequestForGVLVersion2SetsValidators(t *testing.T) {
+	useUpstream(t, serveGVL(testGVL(29), 3600))
+
+	rw := requestGVL(http.MethodGet, nil)
+	if rw.Header().Get("ETag") == "" || strings.HasPrefix(rw.Header().Get("ETag"), "W/") {
+		t.Errorf("ETag = %q, want a strong tag", rw.Header().Get("ETag"))
+	}
+	if got := rw.Header().Get("Last-Modified"); got != "Thu, 12 Mar 2020 16:05:14 GMT" {
+		t.Errorf("Last-Modified = %q", got)
+	}
+	maxAge, err := strconv.Atoi(strings.TrimPrefix(rw.Header().Get("Cache-Control"), "public, max-age="))
+	if err != nil || maxAge <= 0 || maxAge > 3600 {
+		t.Errorf("Cache-Control = %q", rw.Header().Get("Cache-Control"))
+	}
+}
+
+func TestHandleRequestForGVLVersion2ConditionalRequests(t *testing.T) {
+	useUpstream(t, serveGVL(testGVL(29), 3600))
+	etag := requestGVL(http.MethodGet, nil).Header().Get("ETag")
+
+	cases := []struct {
+		headers map[string]string
+		want    int
+	}{
+		{map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{map[string]string{"If-None-Match": `"other", ` + etag}, http.StatusNotModified},
+		{map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+		{map[string]string{"If-Modified-Since": "Thu, 12 Mar 2020 16:05:14 GMT"}, http.StatusNotModified},
+		{map[string]string{"If-Modified-Since": "Wed, 11 Mar 2020 16:05:14 GMT"}, http.StatusOK},
+		// If-None-Match takes precedence over If-Modified-Since
+		{map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": "Thu, 12 Mar 2020 16:05:14 GMT"}, http.StatusOK},
+	}
+	for _, c := range cases {
+		rw := requestGVL(http.MethodGet, c.headers)
+		if rw.Code != c.want {
+			t.Errorf("%v: status = %d, want %d", c.headers, rw.Code, c.want)
+		}
+		if rw.Code == http.StatusNotModified && rw.Body.Len() != 0 {
+			t.Errorf("%v: 304 response has a body", c.headers)
+		}
+	}
+}
+
+func TestHandleRequestForGVLVersion2Head(t *testing.T) {
+	useUpstream(t, serveGVL(testGVL(29), 3600))
+	get := requestGVL(http.MethodGet, nil)
+	head := requestGVL(http.MethodHead, nil)
+
+	if head.Code != http.StatusOK || head.Body.Len() != 0 {
+		t.Errorf("HEAD status = %d with %d bytes of body", head.Code, head.Body.Len())
+	}
+	for _, name := range []string{"ETag", "Last-Modified", "Content-Type", "Content-Length"} {
+		if get.Header().Get(name) != head.Header().Get(name) {
+			t.Errorf("%s: GET %q, HEAD %q", name, get.Header().Get(name), head.Header().Get(name))
+		}
+	}
+}
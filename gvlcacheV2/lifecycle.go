@@ -0,0 +1,47 @@
+package gvlcachev2
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+
+	l4g "github.com/ezoic/log4go"
+)
+
+// draining is set once the instance is shutting down. It fails readiness so load balancers stop sending
+// traffic, and stops new background refreshes from starting.
+var draining int32
+
+// StartDraining marks the instance as shutting down. /readyz answers 503 from then on, while requests that still
+// arrive are served as usual.
+func StartDraining() {
+	atomic.StoreInt32(&draining, 1)
+}
+
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// Shutdown drains the instance, waits for a refresh from IAB that is still running to be stored, and closes the
+// cache client. It gives up on the refresh when ctx is done.
+func Shutdown(ctx context.Context) error {
+	StartDraining()
+
+	refreshMu.Lock()
+	call := inflight
+	refreshMu.Unlock()
+	if call != nil {
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			l4g.Warn("Shutting down with a refresh of the GVL still running")
+			return ctx.Err()
+		}
+	}
+
+	// ezcache keeps its connections for the life of the process, other backends may hold resources to release
+	if closer, ok := cache.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package gvlcachev2
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type closingCache struct {
+	*memoryCache
+	closed bool
+}
+
+func (c *closingCache) Close() error {
+	c.closed = true
+	return nil
+}
+
+func useDraining(t *testing.T) {
+	t.Cleanup(func() { atomic.StoreInt32(&draining, 0) })
+}
+
+func TestShutdownWaitsForRefreshAndFailsReadiness(t *testing.T) {
+	release := make(chan struct{})
+	useUpstream(t, func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+		serveGVL(testGVL(29), 3600)(rw, req)
+	})
+	useDraining(t)
+	closing := &closingCache{memoryCache: cache.(*memoryCache)}
+	cache = closing
+
+	refreshGVLInBackground()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned before the refresh finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+
+	if currentSnapshot(defaultLanguage) == nil || !closing.closed {
+		t.Errorf("the refresh was not stored or the cache was not closed")
+	}
+	if status := readiness(); status != http.StatusServiceUnavailable {
+		t.Errorf("readiness while draining = %d, want 503", status)
+	}
+	refreshGVLInBackground()
+	if inflight != nil {
+		t.Errorf("a background refresh started while draining")
+	}
+}
+
+func TestShutdownGivesUpOnSlowRefresh(t *testing.T) {
+	release := make(chan struct{})
+	useUpstream(t, func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+		serveGVL(testGVL(29), 3600)(rw, req)
+	})
+	useDraining(t)
+	defer close(release)
+
+	refreshGVLInBackground()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want the deadline to pass", err)
+	}
+}
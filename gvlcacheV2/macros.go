@@ -0,0 +1,235 @@
+package gvlcachev2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ezoic/gvlcache/tcstring"
+	l4g "github.com/ezoic/log4go"
+)
+
+// defaultHTTPGetLimit is the limit, in KB, of vendors that declare no overflow. It is the smaller of the two the
+// spec allows.
+const defaultHTTPGetLimit = 32
+
+// macroPattern matches the TCF macros of pixel and creative URLs. Other macros are left for the ad server.
+var macroPattern = regexp.MustCompile(`\$\{(GDPR|GDPR_CONSENT_([0-9]+)|ADDTL_CONSENT)\}`)
+
+// degradationStep drops the segments of a type from the TC string
+type degradationStep struct {
+	segmentType int
+	name        string
+}
+
+// degradationOrder is the optional segments of the TC string, dropped in this order when the URL is too long. A
+// vendor only needs the core segment: the publisher TC segment is the publisher's own, and the allowed and
+// disclosed vendors matter least to a vendor that is already being called.
+var degradationOrder = []degradationStep{
+	{tcstring.SegmentTypePublisherTC, "publisherTC"},
+	{tcstring.SegmentTypeAllowedVendors, "allowedVendors"},
+	{tcstring.SegmentTypeDisclosedVendors, "disclosedVendors"},
+}
+
+// MacroRequest asks for the TCF macros of a URL template to be filled for a vendor. GDPRApplies defaults to
+// whether there is a TC string. With Degrade, optional segments of the TC string are dropped until the URL fits
+// the vendor's limit; without it a URL that doesn't fit is a URLOverflowError.
+type MacroRequest struct {
+	Template     string `json:"template"`
+	VendorID     int    `json:"vendorId"`
+	TCString     string `json:"tcString"`
+	GDPRApplies  *bool  `json:"gdprApplies,omitempty"`
+	AddtlConsent string `json:"addtlConsent,omitempty"`
+	Degrade      bool   `json:"degrade"`
+}
+
+func (request *MacroRequest) validate() error {
+	if request.Template == "" {
+		return errors.New("template must be set")
+	}
+	if request.VendorID <= 0 {
+		return errors.New("vendorId must be a vendor id")
+	}
+	if request.TCString == "" && request.gdprApplies() {
+		return errors.New("tcString must be set when GDPR applies")
+	}
+	for _, macro := range macroPattern.FindAllStringSubmatch(request.Template, -1) {
+		if macro[2] != "" && macro[2] != strconv.Itoa(request.VendorID) {
+			return fmt.Errorf("the template holds the consent macro of vendor %s, expand it for that vendor", macro[2])
+		}
+	}
+	return nil
+}
+
+func (request *MacroRequest) gdprApplies() bool {
+	if request.GDPRApplies == nil {
+		return request.TCString != ""
+	}
+	return *request.GDPRApplies
+}
+
+// MacroExpansion is a URL with its macros filled. Length and Limit are in bytes; DroppedSegments are the segments
+// of the TC string left out to fit the limit.
+type MacroExpansion struct {
+	URL               string   `json:"url"`
+	Length            int      `json:"length"`
+	Limit             int      `json:"limit"`
+	VendorListVersion int      `json:"vendorListVersion"`
+	DroppedSegments   []string `json:"droppedSegments,omitempty"`
+}
+
+// URLOverflowError is an expanded URL longer than its vendor's overflow.httpGetLimit allows
+type URLOverflowError struct {
+	VendorID int
+	Limit    int
+	Length   int
+}
+
+func (err *URLOverflowError) Error() string {
+	return fmt.Sprintf("the URL for vendor %d is %d bytes, over its limit of %d", err.VendorID, err.Length, err.Limit)
+}
+
+// vendorNotInListError is a macro request for a vendor the vendor list does not have
+type vendorNotInListError struct {
+	VendorID          int
+	VendorListVersion int
+}
+
+func (err vendorNotInListError) Error() string {
+	return fmt.Sprintf("vendor %d is not in vendor list version %d", err.VendorID, err.VendorListVersion)
+}
+
+// ExpandMacros fills ${GDPR}, ${GDPR_CONSENT_<vendorId>} and ${ADDTL_CONSENT} in a URL template. The vendor's limit
+// comes from the version of the vendor list the TC string names, or from the latest list without a string.
+func ExpandMacros(request MacroRequest) (*MacroExpansion, error) {
+	if err := request.validate(); err != nil {
+		return nil, err
+	}
+	var gvl *GVLVersionTwoValue
+	if request.TCString != "" {
+		tc, err := tcstring.Decode(request.TCString)
+		if err != nil {
+			return nil, err
+		}
+		if gvl, err = fetchArchivedVersion(tc.VendorListVersion); err != nil {
+			return nil, err
+		}
+	} else {
+		lookup, err := lookupGVL(defaultLanguage)
+		if err != nil {
+			return nil, err
+		}
+		gvl = lookup.GVL
+	}
+	vendor, ok := gvl.Vendors[request.VendorID]
+	if !ok {
+		return nil, vendorNotInListError{VendorID: request.VendorID, VendorListVersion: gvl.VendorListVersion}
+	}
+	limit := vendor.Overflow.HTTPGetLimit
+	if limit == 0 {
+		limit = defaultHTTPGetLimit
+	}
+	return expandMacros(request, limit*1024, gvl.VendorListVersion)
+}
+
+// expandMacros fills the template, dropping segments of the TC string while the URL is longer than limit bytes and
+// the request allows it
+func expandMacros(request MacroRequest, limit int, vendorListVersion int) (*MacroExpansion, error) {
+	segments := []string{}
+	if request.TCString != "" {
+		segments = strings.Split(strings.TrimSpace(request.TCString), ".")
+	}
+	expansion := &MacroExpansion{Limit: limit, VendorListVersion: vendorListVersion}
+	// The first step drops nothing
+	for _, step := range append([]degradationStep{{}}, degradationOrder...) {
+		if step.name != "" {
+			kept := []string{}
+			for i, segment := range segments {
+				if segmentType, err := tcstring.SegmentType(segment); i == 0 || err != nil || segmentType != step.segmentType {
+					kept = append(kept, segment)
+				}
+			}
+			if len(kept) == len(segments) {
+				continue
+			}
+			segments = kept
+			expansion.DroppedSegments = append(expansion.DroppedSegments, step.name)
+		}
+		expansion.URL = fillMacros(request, strings.Join(segments, "."))
+		expansion.Length = len(expansion.URL)
+		if expansion.Length <= limit {
+			return expansion, nil
+		}
+		if !request.Degrade {
+			break
+		}
+	}
+	return nil, &URLOverflowError{VendorID: request.VendorID, Limit: limit, Length: expansion.Length}
+}
+
+func fillMacros(request MacroRequest, tcString string) string {
+	gdpr := "0"
+	if request.gdprApplies() {
+		gdpr = "1"
+	}
+	return macroPattern.ReplaceAllStringFunc(request.Template, func(macro string) string {
+		switch macro {
+		case "${GDPR}":
+			return gdpr
+		case "${ADDTL_CONSENT}":
+			return escapeMacroValue(request.AddtlConsent)
+		}
+		return escapeMacroValue(tcString)
+	})
+}
+
+// escapeMacroValue percent-encodes everything but the unreserved characters of RFC 3986, so that the value is safe
+// in a path as much as in a query. TC strings and additional consent strings are all unreserved characters when
+// they are well formed.
+func escapeMacroValue(value string) string {
+	b := &strings.Builder{}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// HandleExpandMacros fills the TCF macros of the URL template of a JSON MacroRequest
+func HandleExpandMacros(rw http.ResponseWriter, req *http.Request) {
+	request := MacroRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		writeError(rw, req, validationFailed("The request body is not valid JSON."))
+		return
+	}
+	if err := request.validate(); err != nil {
+		writeError(rw, req, validationFailed(err.Error()))
+		return
+	}
+
+	expansion, err := ExpandMacros(request)
+	decodeErr := &tcstring.DecodeError{}
+	overflowErr := &URLOverflowError{}
+	var missing vendorNotInListError
+	switch {
+	case err == nil:
+		writeJSON(rw, http.StatusOK, expansion)
+	case errors.As(err, &decodeErr):
+		writeError(rw, req, validationFailed(fmt.Sprintf("The TC string can't be read: %v", err)))
+	case errors.As(err, &overflowErr):
+		writeError(rw, req, urlTooLong(overflowErr.Error()))
+	case errors.As(err, &missing):
+		writeError(rw, req, notFound(missing.Error()))
+	default:
+		l4g.Error(err)
+		writeError(rw, req, upstreamUnavailable(err, http.StatusBadGateway, "There was an error fetching the vendor list the TC string was made for."))
+	}
+}
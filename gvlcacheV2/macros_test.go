@@ -0,0 +1,113 @@
+package gvlcachev2
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ezoic/gvlcache/tcstring"
+)
+
+func TestEscapeMacroValueKeepsOnlyUnreservedCharacters(t *testing.T) {
+	if escaped := escapeMacroValue("CPa.b-c_d~1 2/&=+é"); escaped != "CPa.b-c_d~1%202%2F%26%3D%2B%C3%A9" {
+		t.Errorf("escaped = %s", escaped)
+	}
+}
+
+func TestExpandMacrosDegradesToFitTheLimit(t *testing.T) {
+	tc := tcfTestString()
+	tc.DisclosedVendors = tcstring.IDs{8, 744}
+	tc.PublisherTC = &tcstring.PublisherTC{PurposesConsent: tcstring.IDs{1}, NumCustomPurposes: 1, CustomPurposesConsent: tcstring.IDs{1}}
+	encoded, err := tcstring.Encode(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments := strings.Split(encoded, ".")
+	request := MacroRequest{
+		Template:     "https://px.example/s?gdpr=${GDPR}&gdpr_consent=${GDPR_CONSENT_8}&addtl=${ADDTL_CONSENT}&price=${AUCTION_PRICE}",
+		VendorID:     8,
+		TCString:     encoded,
+		AddtlConsent: "1~89.2008",
+	}
+	full := "https://px.example/s?gdpr=1&gdpr_consent=" + encoded + "&addtl=1~89.2008&price=${AUCTION_PRICE}"
+	expansion, err := expandMacros(request, len(full), 29)
+	if err != nil || expansion.URL != full || expansion.DroppedSegments != nil {
+		t.Fatalf("expansion = %+v, %v", expansion, err)
+	}
+
+	// The publisher TC segment is the last one, and goes first
+	withoutPublisher := len(full) - len(segments[2]) - 1
+	_, err = expandMacros(request, withoutPublisher, 29)
+	overflowErr := &URLOverflowError{}
+	if !errors.As(err, &overflowErr) || overflowErr.Length != len(full) || overflowErr.Limit != withoutPublisher || overflowErr.VendorID != 8 {
+		t.Errorf("without degradation: err = %v", err)
+	}
+	request.Degrade = true
+	expansion, err = expandMacros(request, withoutPublisher, 29)
+	if err != nil || !strings.Contains(expansion.URL, segments[0]+"."+segments[1]+"&") || !reflect.DeepEqual(expansion.DroppedSegments, []string{"publisherTC"}) {
+		t.Errorf("dropping the publisher TC: %+v, %v", expansion, err)
+	}
+	expansion, err = expandMacros(request, withoutPublisher-1, 29)
+	if err != nil || !strings.Contains(expansion.URL, "gdpr_consent="+segments[0]+"&") ||
+		!reflect.DeepEqual(expansion.DroppedSegments, []string{"publisherTC", "disclosedVendors"}) {
+		t.Errorf("dropping every optional segment: %+v, %v", expansion, err)
+	}
+	if _, err := expandMacros(request, 10, 29); !errors.As(err, &overflowErr) || overflowErr.Length != len(full)-len(segments[1])-len(segments[2])-2 {
+		t.Errorf("the core segment alone does not fit: err = %v", err)
+	}
+
+	noGDPR := false
+	request = MacroRequest{Template: "https://px.example/s?gdpr=${GDPR}&c=${GDPR_CONSENT_8}", VendorID: 8, GDPRApplies: &noGDPR}
+	if expansion, err := expandMacros(request, 1024, 29); err != nil || expansion.URL != "https://px.example/s?gdpr=0&c=" {
+		t.Errorf("without GDPR: %+v, %v", expansion, err)
+	}
+}
+
+func postMacros(body string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	HandleExpandMacros(rw, httptest.NewRequest(http.MethodPost, "/tcf/macros", strings.NewReader(body)))
+	return rw
+}
+
+func TestHandleExpandMacrosHonorsTheVendorsLimit(t *testing.T) {
+	gvl := evaluateTestGVL()
+	small, large := gvl.Vendors[8], gvl.Vendors[744]
+	small.Overflow.HTTPGetLimit = 32
+	large.Overflow.HTTPGetLimit = 128
+	gvl.Vendors[8], gvl.Vendors[744] = small, large
+	useArchive(t, gvl)
+	encoded, err := tcstring.Encode(tcfTestString())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A template of 40 KB fits vendor 744's limit but not vendor 8's
+	padding := strings.Repeat("a", 40*1024)
+	body := func(vendorID string) string {
+		return `{"template":"https://px.example/s?p=` + padding + `&c=${GDPR_CONSENT_` + vendorID + `}","vendorId":` + vendorID + `,"tcString":"` + encoded + `"}`
+	}
+	rw := postMacros(body("744"))
+	expansion := MacroExpansion{}
+	json.NewDecoder(rw.Body).Decode(&expansion)
+	if rw.Code != http.StatusOK || expansion.Limit != 128*1024 || !strings.HasSuffix(expansion.URL, "&c="+encoded) || expansion.VendorListVersion != 29 {
+		t.Errorf("vendor 744: status = %d, limit = %d", rw.Code, expansion.Limit)
+	}
+	if rw := postMacros(body("8")); rw.Code != http.StatusUnprocessableEntity || decodeError(t, rw).Code != CodeURLTooLong {
+		t.Errorf("vendor 8: status = %d", rw.Code)
+	}
+
+	for body, status := range map[string]int{
+		`{"template":"https://px.example/?c=${GDPR_CONSENT_744}","vendorId":8,"tcString":"` + encoded + `"}`: http.StatusBadRequest,
+		`{"template":"https://px.example/","vendorId":8,"gdprApplies":true}`:                                 http.StatusBadRequest,
+		`{"template":"https://px.example/","vendorId":999,"tcString":"` + encoded + `"}`:                     http.StatusNotFound,
+		`{"template":"https://px.example/","vendorId":8,"tcString":"not a tc string"}`:                       http.StatusBadRequest,
+	} {
+		if rw := postMacros(body); rw.Code != status {
+			t.Errorf("%s: status = %d, want %d", body, rw.Code, status)
+		}
+	}
+}
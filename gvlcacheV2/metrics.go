@@ -0,0 +1,266 @@
+package gvlcachev2
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// defaultBuckets are the upper bounds, in seconds, of the latency histograms
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// counterVec is a Prometheus counter with labels
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]*counterValue{}}
+}
+
+func (counter *counterVec) add(delta float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	value, ok := counter.values[key]
+	if !ok {
+		value = &counterValue{labelValues: labelValues}
+		counter.values[key] = value
+	}
+	value.value += delta
+}
+
+func (counter *counterVec) write(w io.Writer) {
+	writeMetricHeader(w, counter.name, counter.help, "counter")
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	for _, key := range sortedValueKeys(counter.values) {
+		value := counter.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", counter.name, formatLabels(counter.labels, value.labelValues), formatFloat(value.value))
+	}
+}
+
+// histogramVec is a Prometheus histogram with labels
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64 // per bucket, not cumulative
+	sum         float64
+	count       uint64
+}
+
+func newHistogramVec(name string, help string, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: defaultBuckets, values: map[string]*histogramValue{}}
+}
+
+func (histogram *histogramVec) observe(observed float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+	value, ok := histogram.values[key]
+	if !ok {
+		value = &histogramValue{labelValues: labelValues, counts: make([]uint64, len(histogram.buckets))}
+		histogram.values[key] = value
+	}
+	if i := sort.SearchFloat64s(histogram.buckets, observed); i < len(histogram.buckets) {
+		value.counts[i]++
+	}
+	value.sum += observed
+	value.count++
+}
+
+func (histogram *histogramVec) write(w io.Writer) {
+	writeMetricHeader(w, histogram.name, histogram.help, "histogram")
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+	bucketLabels := append(append([]string{}, histogram.labels...), "le")
+	for _, key := range sortedValueKeys(histogram.values) {
+		value := histogram.values[key]
+		var cumulative uint64
+		for i, bound := range histogram.buckets {
+			cumulative += value.counts[i]
+			labels := formatLabels(bucketLabels, append(append([]string{}, value.labelValues...), formatFloat(bound)))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, labels, cumulative)
+		}
+		labels := formatLabels(bucketLabels, append(append([]string{}, value.labelValues...), "+Inf"))
+		fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, labels, value.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", histogram.name, formatLabels(histogram.labels, value.labelValues), formatFloat(value.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", histogram.name, formatLabels(histogram.labels, value.labelValues), value.count)
+	}
+}
+
+func sortedValueKeys(values interface{}) []string {
+	keys := []string{}
+	switch values := values.(type) {
+	case map[string]*counterValue:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	case map[string]*histogramValue:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeMetricHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var (
+	httpRequests = newCounterVec("gvlcache_http_requests_total",
+		"HTTP requests answered, by route, method and status.", "route", "method", "status")
+	httpDuration = newHistogramVec("gvlcache_http_request_duration_seconds",
+		"Time taken to answer HTTP requests, by route and status.", "route", "status")
+	upstreamFetches = newCounterVec("gvlcache_upstream_fetches_total",
+		"Fetches of vendor lists from IAB, by outcome: success, network_error, status_error, malformed or circuit_open.", "outcome")
+	upstreamDuration = newHistogramVec("gvlcache_upstream_fetch_duration_seconds",
+		"Time taken to fetch vendor lists from IAB, by outcome.", "outcome")
+	upstreamBytes = newCounterVec("gvlcache_upstream_response_bytes_total",
+		"Bytes of vendor list bodies received from IAB.")
+	validationFailures = newCounterVec("gvlcache_validation_failures_total",
+		"Vendor lists from IAB that were rejected, by the rule they broke.", "rule")
+)
+
+// recordUpstreamFetch counts one fetch from IAB that started at start
+func recordUpstreamFetch(outcome string, start time.Time, bytes int) {
+	upstreamFetches.add(1, outcome)
+	upstreamDuration.observe(time.Since(start).Seconds(), outcome)
+	if bytes > 0 {
+		upstreamBytes.add(float64(bytes))
+	}
+}
+
+// statusRecorder remembers the status a handler answered with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(b []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	return recorder.ResponseWriter.Write(b)
+}
+
+// Metrics counts and times every request by the route pattern it matched, so that /GVLV2/vendors/8 and
+// /GVLV2/vendors/9 are one series
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: rw}
+		next.ServeHTTP(recorder, req)
+
+		route := chi.RouteContext(req.Context()).RoutePattern()
+		if route == "" {
+			route = "unmatched"
+		}
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		status := strconv.Itoa(recorder.status)
+		httpRequests.add(1, route, req.Method, status)
+		httpDuration.observe(time.Since(start).Seconds(), route, status)
+	})
+}
+
+// writeGauge writes a metric that only has its current value
+func writeGauge(w io.Writer, name string, help string, value float64) {
+	writeMetricHeader(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+// writeMetrics writes every metric in the Prometheus text format
+func writeMetrics(w io.Writer, now time.Time) {
+	httpRequests.write(w)
+	httpDuration.write(w)
+
+	writeMetricHeader(w, "gvlcache_cache_lookups_total", "Lookups of the vendor list, by tier and result: hit, miss, stale or error.", "counter")
+	for _, tier := range []string{tierL1, tierMemcached, tierUpstream} {
+		stats := cacheStats[tier].snapshot()
+		for _, result := range []struct {
+			name  string
+			value uint64
+		}{{"hit", stats.Hits}, {"miss", stats.Misses}, {"stale", stats.Stale}, {"error", stats.Errors}} {
+			fmt.Fprintf(w, "gvlcache_cache_lookups_total%s %d\n", formatLabels([]string{"tier", "result"}, []string{tier, result.name}), result.value)
+		}
+	}
+
+	upstreamFetches.write(w)
+	upstreamDuration.write(w)
+	upstreamBytes.write(w)
+	validationFailures.write(w)
+	writeGauge(w, "gvlcache_upstream_circuit_state", "State of the circuit breaker in front of IAB: 0 closed, 1 half open, 2 open.",
+		float64(upstreamCircuit.state()))
+
+	version, age := 0.0, 0.0
+	if snap := currentSnapshot(defaultLanguage); snap != nil {
+		version = float64(snap.GVL.VendorListVersion)
+		age = snap.age(now).Seconds()
+	}
+	writeGauge(w, "gvlcache_vendor_list_version", "The vendorListVersion being served, 0 before a list is loaded.", version)
+	writeGauge(w, "gvlcache_snapshot_age_seconds", "Seconds since the list being served was stored.", age)
+}
+
+// HandleMetrics exposes the metrics of the instance for Prometheus to scrape
+func HandleMetrics(rw http.ResponseWriter, req *http.Request) {
+	b := &bytes.Buffer{}
+	writeMetrics(b, time.Now())
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(b.Bytes())
+}
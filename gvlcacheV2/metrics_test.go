@@ -0,0 +1,74 @@
+package gvlcachev2
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+func scrape(t *testing.T) string {
+	rw := httptest.NewRecorder()
+	HandleMetrics(rw, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rw.Code != http.StatusOK || !strings.HasPrefix(rw.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("status = %d, headers = %v", rw.Code, rw.Header())
+	}
+	return rw.Body.String()
+}
+
+func TestHistogramIsCumulative(t *testing.T) {
+	histogram := newHistogramVec("test_seconds", "Test.", "route")
+	histogram.observe(0.003, "/a")
+	histogram.observe(0.2, "/a")
+	histogram.observe(20, "/a")
+	b := &strings.Builder{}
+	histogram.write(b)
+
+	for _, line := range []string{
+		`test_seconds_bucket{route="/a",le="0.005"} 1`,
+		`test_seconds_bucket{route="/a",le="0.25"} 2`,
+		`test_seconds_bucket{route="/a",le="10"} 2`,
+		`test_seconds_bucket{route="/a",le="+Inf"} 3`,
+		`test_seconds_sum{route="/a"} 20.203`,
+		`test_seconds_count{route="/a"} 3`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("missing %s in\n%s", line, b)
+		}
+	}
+}
+
+func TestMetricsCoverRequestsUpstreamAndSnapshot(t *testing.T) {
+	useUpstream(t, serveGVL(testGVL(29), 3600))
+	r := chi.NewRouter()
+	r.Use(Metrics)
+	r.Get("/GVLV2/vendors/{id}", HandleVendorResource)
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/GVLV2/vendors/8", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/GVLV2/vendors/9", nil))
+
+	gvl := &GVLVersionTwoValue{}
+	gvl.isIABResponseBodyMalformed([]byte(`{"gvlSpecificationVersion": 2, "vendorListVersion": 30}`))
+
+	setSnapshot(&gvlSnapshot{GVL: testGVL(29), Language: defaultLanguage, StoredAt: time.Now().Add(-time.Minute)})
+	body := scrape(t)
+	for _, want := range []string{
+		`gvlcache_http_requests_total{route="/GVLV2/vendors/{id}",method="GET",status="200"}`,
+		`gvlcache_http_requests_total{route="/GVLV2/vendors/{id}",method="GET",status="404"}`,
+		`gvlcache_http_request_duration_seconds_count{route="/GVLV2/vendors/{id}",status="200"}`,
+		`gvlcache_cache_lookups_total{tier="upstream",result="hit"}`,
+		`gvlcache_upstream_fetches_total{outcome="success"}`,
+		`gvlcache_upstream_fetch_duration_seconds_count{outcome="success"}`,
+		"gvlcache_upstream_response_bytes_total ",
+		`gvlcache_validation_failures_total{rule="purposes"}`,
+		"gvlcache_upstream_circuit_state 0\n",
+		"gvlcache_vendor_list_version 29\n",
+		"gvlcache_snapshot_age_seconds 6",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package gvlcachev2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	l4g "github.com/ezoic/log4go"
+)
+
+const (
+	defaultVendorPageSize = 50
+	maxVendorPageSize     = 500
+)
+
+// vendorIndex maps each purpose and feature id to the sorted ids of the vendors that declare it. It is built
+// once for every snapshot that is accepted, so queries only intersect lists.
+type vendorIndex struct {
+	all              []int
+	consentPurposes  map[int][]int
+	legIntPurposes   map[int][]int
+	flexiblePurposes map[int][]int
+	specialPurposes  map[int][]int
+	features         map[int][]int
+	specialFeatures  map[int][]int
+	// anyFlexible holds the vendors with at least one flexible purpose
+	anyFlexible []int
+}
+
+func buildVendorIndex(gvl *GVLVersionTwoValue) *vendorIndex {
+	index := &vendorIndex{
+		consentPurposes:  map[int][]int{},
+		legIntPurposes:   map[int][]int{},
+		flexiblePurposes: map[int][]int{},
+		specialPurposes:  map[int][]int{},
+		features:         map[int][]int{},
+		specialFeatures:  map[int][]int{},
+	}
+	add := func(inverted map[int][]int, ids []int, vendorID int) {
+		for _, id := range ids {
+			inverted[id] = append(inverted[id], vendorID)
+		}
+	}
+	for id := range gvl.Vendors {
+		index.all = append(index.all, id)
+	}
+	// Appending in id order keeps every list sorted
+	sort.Ints(index.all)
+	for _, id := range index.all {
+		vendor := gvl.Vendors[id]
+		add(index.consentPurposes, vendor.Purposes, id)
+		add(index.legIntPurposes, vendor.LegIntPurposes, id)
+		add(index.flexiblePurposes, vendor.FlexiblePurposes, id)
+		add(index.specialPurposes, vendor.SpecialPurposes, id)
+		add(index.features, vendor.Features, id)
+		add(index.specialFeatures, vendor.SpecialFeatures, id)
+		if len(vendor.FlexiblePurposes) > 0 {
+			index.anyFlexible = append(index.anyFlexible, id)
+		}
+	}
+	return index
+}
+
+// intersect returns the ids that are in both sorted lists
+func intersect(a []int, b []int) []int {
+	out := []int{}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+// union returns the ids that are in either sorted list
+func union(a []int, b []int) []int {
+	out := []int{}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			out = append(out, a[i])
+			i++
+		case a[i] > b[j]:
+			out = append(out, b[j])
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	out = append(out, a[i:]...)
+	return append(out, b[j:]...)
+}
+
+// vendorQuery is a parsed query of /GVLV2/vendors
+type vendorQuery struct {
+	purposes        []int
+	basis           string // "consent", "legInt" or "" for either
+	flexible        bool
+	specialPurposes []int
+	features        []int
+	specialFeatures []int
+	nameMatch       string // "contains", "prefix" or "exact"
+	name            string
+	sortBy          string // "id" or "name"
+	descending      bool
+	page            int
+	pageSize        int
+}
+
+// vendorQueryResult is the body of /GVLV2/vendors
+type vendorQueryResult struct {
+	VendorListVersion int                   `json:"vendorListVersion"`
+	Total             int                   `json:"total"`
+	Page              int                   `json:"page"`
+	PageSize          int                   `json:"pageSize"`
+	Vendors           []GVLVersionTwoVendor `json:"vendors"`
+}
+
+func parseIDList(values url.Values, name string) ([]int, error) {
+	ids := []int{}
+	for _, value := range values[name] {
+		for _, field := range strings.Split(value, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || id <= 0 {
+				return nil, fmt.Errorf("%s must be a list of positive ids", name)
+			}
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func parsePositiveInt(values url.Values, name string, fallback int) (int, error) {
+	raw := values.Get(name)
+	if raw == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s must be a positive integer", name)
+	}
+	return n, nil
+}
+
+func parseVendorQuery(values url.Values) (*vendorQuery, error) {
+	query := &vendorQuery{sortBy: "id"}
+	var err error
+	if query.purposes, err = parseIDList(values, "purpose"); err != nil {
+		return nil, err
+	}
+	if query.specialPurposes, err = parseIDList(values, "specialPurpose"); err != nil {
+		return nil, err
+	}
+	if query.features, err = parseIDList(values, "feature"); err != nil {
+		return nil, err
+	}
+	if query.specialFeatures, err = parseIDList(values, "specialFeature"); err != nil {
+		return nil, err
+	}
+
+	switch basis := values.Get("basis"); basis {
+	case "", "any":
+	case "consent", "legInt":
+		query.basis = basis
+	default:
+		return nil, fmt.Errorf(`basis must be "consent", "legInt" or "any"`)
+	}
+	if flexible := values.Get("flexible"); flexible != "" {
+		if query.flexible, err = strconv.ParseBool(flexible); err != nil {
+			return nil, fmt.Errorf("flexible must be true or false")
+		}
+	}
+
+	if name := values.Get("name"); name != "" {
+		query.nameMatch, query.name = "exact", name
+		if parts := strings.SplitN(name, ":", 2); len(parts) == 2 && (parts[0] == "contains" || parts[0] == "prefix" || parts[0] == "exact") {
+			query.nameMatch, query.name = parts[0], parts[1]
+		}
+		query.name = strings.ToLower(query.name)
+	}
+
+	if sortBy := values.Get("sort"); sortBy != "" {
+		query.descending = strings.HasPrefix(sortBy, "-")
+		query.sortBy = strings.TrimPrefix(sortBy, "-")
+		if query.sortBy != "id" && query.sortBy != "name" {
+			return nil, fmt.Errorf(`sort must be "id" or "name", optionally prefixed with "-"`)
+		}
+	}
+	if query.page, err = parsePositiveInt(values, "page", 1); err != nil {
+		return nil, err
+	}
+	if query.pageSize, err = parsePositiveInt(values, "pageSize", defaultVendorPageSize); err != nil {
+		return nil, err
+	}
+	if query.pageSize > maxVendorPageSize {
+		query.pageSize = maxVendorPageSize
+	}
+	return query, nil
+}
+
+// matchingIDs narrows the vendor ids down with the inverted indexes. Every condition of the query has to hold.
+func (query *vendorQuery) matchingIDs(index *vendorIndex) []int {
+	ids := index.all
+	for _, purpose := range query.purposes {
+		var declared []int
+		switch query.basis {
+		case "consent":
+			declared = index.consentPurposes[purpose]
+		case "legInt":
+			declared = index.legIntPurposes[purpose]
+		default:
+			declared = union(index.consentPurposes[purpose], index.legIntPurposes[purpose])
+		}
+		if query.flexible {
+			declared = intersect(declared, index.flexiblePurposes[purpose])
+		}
+		ids = intersect(ids, declared)
+	}
+	if query.flexible && len(query.purposes) == 0 {
+		ids = intersect(ids, index.anyFlexible)
+	}
+	for _, id := range query.specialPurposes {
+		ids = intersect(ids, index.specialPurposes[id])
+	}
+	for _, id := range query.features {
+		ids = intersect(ids, index.features[id])
+	}
+	for _, id := range query.specialFeatures {
+		ids = intersect(ids, index.specialFeatures[id])
+	}
+	return ids
+}
+
+func (query *vendorQuery) matchesName(name string) bool {
+	name = strings.ToLower(name)
+	switch query.nameMatch {
+	case "contains":
+		return strings.Contains(name, query.name)
+	case "prefix":
+		return strings.HasPrefix(name, query.name)
+	case "exact":
+		return name == query.name
+	}
+	return true
+}
+
+func (query *vendorQuery) run(snap *gvlSnapshot) vendorQueryResult {
+	vendors := []GVLVersionTwoVendor{}
+	for _, id := range query.matchingIDs(snap.vendorIndex()) {
+		if vendor := snap.GVL.Vendors[id]; query.matchesName(vendor.Name) {
+			vendors = append(vendors, vendor)
+		}
+	}
+	// Names are compared without case and ties broken by id, so that the order is strict
+	less := func(a GVLVersionTwoVendor, b GVLVersionTwoVendor) bool {
+		if query.sortBy == "name" {
+			if aName, bName := strings.ToLower(a.Name), strings.ToLower(b.Name); aName != bName {
+				return aName < bName
+			}
+		}
+		return a.ID < b.ID
+	}
+	sort.SliceStable(vendors, func(i, j int) bool {
+		if query.descending {
+			return less(vendors[j], vendors[i])
+		}
+		return less(vendors[i], vendors[j])
+	})
+
+	result := vendorQueryResult{
+		VendorListVersion: snap.GVL.VendorListVersion,
+		Total:             len(vendors),
+		Page:              query.page,
+		PageSize:          query.pageSize,
+		Vendors:           []GVLVersionTwoVendor{},
+	}
+	// Pages past the last are empty. They are counted before multiplying, which a large page would overflow.
+	if pages := (len(vendors) + query.pageSize - 1) / query.pageSize; query.page-1 < pages {
+		start := (query.page - 1) * query.pageSize
+		end := start + query.pageSize
+		if end > len(vendors) {
+			end = len(vendors)
+		}
+		result.Vendors = vendors[start:end]
+	}
+	return result
+}
+
+// HandleVendorQuery returns the vendors of the latest list that match every condition in the query string:
+// purpose (with basis=consent|legInt|any and flexible=true), specialPurpose, feature, specialFeature and name
+// (contains:, prefix: or exact:). Results are sorted with sort=id|name, prefixed with "-" for descending order,
+// and paginated with page and pageSize.
+func HandleVendorQuery(rw http.ResponseWriter, req *http.Request) {
+	query, err := parseVendorQuery(req.URL.Query())
+	if err != nil {
+		writeError(rw, req, validationFailed(err.Error()))
+		return
+	}
+	lookup, err := lookupGVL(defaultLanguage)
+	if err != nil {
+		l4g.Error(err)
+		writeError(rw, req, latestListUnavailable(err, "There was an error returning the vendor list from IAB's server."))
+		return
+	}
+	if lookup.Stale {
+		setStaleHeaders(rw, lookup)
+	}
+
+	b := &bytes.Buffer{}
+	json.NewEncoder(b).Encode(query.run(lookup.gvlSnapshot))
+	if err := writeCacheableJSON(rw, req, lookup, b.Bytes()); err != nil {
+		l4g.Error(err)
+	}
+}
@@ -0,0 +1,114 @@
+package gvlcachev2
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func queryTestSnapshot() *gvlSnapshot {
+	gvl := testGVL(29)
+	gvl.Vendors = map[int]GVLVersionTwoVendor{
+		1:   {ID: 1, Name: "Alpha Media", Purposes: []int{1, 7}, SpecialFeatures: []int{1}},
+		2:   {ID: 2, Name: "Vidcorp", LegIntPurposes: []int{7}, FlexiblePurposes: []int{7}, SpecialFeatures: []int{1}},
+		3:   {ID: 3, Name: "Beta Ads", LegIntPurposes: []int{7}, Features: []int{2}},
+		744: {ID: 744, Name: "Vidazoo Ltd", Purposes: []int{3}, LegIntPurposes: []int{7}, FlexiblePurposes: []int{3}, SpecialFeatures: []int{1, 2}},
+	}
+	snap := &gvlSnapshot{GVL: gvl}
+	snap.index = buildVendorIndex(gvl)
+	return snap
+}
+
+func runVendorQuery(t *testing.T, rawQuery string) vendorQueryResult {
+	values, _ := url.ParseQuery(rawQuery)
+	query, err := parseVendorQuery(values)
+	if err != nil {
+		t.Fatalf("%s: %v", rawQuery, err)
+	}
+	return query.run(queryTestSnapshot())
+}
+
+func vendorIDs(result vendorQueryResult) []int {
+	ids := []int{}
+	for _, vendor := range result.Vendors {
+		ids = append(ids, vendor.ID)
+	}
+	return ids
+}
+
+func TestVendorQueryFilters(t *testing.T) {
+	cases := map[string][]int{
+		"":                                     {1, 2, 3, 744},
+		"purpose=7":                            {1, 2, 3, 744},
+		"purpose=7&basis=consent":              {1},
+		"purpose=7&basis=legInt":               {2, 3, 744},
+		"purpose=7&basis=legInt&flexible=true": {2},
+		"flexible=true":                        {2, 744},
+		"purpose=7&basis=legInt&specialFeature=1&flexible=true&name=contains:vid": {2},
+		"specialFeature=1,2": {744},
+		"feature=2":          {3},
+		"name=prefix:beta":   {3},
+		"name=Vidazoo%20Ltd": {744},
+		"purpose=7&sort=-id": {744, 3, 2, 1},
+		"sort=name":          {1, 3, 744, 2},
+		"purpose=10":         {},
+	}
+	for rawQuery, want := range cases {
+		got := vendorIDs(runVendorQuery(t, rawQuery))
+		if len(got) != len(want) {
+			t.Errorf("%s: got %v, want %v", rawQuery, got, want)
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s: got %v, want %v", rawQuery, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestVendorQueryPaginates(t *testing.T) {
+	result := runVendorQuery(t, "pageSize=3&page=2")
+	if result.Total != 4 || len(result.Vendors) != 1 || result.Vendors[0].ID != 744 {
+		t.Errorf("page 2 = %+v", result)
+	}
+	if result := runVendorQuery(t, "pageSize=3&page=3"); len(result.Vendors) != 0 {
+		t.Errorf("page past the end = %+v", result)
+	}
+	// (page - 1) * pageSize overflows for this page
+	if result := runVendorQuery(t, "pageSize=100&page=9223372036854775807"); len(result.Vendors) != 0 {
+		t.Errorf("huge page = %+v", result)
+	}
+}
+
+func TestVendorQuerySortsTiesByID(t *testing.T) {
+	snap := queryTestSnapshot()
+	for _, id := range []int{5, 6, 7} {
+		snap.GVL.Vendors[id] = GVLVersionTwoVendor{ID: id, Name: "Same Name"}
+	}
+	snap.GVL.Vendors[8] = GVLVersionTwoVendor{ID: 8, Name: "same name"}
+	snap.index = buildVendorIndex(snap.GVL)
+	for rawQuery, want := range map[string][]int{
+		"name=exact:same%20name&sort=name":  {5, 6, 7, 8},
+		"name=exact:same%20name&sort=-name": {8, 7, 6, 5},
+	} {
+		values, _ := url.ParseQuery(rawQuery)
+		query, err := parseVendorQuery(values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := vendorIDs(query.run(snap)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", rawQuery, got, want)
+		}
+	}
+}
+
+func TestVendorQueryRejectsBadParameters(t *testing.T) {
+	for _, rawQuery := range []string{"purpose=x", "basis=maybe", "flexible=perhaps", "sort=policyUrl", "page=0"} {
+		values, _ := url.ParseQuery(rawQuery)
+		if _, err := parseVendorQuery(values); err == nil {
+			t.Errorf("%s: expected an error", rawQuery)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package gvlcachev2
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	l4g "github.com/ezoic/log4go"
+)
+
+// The reasons a vendor needs consent to be collected again
+const (
+	reasonConsentPurposeAdded     = "consentPurposeAdded"
+	reasonSpecialFeatureAdded     = "specialFeatureAdded"
+	reasonPurposeLegalTextChanged = "purposeLegalTextChanged"
+)
+
+// ReconsentReport says whether consent collected under one version of the vendor list has to be collected again
+// under the latest one, and why, vendor by vendor
+type ReconsentReport struct {
+	ConsentVersion    int               `json:"consentVendorListVersion"`
+	LatestVersion     int               `json:"latestVendorListVersion"`
+	ReconsentRequired bool              `json:"reconsentRequired"`
+	Vendors           []VendorReconsent `json:"vendors"`
+}
+
+// VendorReconsent lists the reasons one vendor needs consent again
+type VendorReconsent struct {
+	ID      int               `json:"id"`
+	Name    string            `json:"name"`
+	Reasons []ReconsentReason `json:"reasons"`
+}
+
+// ReconsentReason is one change that requires consent again. ID is the purpose or special feature it is about.
+type ReconsentReason struct {
+	Kind string `json:"kind"`
+	ID   int    `json:"id"`
+}
+
+// CheckReconsent compares the version of the vendor list consent was collected under with the latest one. Under
+// TCF policy a vendor needs consent again when it declares a new purpose on a consent basis or a new special
+// feature, or when the legal text of a purpose it declares changed. With vendorIDs only those vendors are checked,
+// otherwise every vendor of the latest list is.
+func CheckReconsent(consentVersion int, vendorIDs []int) (*ReconsentReport, error) {
+	lookup, err := lookupGVL(defaultLanguage)
+	if err != nil {
+		return nil, err
+	}
+	if consentVersion == lookup.GVL.VendorListVersion {
+		return checkReconsent(lookup.GVL, lookup.GVL, vendorIDs), nil
+	}
+	from, err := fetchArchivedVersion(consentVersion)
+	if err != nil {
+		return nil, err
+	}
+	return checkReconsent(from, lookup.GVL, vendorIDs), nil
+}
+
+func checkReconsent(from *GVLVersionTwoValue, to *GVLVersionTwoValue, vendorIDs []int) *ReconsentReport {
+	report := &ReconsentReport{
+		ConsentVersion: from.VendorListVersion,
+		LatestVersion:  to.VendorListVersion,
+		Vendors:        []VendorReconsent{},
+	}
+
+	// diffText reports the purposes in id order
+	legalTextChanged := []int{}
+	for _, change := range diffText("purpose", textsOfPurposes(from.Purposes), textsOfPurposes(to.Purposes)) {
+		for _, field := range change.Fields {
+			if field == "descriptionLegal" {
+				legalTextChanged = append(legalTextChanged, change.ID)
+			}
+		}
+	}
+
+	ids := sortedKeys(to.Vendors)
+	if vendorIDs != nil {
+		wanted := map[int]bool{}
+		markAll(wanted, vendorIDs)
+		ids = []int{}
+		for _, id := range sortedKeys(to.Vendors) {
+			if wanted[id] {
+				ids = append(ids, id)
+			}
+		}
+	}
+	for _, id := range ids {
+		vendor := to.Vendors[id]
+		if vendor.DeletedDate != "" {
+			continue
+		}
+		// A vendor that was not in the older list never had consent for anything it declares
+		old := from.Vendors[id]
+		reasons := []ReconsentReason{}
+		if change := diffIDs(old.Purposes, vendor.Purposes); change != nil {
+			for _, purpose := range change.Added {
+				reasons = append(reasons, ReconsentReason{Kind: reasonConsentPurposeAdded, ID: purpose})
+			}
+		}
+		if change := diffIDs(old.SpecialFeatures, vendor.SpecialFeatures); change != nil {
+			for _, feature := range change.Added {
+				reasons = append(reasons, ReconsentReason{Kind: reasonSpecialFeatureAdded, ID: feature})
+			}
+		}
+		declared := map[int]bool{}
+		markAll(declared, vendor.Purposes, vendor.LegIntPurposes)
+		for _, purpose := range legalTextChanged {
+			if declared[purpose] {
+				reasons = append(reasons, ReconsentReason{Kind: reasonPurposeLegalTextChanged, ID: purpose})
+			}
+		}
+		if len(reasons) > 0 {
+			report.Vendors = append(report.Vendors, VendorReconsent{ID: id, Name: vendor.Name, Reasons: reasons})
+		}
+	}
+	report.ReconsentRequired = len(report.Vendors) > 0
+	return report
+}
+
+// HandleReconsentCheck reports whether consent collected under the version given as vendorListVersion has to be
+// collected again, optionally only for the vendors given as vendorIds
+func HandleReconsentCheck(rw http.ResponseWriter, req *http.Request) {
+	version, err := strconv.Atoi(req.URL.Query().Get("vendorListVersion"))
+	if err != nil || version <= 0 {
+		writeError(rw, req, validationFailed("vendorListVersion must be a vendor list version"))
+		return
+	}
+	var vendorIDs []int
+	if raw := req.URL.Query().Get("vendorIds"); raw != "" {
+		if vendorIDs, err = parseVendorIDs(raw); err != nil {
+			writeError(rw, req, validationFailed(err.Error()))
+			return
+		}
+	}
+
+	report, err := CheckReconsent(version, vendorIDs)
+	if err != nil {
+		l4g.Error(err)
+		writeError(rw, req, upstreamUnavailable(err, http.StatusBadGateway, "There was an error fetching the vendor lists to compare."))
+		return
+	}
+	b := &bytes.Buffer{}
+	json.NewEncoder(b).Encode(report)
+	rw.Header().Add("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(b.Bytes())
+}
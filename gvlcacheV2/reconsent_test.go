@@ -0,0 +1,73 @@
+package gvlcachev2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func reconsentTestVersions() (*GVLVersionTwoValue, *GVLVersionTwoValue) {
+	from := subsetTestGVL()
+	from.VendorListVersion = 28
+
+	to := subsetTestGVL()
+	to.Purposes[2] = GVLVersionTwoPurpose{ID: 2, Name: "Select basic ads", DescriptionLegal: "New legal text"}
+	to.Purposes[3] = GVLVersionTwoPurpose{ID: 3, Name: "Create a personalised ads profile", Description: "Reworded"}
+	vendor := to.Vendors[744]
+	vendor.Purposes = []int{1, 3, 4}
+	vendor.SpecialFeatures = []int{1, 2}
+	to.Vendors[744] = vendor
+	to.Vendors[12] = GVLVersionTwoVendor{ID: 12, Name: "New Co", Purposes: []int{1}}
+	to.Vendors[13] = GVLVersionTwoVendor{ID: 13, Name: "Gone Co", Purposes: []int{1}, DeletedDate: "2020-06-01T00:00:00Z"}
+	return from, to
+}
+
+func TestCheckReconsentListsReasonsByVendor(t *testing.T) {
+	from, to := reconsentTestVersions()
+	report := checkReconsent(from, to, nil)
+
+	want := []VendorReconsent{
+		{ID: 8, Name: "Emerse Sverige AB", Reasons: []ReconsentReason{{Kind: reasonPurposeLegalTextChanged, ID: 2}}},
+		{ID: 12, Name: "New Co", Reasons: []ReconsentReason{{Kind: reasonConsentPurposeAdded, ID: 1}}},
+		{ID: 744, Name: "Vidazoo Ltd", Reasons: []ReconsentReason{{Kind: reasonConsentPurposeAdded, ID: 4}, {Kind: reasonSpecialFeatureAdded, ID: 1}}},
+	}
+	if !report.ReconsentRequired || !reflect.DeepEqual(report.Vendors, want) {
+		t.Errorf("report = %+v", report)
+	}
+
+	if report := checkReconsent(from, to, []int{8, 999}); len(report.Vendors) != 1 || report.Vendors[0].ID != 8 {
+		t.Errorf("vendor set report = %+v", report)
+	}
+	if report := checkReconsent(to, to, nil); report.ReconsentRequired || len(report.Vendors) != 0 {
+		t.Errorf("same version report = %+v", report)
+	}
+}
+
+func TestHandleReconsentCheck(t *testing.T) {
+	from, to := reconsentTestVersions()
+	useArchive(t, from)
+	snap, err := promoteVersion(to, defaultLanguage, time.Now().Add(time.Hour), gvlSource{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setSnapshot(snap)
+
+	rw := httptest.NewRecorder()
+	HandleReconsentCheck(rw, httptest.NewRequest(http.MethodGet, "/GVLV2/reconsent?vendorListVersion=28&vendorIds=744", nil))
+	report := ReconsentReport{}
+	json.NewDecoder(rw.Body).Decode(&report)
+	if rw.Code != http.StatusOK || !report.ReconsentRequired || report.ConsentVersion != 28 || report.LatestVersion != 29 || len(report.Vendors) != 1 {
+		t.Errorf("status = %d, report = %+v", rw.Code, report)
+	}
+
+	for query, status := range map[string]int{"": http.StatusBadRequest, "?vendorListVersion=28&vendorIds=x": http.StatusBadRequest, "?vendorListVersion=27": http.StatusNotFound} {
+		rw := httptest.NewRecorder()
+		HandleReconsentCheck(rw, httptest.NewRequest(http.MethodGet, "/GVLV2/reconsent"+query, nil))
+		if rw.Code != status {
+			t.Errorf("%q: status = %d, want %d", query, rw.Code, status)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package gvlcachev2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	l4g "github.com/ezoic/log4go"
+	"github.com/go-chi/chi"
+)
+
+// GVLVersionTwoExpandedVendor is a vendor with the ids it declares replaced by the objects they refer to
+type GVLVersionTwoExpandedVendor struct {
+	ID               int                           `json:"id"`
+	Name             string                        `json:"name"`
+	Purposes         []GVLVersionTwoPurpose        `json:"purposes"`
+	SpecialPurposes  []GVLVersionTwoSpecialPurpose `json:"specialPurposes"`
+	LegIntPurposes   []GVLVersionTwoPurpose        `json:"legIntPurposes"`
+	FlexiblePurposes []GVLVersionTwoPurpose        `json:"flexiblePurposes"`
+	Features         []GVLVersionTwoFeature        `json:"features"`
+	SpecialFeatures  []GVLVersionTwoSpecialFeature `json:"specialFeatures"`
+	PolicyURL        string                        `json:"policyUrl"`
+	DeletedDate      string                        `json:"deletedDate"`
+	Overflow         GVLVersionTwoOverflow         `json:"overflow"`
+}
+
+// expandVendor looks up every id the vendor declares. Ids that are not in the list are left out.
+func (gvl *GVLVersionTwoValue) expandVendor(vendor GVLVersionTwoVendor) GVLVersionTwoExpandedVendor {
+	purposes := func(ids []int) []GVLVersionTwoPurpose {
+		out := []GVLVersionTwoPurpose{}
+		for _, id := range ids {
+			if purpose, ok := gvl.Purposes[id]; ok {
+				out = append(out, purpose)
+			}
+		}
+		return out
+	}
+	expanded := GVLVersionTwoExpandedVendor{
+		ID:               vendor.ID,
+		Name:             vendor.Name,
+		Purposes:         purposes(vendor.Purposes),
+		SpecialPurposes:  []GVLVersionTwoSpecialPurpose{},
+		LegIntPurposes:   purposes(vendor.LegIntPurposes),
+		FlexiblePurposes: purposes(vendor.FlexiblePurposes),
+		Features:         []GVLVersionTwoFeature{},
+		SpecialFeatures:  []GVLVersionTwoSpecialFeature{},
+		PolicyURL:        vendor.PolicyURL,
+		DeletedDate:      vendor.DeletedDate,
+		Overflow:         vendor.Overflow,
+	}
+	for _, id := range vendor.SpecialPurposes {
+		if purpose, ok := gvl.SpecialPurposes[id]; ok {
+			expanded.SpecialPurposes = append(expanded.SpecialPurposes, purpose)
+		}
+	}
+	for _, id := range vendor.Features {
+		if feature, ok := gvl.Features[id]; ok {
+			expanded.Features = append(expanded.Features, feature)
+		}
+	}
+	for _, id := range vendor.SpecialFeatures {
+		if feature, ok := gvl.SpecialFeatures[id]; ok {
+			expanded.SpecialFeatures = append(expanded.SpecialFeatures, feature)
+		}
+	}
+	return expanded
+}
+
+// serveResource answers a request for one entry of the latest list. find returns the entry with the id from the
+// URL, and false when the list has no such entry.
+func serveResource(rw http.ResponseWriter, req *http.Request, kind string, find func(gvl *GVLVersionTwoValue, id int) (interface{}, bool)) {
+	id, err := strconv.Atoi(chi.URLParam(req, "id"))
+	if err != nil {
+		writeError(rw, req, validationFailed(fmt.Sprintf("%q is not a %s id", chi.URLParam(req, "id"), kind)))
+		return
+	}
+	lookup, err := lookupGVL(defaultLanguage)
+	if err != nil {
+		l4g.Error(err)
+		writeError(rw, req, latestListUnavailable(err, "There was an error returning the vendor list from IAB's server."))
+		return
+	}
+	if lookup.Stale {
+		setStaleHeaders(rw, lookup)
+	}
+
+	resource, ok := find(lookup.GVL, id)
+	if !ok {
+		writeError(rw, req, notFound(fmt.Sprintf("%s %d is not in vendor list version %d", kind, id, lookup.GVL.VendorListVersion)))
+		return
+	}
+	b := &bytes.Buffer{}
+	json.NewEncoder(b).Encode(resource)
+	if err := writeCacheableJSON(rw, req, lookup, b.Bytes()); err != nil {
+		l4g.Error(err)
+	}
+}
+
+// HandleVendorResource returns the vendor with the id in the URL. With ?expand=true the purposes and features
+// it declares are returned as full objects instead of ids.
+func HandleVendorResource(rw http.ResponseWriter, req *http.Request) {
+	expand := req.URL.Query().Get("expand") == "true"
+	serveResource(rw, req, "vendor", func(gvl *GVLVersionTwoValue, id int) (interface{}, bool) {
+		vendor, ok := gvl.Vendors[id]
+		if ok && expand {
+			return gvl.expandVendor(vendor), true
+		}
+		return vendor, ok
+	})
+}
+
+// HandlePurposeResource returns the purpose with the id in the URL
+func HandlePurposeResource(rw http.ResponseWriter, req *http.Request) {
+	serveResource(rw, req, "purpose", func(gvl *GVLVersionTwoValue, id int) (interface{}, bool) {
+		purpose, ok := gvl.Purposes[id]
+		return purpose, ok
+	})
+}
+
+// HandleSpecialPurposeResource returns the special purpose with the id in the URL
+func HandleSpecialPurposeResource(rw http.ResponseWriter, req *http.Request) {
+	serveResource(rw, req, "special purpose", func(gvl *GVLVersionTwoValue, id int) (interface{}, bool) {
+		purpose, ok := gvl.SpecialPurposes[id]
+		return purpose, ok
+	})
+}
+
+// HandleFeatureResource returns the feature with the id in the URL
+func HandleFeatureResource(rw http.ResponseWriter, req *http.Request) {
+	serveResource(rw, req, "feature", func(gvl *GVLVersionTwoValue, id int) (interface{}, bool) {
+		feature, ok := gvl.Features[id]
+		return feature, ok
+	})
+}
+
+// HandleSpecialFeatureResource returns the special feature with the id in the URL
+func HandleSpecialFeatureResource(rw http.ResponseWriter, req *http.Request) {
+	serveResource(rw, req, "special feature", func(gvl *GVLVersionTwoValue, id int) (interface{}, bool) {
+		feature, ok := gvl.SpecialFeatures[id]
+		return feature, ok
+	})
+}
+
+// HandleStackResource returns the stack with the id in the URL
+func HandleStackResource(rw http.ResponseWriter, req *http.Request) {
+	serveResource(rw, req, "stack", func(gvl *GVLVersionTwoValue, id int) (interface{}, bool) {
+		stack, ok := gvl.Stacks[id]
+		return stack, ok
+	})
+}
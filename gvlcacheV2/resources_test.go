@@ -0,0 +1,76 @@
+package gvlcachev2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+func resourceRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/GVLV2/vendors/{id}", HandleVendorResource)
+	r.Get("/GVLV2/purposes/{id}", HandlePurposeResource)
+	r.Get("/GVLV2/stacks/{id}", HandleStackResource)
+	return r
+}
+
+func getResource(t *testing.T, target string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	resourceRouter().ServeHTTP(rw, httptest.NewRequest(http.MethodGet, target, nil))
+	return rw
+}
+
+func TestResourcesReturnMatchingEntry(t *testing.T) {
+	useUpstream(t, serveGVL(subsetTestGVL(), 3600))
+
+	purpose := GVLVersionTwoPurpose{}
+	rw := getResource(t, "/GVLV2/purposes/3")
+	json.NewDecoder(rw.Body).Decode(&purpose)
+	if rw.Code != http.StatusOK || purpose.ID != 3 {
+		t.Errorf("purpose 3: status = %d, body = %+v", rw.Code, purpose)
+	}
+
+	vendor := GVLVersionTwoVendor{}
+	rw = getResource(t, "/GVLV2/vendors/744")
+	json.NewDecoder(rw.Body).Decode(&vendor)
+	if rw.Code != http.StatusOK || vendor.Name != "Vidazoo Ltd" || len(vendor.Purposes) != 2 {
+		t.Errorf("vendor 744: status = %d, body = %+v", rw.Code, vendor)
+	}
+}
+
+func TestVendorResourceExpandsPurposes(t *testing.T) {
+	useUpstream(t, serveGVL(subsetTestGVL(), 3600))
+
+	expanded := GVLVersionTwoExpandedVendor{}
+	rw := getResource(t, "/GVLV2/vendors/744?expand=true")
+	json.NewDecoder(rw.Body).Decode(&expanded)
+	if len(expanded.Purposes) != 2 || expanded.Purposes[1].Name != "Create a personalised ads profile" {
+		t.Errorf("purposes = %+v", expanded.Purposes)
+	}
+	if len(expanded.SpecialFeatures) != 1 || expanded.SpecialFeatures[0].ID != 2 {
+		t.Errorf("special features = %+v", expanded.SpecialFeatures)
+	}
+}
+
+func TestResourcesReportUnknownIds(t *testing.T) {
+	useUpstream(t, serveGVL(subsetTestGVL(), 3600))
+
+	for target, want := range map[string]struct {
+		status int
+		code   string
+	}{
+		"/GVLV2/vendors/99":  {http.StatusNotFound, CodeNotFound},
+		"/GVLV2/stacks/42":   {http.StatusNotFound, CodeNotFound},
+		"/GVLV2/purposes/x1": {http.StatusBadRequest, CodeValidationFailed},
+	} {
+		rw := getResource(t, target)
+		body := ErrorResponse{}
+		json.NewDecoder(rw.Body).Decode(&body)
+		if rw.Code != want.status || body.Error.Code != want.code || body.Error.Message == "" {
+			t.Errorf("%s: status = %d, error = %+v", target, rw.Code, body.Error)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package gvlcachev2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ezoic/gvlcache/tcstring"
+	l4g "github.com/ezoic/log4go"
+	"github.com/go-chi/chi"
+)
+
+// The problems a publisher restriction can have
+const (
+	problemPurposeUnknown  = "purposeUnknown"
+	problemVendorNotInList = "vendorNotInList"
+	problemNotDeclared     = "purposeNotDeclared"
+	problemNotFlexible     = "purposeNotFlexible"
+	problemLINotPermitted  = "legitimateInterestNotPermitted"
+	problemConflicting     = "conflictingRestrictions"
+)
+
+// publisherIDPattern is what publisher ids may look like. They name the files configs are stored in.
+var publisherIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// RestrictionsDir is the directory publisher restriction configs are stored in, one file per publisher. It is the
+// only copy of them, so it should be on a volume that survives restarts and that every instance shares.
+var RestrictionsDir string
+
+// errNoRestrictionConfig is loading the config of a publisher that has not stored one
+var errNoRestrictionConfig = errors.New("the publisher has no restriction config")
+
+// RestrictionConfig is the publisher restrictions a publisher has its CMP write into TC strings
+type RestrictionConfig struct {
+	PublisherID       string                          `json:"publisherId"`
+	Restrictions      []tcstring.PublisherRestriction `json:"restrictions"`
+	VendorListVersion int                             `json:"vendorListVersion"` // the version it was validated against
+	UpdatedAt         time.Time                       `json:"updatedAt"`
+}
+
+// RestrictionProblem is a restriction TCF policy does not allow. VendorID is 0 for problems of the whole
+// restriction.
+type RestrictionProblem struct {
+	PurposeID       int                      `json:"purposeId"`
+	RestrictionType tcstring.RestrictionType `json:"restrictionType"`
+	VendorID        int                      `json:"vendorId,omitempty"`
+	Problem         string                   `json:"problem"`
+}
+
+func (problem RestrictionProblem) String() string {
+	if problem.VendorID == 0 {
+		return fmt.Sprintf("%s on purpose %d: %s", problem.RestrictionType, problem.PurposeID, problem.Problem)
+	}
+	return fmt.Sprintf("%s on purpose %d for vendor %d: %s", problem.RestrictionType, problem.PurposeID, problem.VendorID, problem.Problem)
+}
+
+// RestrictionReport is the outcome of checking publisher restrictions against a version of the vendor list
+type RestrictionReport struct {
+	VendorListVersion int                  `json:"vendorListVersion"`
+	Valid             bool                 `json:"valid"`
+	Problems          []RestrictionProblem `json:"problems"`
+}
+
+// ValidateRestrictions checks publisher restrictions against the vendor list. Any purpose can be forbidden to a
+// vendor, but its legal basis can only be switched when the vendor declared the purpose flexible, and only to a
+// basis the purpose allows. A vendor can only be given one type of restriction per purpose.
+func ValidateRestrictions(restrictions []tcstring.PublisherRestriction, gvl *GVLVersionTwoValue) *RestrictionReport {
+	report := &RestrictionReport{VendorListVersion: gvl.VendorListVersion, Problems: []RestrictionProblem{}}
+	conflicts := tcstring.Conflicts(restrictions)
+	for _, restriction := range tcstring.MergeRestrictions(restrictions) {
+		problem := RestrictionProblem{PurposeID: restriction.PurposeID, RestrictionType: restriction.RestrictionType}
+		if _, ok := gvl.Purposes[restriction.PurposeID]; !ok {
+			problem.Problem = problemPurposeUnknown
+			report.Problems = append(report.Problems, problem)
+			continue
+		}
+		if restriction.RestrictionType == tcstring.RequireLegitimateInterest && !legitimateInterestAllowed(restriction.PurposeID, gvl.TCFPolicyVersion) {
+			problem.Problem = problemLINotPermitted
+			report.Problems = append(report.Problems, problem)
+			continue
+		}
+		for _, id := range restriction.Vendors {
+			problem.VendorID = id
+			vendor, ok := gvl.Vendors[id]
+			switch {
+			case !ok:
+				problem.Problem = problemVendorNotInList
+			case conflicts[restriction.PurposeID].Has(id):
+				problem.Problem = problemConflicting
+			case restriction.RestrictionType == tcstring.NotAllowed:
+				continue
+			case !containsInt(vendor.Purposes, restriction.PurposeID) && !containsInt(vendor.LegIntPurposes, restriction.PurposeID):
+				problem.Problem = problemNotDeclared
+			case !containsInt(vendor.FlexiblePurposes, restriction.PurposeID):
+				problem.Problem = problemNotFlexible
+			default:
+				continue
+			}
+			report.Problems = append(report.Problems, problem)
+		}
+	}
+	report.Valid = len(report.Problems) == 0
+	return report
+}
+
+func restrictionConfigPath(publisherID string) string {
+	return filepath.Join(RestrictionsDir, publisherID+".json")
+}
+
+// storeRestrictionConfig writes a publisher's config to a temporary file first and renames it into place, as
+// persistSnapshot does, so a crash never leaves a half-written config behind
+func storeRestrictionConfig(config RestrictionConfig) error {
+	if RestrictionsDir == "" {
+		return errors.New("no restrictions directory is configured")
+	}
+	b, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(RestrictionsDir, "restrictions-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), restrictionConfigPath(config.PublisherID))
+}
+
+func loadRestrictionConfig(publisherID string) (*RestrictionConfig, error) {
+	if RestrictionsDir == "" {
+		return nil, errors.New("no restrictions directory is configured")
+	}
+	b, err := ioutil.ReadFile(restrictionConfigPath(publisherID))
+	if os.IsNotExist(err) {
+		return nil, errNoRestrictionConfig
+	}
+	if err != nil {
+		return nil, err
+	}
+	config := &RestrictionConfig{}
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("%s: %v", restrictionConfigPath(publisherID), err)
+	}
+	return config, nil
+}
+
+// restrictionsRequest is the body of the restriction endpoints
+type restrictionsRequest struct {
+	Restrictions []tcstring.PublisherRestriction `json:"restrictions"`
+}
+
+func parseRestrictionsRequest(req *http.Request) ([]tcstring.PublisherRestriction, error) {
+	body := restrictionsRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("the request body is not a valid restriction config: %v", err)
+	}
+	for i, restriction := range body.Restrictions {
+		if restriction.PurposeID <= 0 || len(restriction.Vendors) == 0 {
+			return nil, fmt.Errorf("restriction %d needs a purposeId and vendors", i)
+		}
+	}
+	return body.Restrictions, nil
+}
+
+func writeJSON(rw http.ResponseWriter, status int, value interface{}) {
+	b := &bytes.Buffer{}
+	json.NewEncoder(b).Encode(value)
+	rw.Header().Add("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	rw.Write(b.Bytes())
+}
+
+// HandleValidateRestrictions checks the restrictions in the body against the latest vendor list without storing
+// them
+func HandleValidateRestrictions(rw http.ResponseWriter, req *http.Request) {
+	restrictions, err := parseRestrictionsRequest(req)
+	if err != nil {
+		writeError(rw, req, validationFailed(err.Error()))
+		return
+	}
+	lookup, err := lookupGVL(defaultLanguage)
+	if err != nil {
+		l4g.Error(err)
+		writeError(rw, req, upstreamUnavailable(err, http.StatusBadGateway, "There was an error fetching the vendor list."))
+		return
+	}
+	writeJSON(rw, http.StatusOK, ValidateRestrictions(restrictions, lookup.GVL))
+}
+
+// HandlePutRestrictions stores the restriction config of the publisher in the path, once it passes validation
+// against the latest vendor list
+func HandlePutRestrictions(rw http.ResponseWriter, req *http.Request) {
+	publisherID := chi.URLParam(req, "publisherId")
+	if !publisherIDPattern.MatchString(publisherID) {
+		writeError(rw, req, validationFailed(fmt.Sprintf("%q is not a publisher id", publisherID)))
+		return
+	}
+	restrictions, err := parseRestrictionsRequest(req)
+	if err != nil {
+		writeError(rw, req, validationFailed(err.Error()))
+		return
+	}
+	lookup, err := lookupGVL(defaultLanguage)
+	if err != nil {
+		l4g.Error(err)
+		writeError(rw, req, upstreamUnavailable(err, http.StatusBadGateway, "There was an error fetching the vendor list."))
+		return
+	}
+	report := ValidateRestrictions(restrictions, lookup.GVL)
+	if !report.Valid {
+		problems := make([]string, len(report.Problems))
+		for i, problem := range report.Problems {
+			problems[i] = problem.String()
+		}
+		writeError(rw, req, validationFailed("The restrictions break TCF policy: "+strings.Join(problems, "; ")))
+		return
+	}
+
+	config := RestrictionConfig{
+		PublisherID:       publisherID,
+		Restrictions:      tcstring.MergeRestrictions(restrictions),
+		VendorListVersion: lookup.GVL.VendorListVersion,
+		UpdatedAt:         time.Now().UTC(),
+	}
+	if err := storeRestrictionConfig(config); err != nil {
+		l4g.Error(err)
+		writeError(rw, req, internalError("There was an error storing the restriction config."))
+		return
+	}
+	l4g.Info("Stored %d publisher restrictions for %s", len(config.Restrictions), publisherID)
+	writeJSON(rw, http.StatusOK, config)
+}
+
+// storedRestrictions is the body of HandleGetRestrictions. The report checks the config against the latest list,
+// which may have changed since the config was stored.
+type storedRestrictions struct {
+	Config RestrictionConfig  `json:"config"`
+	Report *RestrictionReport `json:"report"`
+}
+
+// HandleGetRestrictions returns the stored restriction config of the publisher in the path
+func HandleGetRestrictions(rw http.ResponseWriter, req *http.Request) {
+	publisherID := chi.URLParam(req, "publisherId")
+	if !publisherIDPattern.MatchString(publisherID) {
+		writeError(rw, req, validationFailed(fmt.Sprintf("%q is not a publisher id", publisherID)))
+		return
+	}
+	config, err := loadRestrictionConfig(publisherID)
+	if err == errNoRestrictionConfig {
+		writeError(rw, req, notFound(fmt.Sprintf("Publisher %s has no restriction config.", publisherID)))
+		return
+	}
+	if err != nil {
+		l4g.Error(err)
+		writeError(rw, req, internalError("There was an error reading the restriction config."))
+		return
+	}
+	stored := storedRestrictions{Config: *config}
+	if lookup, err := lookupGVL(defaultLanguage); err == nil {
+		stored.Report = ValidateRestrictions(config.Restrictions, lookup.GVL)
+	}
+	writeJSON(rw, http.StatusOK, stored)
+}
@@ -0,0 +1,121 @@
+package gvlcachev2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ezoic/gvlcache/tcstring"
+	"github.com/go-chi/chi"
+)
+
+func TestValidateRestrictionsFollowsFlexiblePurposes(t *testing.T) {
+	gvl := evaluateTestGVL()
+	for _, test := range []struct {
+		name        string
+		restriction tcstring.PublisherRestriction
+		problems    []string
+	}{
+		{"any purpose can be forbidden", tcstring.PublisherRestriction{PurposeID: 3, RestrictionType: tcstring.NotAllowed, Vendors: tcstring.IDs{8, 744}}, nil},
+		{"flexible purpose", tcstring.PublisherRestriction{PurposeID: 2, RestrictionType: tcstring.RequireConsent, Vendors: tcstring.IDs{8}}, nil},
+		{"purpose that isn't flexible", tcstring.PublisherRestriction{PurposeID: 3, RestrictionType: tcstring.RequireLegitimateInterest, Vendors: tcstring.IDs{744}},
+			[]string{problemNotFlexible}},
+		{"purpose the vendor does not declare", tcstring.PublisherRestriction{PurposeID: 2, RestrictionType: tcstring.RequireConsent, Vendors: tcstring.IDs{744}},
+			[]string{problemNotDeclared}},
+		{"purpose 1 on legitimate interest", tcstring.PublisherRestriction{PurposeID: 1, RestrictionType: tcstring.RequireLegitimateInterest, Vendors: tcstring.IDs{8}},
+			[]string{problemLINotPermitted}},
+		{"unknown purpose", tcstring.PublisherRestriction{PurposeID: 9, RestrictionType: tcstring.NotAllowed, Vendors: tcstring.IDs{8}},
+			[]string{problemPurposeUnknown}},
+		{"unknown vendor", tcstring.PublisherRestriction{PurposeID: 1, RestrictionType: tcstring.NotAllowed, Vendors: tcstring.IDs{999}},
+			[]string{problemVendorNotInList}},
+	} {
+		report := ValidateRestrictions([]tcstring.PublisherRestriction{test.restriction}, gvl)
+		problems := []string{}
+		for _, problem := range report.Problems {
+			problems = append(problems, problem.Problem)
+		}
+		if report.Valid != (len(test.problems) == 0) || strings.Join(problems, ",") != strings.Join(test.problems, ",") {
+			t.Errorf("%s: report = %+v, want problems %v", test.name, report, test.problems)
+		}
+	}
+
+	report := ValidateRestrictions([]tcstring.PublisherRestriction{
+		{PurposeID: 2, RestrictionType: tcstring.NotAllowed, Vendors: tcstring.IDs{8}},
+		{PurposeID: 2, RestrictionType: tcstring.RequireConsent, Vendors: tcstring.IDs{8}},
+	}, gvl)
+	if len(report.Problems) != 2 || report.Problems[0].Problem != problemConflicting || report.Problems[0].VendorID != 8 {
+		t.Errorf("conflicting restrictions: %+v", report)
+	}
+}
+
+func restrictionsRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Post("/tcf/restrictions/validate", HandleValidateRestrictions)
+	r.Get("/tcf/publishers/{publisherId}/restrictions", HandleGetRestrictions)
+	r.Put("/tcf/publishers/{publisherId}/restrictions", HandlePutRestrictions)
+	return r
+}
+
+func serveRestrictions(method string, target string, body string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	restrictionsRouter().ServeHTTP(rw, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rw
+}
+
+func useRestrictionsDir(t *testing.T) {
+	previous := RestrictionsDir
+	RestrictionsDir = t.TempDir()
+	t.Cleanup(func() { RestrictionsDir = previous })
+}
+
+func TestRestrictionConfigsAreValidatedAndStored(t *testing.T) {
+	useUpstream(t, serveGVL(evaluateTestGVL(), 3600))
+	useRestrictionsDir(t)
+
+	if rw := serveRestrictions(http.MethodGet, "/tcf/publishers/pub-1/restrictions", ""); rw.Code != http.StatusNotFound {
+		t.Errorf("before storing: status = %d", rw.Code)
+	}
+
+	invalid := `{"restrictions":[{"purposeId":3,"restrictionType":"requireLegitimateInterest","vendors":[744]}]}`
+	rw := serveRestrictions(http.MethodPost, "/tcf/restrictions/validate", invalid)
+	report := RestrictionReport{}
+	json.NewDecoder(rw.Body).Decode(&report)
+	if rw.Code != http.StatusOK || report.Valid || len(report.Problems) != 1 {
+		t.Errorf("validate: status = %d, report = %+v", rw.Code, report)
+	}
+	rw = serveRestrictions(http.MethodPut, "/tcf/publishers/pub-1/restrictions", invalid)
+	if rw.Code != http.StatusBadRequest || !strings.Contains(decodeError(t, rw).Message, problemNotFlexible) {
+		t.Errorf("storing an invalid config: status = %d", rw.Code)
+	}
+
+	valid := `{"restrictions":[{"purposeId":2,"restrictionType":"requireConsent","vendors":[8]},{"purposeId":3,"restrictionType":"notAllowed","vendors":[8,744]}]}`
+	if rw := serveRestrictions(http.MethodPut, "/tcf/publishers/pub-1/restrictions", valid); rw.Code != http.StatusOK {
+		t.Fatalf("storing: status = %d: %s", rw.Code, rw.Body)
+	}
+	rw = serveRestrictions(http.MethodGet, "/tcf/publishers/pub-1/restrictions", "")
+	stored := storedRestrictions{}
+	json.NewDecoder(rw.Body).Decode(&stored)
+	if rw.Code != http.StatusOK || len(stored.Config.Restrictions) != 2 || stored.Config.VendorListVersion != 29 || !stored.Report.Valid {
+		t.Errorf("stored: status = %d, body = %+v", rw.Code, stored)
+	}
+	if stored.Config.Restrictions[0].RestrictionType != tcstring.RequireConsent {
+		t.Errorf("restriction type read back as %v", stored.Config.Restrictions[0].RestrictionType)
+	}
+	// The file is the config, not a cache of it
+	if _, err := os.Stat(filepath.Join(RestrictionsDir, "pub-1.json")); err != nil {
+		t.Errorf("stored config: %v", err)
+	}
+	for _, publisherID := range []string{"..", ".hidden"} {
+		if rw := serveRestrictions(http.MethodPut, "/tcf/publishers/"+publisherID+"/restrictions", valid); rw.Code != http.StatusBadRequest {
+			t.Errorf("publisher %q: status = %d", publisherID, rw.Code)
+		}
+	}
+
+	if rw := serveRestrictions(http.MethodPut, "/tcf/publishers/pub-1/restrictions", `{"restrictions":[{"purposeId":2,"restrictionType":"sometimes","vendors":[8]}]}`); rw.Code != http.StatusBadRequest {
+		t.Errorf("unknown restriction type: status = %d", rw.Code)
+	}
+}
@@ -0,0 +1,246 @@
+package gvlcachev2
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	l4g "github.com/ezoic/log4go"
+)
+
+// Once a list expires it is not dropped right away. For StaleWhileRevalidate after it expires it keeps being
+// served while a refresh runs in the background, and for StaleIfError after it expires it keeps being served
+// when IAB can't be reached. Past both windows a failed refresh is an error.
+var (
+	StaleWhileRevalidate = time.Hour
+	StaleIfError         = 7 * 24 * time.Hour
+)
+
+// gvlSnapshot is a list that has been accepted into the cache, with when it was stored and until when it is fresh
+type gvlSnapshot struct {
+	GVL      *GVLVersionTwoValue `json:"gvl"`
+	Language string              `json:"language"`
+	StoredAt time.Time           `json:"storedAt"`
+	Expires  time.Time           `json:"expires"`
+	Source   gvlSource           `json:"source"`
+
+	// index is built when the snapshot is accepted, see vendorIndex
+	index *vendorIndex
+}
+
+// vendorIndex returns the inverted indexes of the snapshot's vendors
+func (snap *gvlSnapshot) vendorIndex() *vendorIndex {
+	if snap.index == nil {
+		// Only snapshots that were never accepted with setSnapshot get here
+		return buildVendorIndex(snap.GVL)
+	}
+	return snap.index
+}
+
+// gvlSource is where a list was fetched from, along with the validators IAB sent with it
+type gvlSource struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+func (snap *gvlSnapshot) isFresh(now time.Time) bool {
+	return now.Before(snap.Expires)
+}
+
+// age is how long ago the list was stored, as reported in the Age header
+func (snap *gvlSnapshot) age(now time.Time) time.Duration {
+	if now.Before(snap.StoredAt) {
+		return 0
+	}
+	return now.Sub(snap.StoredAt)
+}
+
+// gvlLookup is the snapshot picked to answer a request, and whether it is being served past its expiry
+type gvlLookup struct {
+	*gvlSnapshot
+	Stale bool
+	// RevalidationFailed is set when the list is served stale because IAB could not be reached
+	RevalidationFailed bool
+}
+
+// The L1 snapshot is the copy of the latest list held in this process, in front of memcached
+var (
+	snapshotMu sync.RWMutex
+	snapshots  = map[string]*gvlSnapshot{}
+)
+
+func currentSnapshot(language string) *gvlSnapshot {
+	snapshotMu.RLock()
+	defer snapshotMu.RUnlock()
+	return snapshots[language]
+}
+
+func setSnapshot(snap *gvlSnapshot) {
+	if snap.index == nil {
+		snap.index = buildVendorIndex(snap.GVL)
+	}
+
+	snapshotMu.Lock()
+	previous := snapshots[snap.Language]
+	snapshots[snap.Language] = snap
+	snapshotMu.Unlock()
+
+	if previous == nil || previous.StoredAt != snap.StoredAt {
+		if err := persistSnapshot(snap); err != nil {
+			l4g.Warn("Could not write the L1 snapshot to disk: %v", err)
+		}
+	}
+}
+
+// dropSnapshot removes the L1 snapshot of a language, or of every language when language is empty, from memory
+// and from disk. It returns the languages it dropped.
+func dropSnapshot(language string) []string {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	dropped := []string{}
+	for l := range snapshots {
+		if language == "" || l == language {
+			delete(snapshots, l)
+			dropped = append(dropped, l)
+		}
+	}
+	if language != "" && len(dropped) == 0 {
+		dropped = append(dropped, language)
+	}
+	for _, l := range dropped {
+		if err := removePersistedSnapshot(l); err != nil {
+			l4g.Warn("Could not remove the L1 snapshot from disk: %v", err)
+		}
+	}
+	return dropped
+}
+
+// refreshCall is a fetch from IAB that concurrent callers wait on instead of starting their own
+type refreshCall struct {
+	done chan struct{}
+	snap *gvlSnapshot
+	err  error
+}
+
+var (
+	refreshMu sync.Mutex
+	inflight  *refreshCall
+)
+
+// refreshGVL fetches the list from IAB and accepts it into the cache. Only one fetch runs at a time, callers
+// that arrive while it runs get its result.
+func refreshGVL() (*gvlSnapshot, error) {
+	call, started := joinRefresh()
+	if started {
+		runRefresh(call)
+	}
+	<-call.done
+	return call.snap, call.err
+}
+
+// refreshGVLInBackground starts a refresh unless one is already running or the instance is shutting down
+func refreshGVLInBackground() {
+	if isDraining() {
+		return
+	}
+	call, started := joinRefresh()
+	if !started {
+		return
+	}
+	go func() {
+		runRefresh(call)
+		if call.err != nil {
+			l4g.Warn("Background refresh of the GVL failed: %v", call.err)
+		}
+	}()
+}
+
+// joinRefresh returns the refresh that is running, or registers a new one that the caller has to run
+func joinRefresh() (*refreshCall, bool) {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+	if inflight != nil {
+		return inflight, false
+	}
+	inflight = &refreshCall{done: make(chan struct{})}
+	return inflight, true
+}
+
+func runRefresh(call *refreshCall) {
+	gvl := &GVLVersionTwoValue{}
+	resp, err := gvl.getGVLVersionTwoValueFromIABSource()
+	if err == nil {
+		recordHit(tierUpstream)
+		call.snap = gvl.storeGVLVersion2ValueIntoCache(resp)
+	} else {
+		recordError(tierUpstream)
+	}
+	call.err = err
+
+	refreshMu.Lock()
+	inflight = nil
+	refreshMu.Unlock()
+	close(call.done)
+}
+
+// lookupGVL picks the list to serve for a language: the L1 snapshot, then the latest version in memcached, then
+// IAB. Expired lists are served stale within the windows described above.
+func lookupGVL(language string) (*gvlLookup, error) {
+	now := time.Now()
+	tier := tierL1
+	snap := currentSnapshot(language)
+	if snap != nil && snap.isFresh(now) {
+		recordHit(tierL1)
+		return &gvlLookup{gvlSnapshot: snap}, nil
+	}
+	recordMiss(tierL1)
+
+	// Another instance may already have refreshed the list
+	cached, err := loadLatestVersion(language)
+	switch {
+	case err != nil:
+		recordMiss(tierMemcached)
+	case snap == nil || cached.Expires.After(snap.Expires):
+		setSnapshot(cached)
+		snap = cached
+		tier = tierMemcached
+		if snap.isFresh(now) {
+			recordHit(tierMemcached)
+			return &gvlLookup{gvlSnapshot: snap}, nil
+		}
+	}
+	if snap != nil && now.Before(snap.Expires.Add(StaleWhileRevalidate)) {
+		recordStale(tier)
+		refreshGVLInBackground()
+		return &gvlLookup{gvlSnapshot: snap, Stale: true}, nil
+	}
+
+	fresh, err := refreshGVL()
+	if err == nil {
+		return &gvlLookup{gvlSnapshot: fresh}, nil
+	}
+	if snap != nil && now.Before(snap.Expires.Add(StaleIfError)) {
+		recordStale(tier)
+		l4g.Warn("Serving GVL version %d stale because IAB could not be reached: %v", snap.GVL.VendorListVersion, err)
+		return &gvlLookup{gvlSnapshot: snap, Stale: true, RevalidationFailed: true}, nil
+	}
+	if snap != nil {
+		return nil, staleListExpiredError{VendorListVersion: snap.GVL.VendorListVersion, Err: err}
+	}
+	return nil, err
+}
+
+// staleListExpiredError is a failure to refresh the list when the copy at hand is too old to be served stale
+type staleListExpiredError struct {
+	VendorListVersion int
+	Err               error
+}
+
+func (err staleListExpiredError) Error() string {
+	return fmt.Sprintf("GVL version %d is past its stale-if-error window: %v", err.VendorListVersion, err.Err)
+}
+
+func (err staleListExpiredError) Unwrap() error {
+	return err.Err
+}
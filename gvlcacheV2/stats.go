@@ -0,0 +1,143 @@
+package gvlcachev2
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The tiers a list can be served from, in the order they are tried
+const (
+	tierL1        string = "l1"
+	tierMemcached string = "memcached"
+	tierUpstream  string = "upstream"
+)
+
+// tierCounters counts the outcomes of looking a list up in one tier. For the upstream tier a hit is a
+// successful fetch from IAB and an error is a failed one.
+type tierCounters struct {
+	hits   uint64
+	misses uint64
+	stale  uint64
+	errors uint64
+}
+
+var cacheStats = map[string]*tierCounters{
+	tierL1:        {},
+	tierMemcached: {},
+	tierUpstream:  {},
+}
+
+func recordHit(tier string)   { atomic.AddUint64(&cacheStats[tier].hits, 1) }
+func recordMiss(tier string)  { atomic.AddUint64(&cacheStats[tier].misses, 1) }
+func recordStale(tier string) { atomic.AddUint64(&cacheStats[tier].stale, 1) }
+func recordError(tier string) { atomic.AddUint64(&cacheStats[tier].errors, 1) }
+
+// tierStats is the reported value of tierCounters
+type tierStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+	Stale  uint64 `json:"stale"`
+	Errors uint64 `json:"errors"`
+}
+
+func (counters *tierCounters) snapshot() tierStats {
+	return tierStats{
+		Hits:   atomic.LoadUint64(&counters.hits),
+		Misses: atomic.LoadUint64(&counters.misses),
+		Stale:  atomic.LoadUint64(&counters.stale),
+		Errors: atomic.LoadUint64(&counters.errors),
+	}
+}
+
+// cacheReport is the body of /GVLV2/admin/cache
+type cacheReport struct {
+	Tiers             map[string]tierStats `json:"tiers"`
+	VendorListVersion int                  `json:"vendorListVersion,omitempty"`
+	LastUpdated       string               `json:"lastUpdated,omitempty"`
+	StoredAt          *time.Time           `json:"storedAt,omitempty"`
+	AgeSeconds        int                  `json:"ageSeconds"`
+	TTLSeconds        int                  `json:"ttlSeconds"`
+	RawBytes          int                  `json:"rawBytes"`
+	CompressedBytes   int                  `json:"compressedBytes"`
+	Source            gvlSource            `json:"source"`
+}
+
+func buildCacheReport(now time.Time) (cacheReport, error) {
+	report := cacheReport{Tiers: map[string]tierStats{}}
+	for tier, counters := range cacheStats {
+		report.Tiers[tier] = counters.snapshot()
+	}
+
+	snap := currentSnapshot(defaultLanguage)
+	if snap == nil {
+		return report, nil
+	}
+	storedAt := snap.StoredAt
+	report.VendorListVersion = snap.GVL.VendorListVersion
+	report.LastUpdated = snap.GVL.LastUpdated
+	report.StoredAt = &storedAt
+	report.AgeSeconds = int(snap.age(now) / time.Second)
+	if snap.isFresh(now) {
+		report.TTLSeconds = int(snap.Expires.Sub(now) / time.Second)
+	}
+	report.Source = snap.Source
+
+	raw, err := json.Marshal(snap.GVL)
+	if err != nil {
+		return report, err
+	}
+	compressed := &bytes.Buffer{}
+	zw := gzip.NewWriter(compressed)
+	zw.Write(raw)
+	if err := zw.Close(); err != nil {
+		return report, err
+	}
+	report.RawBytes = len(raw)
+	report.CompressedBytes = compressed.Len()
+	return report, nil
+}
+
+// summary is the plain text version of the report for people reading it in a terminal
+func (report cacheReport) summary() string {
+	b := &strings.Builder{}
+	if report.StoredAt == nil {
+		fmt.Fprintln(b, "No vendor list is loaded.")
+	} else {
+		fmt.Fprintf(b, "Vendor list version %d (last updated %s)\n", report.VendorListVersion, report.LastUpdated)
+		fmt.Fprintf(b, "Stored %s ago, %s left before it expires\n",
+			time.Duration(report.AgeSeconds)*time.Second, time.Duration(report.TTLSeconds)*time.Second)
+		fmt.Fprintf(b, "Size: %d bytes raw, %d bytes gzipped\n", report.RawBytes, report.CompressedBytes)
+		fmt.Fprintf(b, "Source: %s (ETag %q, Last-Modified %q)\n", report.Source.URL, report.Source.ETag, report.Source.LastModified)
+	}
+	for _, tier := range []string{tierL1, tierMemcached, tierUpstream} {
+		stats := report.Tiers[tier]
+		fmt.Fprintf(b, "%-10s hits=%d misses=%d stale=%d errors=%d\n", tier, stats.Hits, stats.Misses, stats.Stale, stats.Errors)
+	}
+	return b.String()
+}
+
+// HandleCacheIntrospection reports where responses have been served from and what is in the cache. The report is
+// JSON unless plain text is asked for with ?format=text or an Accept header of text/plain.
+func HandleCacheIntrospection(rw http.ResponseWriter, req *http.Request) {
+	report, err := buildCacheReport(time.Now())
+	if err != nil {
+		writeError(rw, req, cacheBackendDown("There was an error building the cache report."))
+		return
+	}
+
+	if req.URL.Query().Get("format") == "text" || strings.HasPrefix(req.Header.Get("Accept"), "text/plain") {
+		rw.Header().Add("Content-Type", "text/plain; charset=utf-8")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte(report.summary()))
+		return
+	}
+	rw.Header().Add("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(report)
+}
@@ -0,0 +1,58 @@
+package gvlcachev2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func introspect(t *testing.T, target string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	HandleCacheIntrospection(rw, httptest.NewRequest(http.MethodGet, target, nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rw.Code, rw.Body)
+	}
+	return rw
+}
+
+func TestHandleCacheIntrospectionCountsTiers(t *testing.T) {
+	useUpstream(t, func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("ETag", `"v29"`)
+		serveGVL(testGVL(29), 3600)(rw, req)
+	})
+	before := cacheReport{}
+	json.NewDecoder(introspect(t, "/GVLV2/admin/cache").Body).Decode(&before)
+
+	getGVL(t)
+	getGVL(t)
+
+	after := cacheReport{}
+	json.NewDecoder(introspect(t, "/GVLV2/admin/cache").Body).Decode(&after)
+	if got := after.Tiers[tierUpstream].Hits - before.Tiers[tierUpstream].Hits; got != 1 {
+		t.Errorf("upstream hits = %d, want 1", got)
+	}
+	if got := after.Tiers[tierL1].Hits - before.Tiers[tierL1].Hits; got != 1 {
+		t.Errorf("l1 hits = %d, want 1", got)
+	}
+	if after.VendorListVersion != 29 || after.TTLSeconds <= 0 || after.Source.ETag != `"v29"` {
+		t.Errorf("report = %+v", after)
+	}
+	if after.CompressedBytes == 0 || after.RawBytes == 0 {
+		t.Errorf("sizes were not reported: %+v", after)
+	}
+}
+
+func TestHandleCacheIntrospectionPlainSummary(t *testing.T) {
+	useUpstream(t, serveGVL(testGVL(29), 3600))
+	getGVL(t)
+
+	rw := introspect(t, "/GVLV2/admin/cache?format=text")
+	if !strings.HasPrefix(rw.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Content-Type = %q", rw.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rw.Body.String(), "Vendor list version 29") {
+		t.Errorf("summary = %q", rw.Body)
+	}
+}
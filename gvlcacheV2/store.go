@@ -0,0 +1,408 @@
+package gvlcachev2
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ezoic/ezcache"
+	l4g "github.com/ezoic/log4go"
+)
+
+// Every version of the GVL is written once under its own immutable key, built from the specification
+// version, the vendorListVersion and the language of the list. Readers never look at those keys directly,
+// they first read a small "latest" pointer key that names the versioned key to load. The pointer is only
+// switched once the full version has been written and read back, so a reader either sees the old list or
+// the new one and never a half-replaced value.
+const (
+	cacheBucket       string = "middleton"
+	gvlCacheKeyPrefix string = "gvl-version2"
+	defaultLanguage   string = "en"
+	// gvlSpecificationVersion is the version of the GVL specification this package serves
+	gvlSpecificationVersion = 2
+
+	// versionKeyExpiry is memcached's largest relative expiry (30 days). Versioned keys are immutable, so
+	// they are kept for as long as memcached allows and the garbage collector decides when they go away.
+	versionKeyExpiry int32 = 30 * 24 * 60 * 60
+	// retainedVersions is the number of most recent versions kept for each language on top of the one the
+	// latest pointer references.
+	retainedVersions = 10
+)
+
+// cacheBackend is the subset of ezcache the package relies on. It is kept behind an interface so that
+// tests can run without a memcached instance.
+type cacheBackend interface {
+	LoadKeyObject(bucket string, key string, obj interface{}) error
+	ReplaceKeyObject(bucket string, key string, obj interface{}, expiry int32) error
+}
+
+type ezcacheBackend struct{}
+
+func (ezcacheBackend) LoadKeyObject(bucket string, key string, obj interface{}) error {
+	return ezcache.LoadKeyObject(bucket, key, obj)
+}
+
+func (ezcacheBackend) ReplaceKeyObject(bucket string, key string, obj interface{}, expiry int32) error {
+	return ezcache.ReplaceKeyObject(bucket, key, obj, expiry)
+}
+
+var cache cacheBackend = ezcacheBackend{}
+
+var (
+	// promoteMu serializes writers of the latest pointer and the version index within this process.
+	promoteMu sync.Mutex
+	// promotedLanguages holds every language promoted by this process so the garbage collector can visit them
+	promotedLanguages = map[string]bool{defaultLanguage: true}
+)
+
+// gvlVersionEntry is the immutable value stored under a versioned key
+type gvlVersionEntry struct {
+	GVL      GVLVersionTwoValue `json:"gvl"`
+	Checksum string             `json:"checksum"`
+	StoredAt time.Time          `json:"storedAt"`
+}
+
+// gvlLatestPointer names the versioned key that holds the latest list for a language. The pointer outlives
+// Expires by the stale windows so that the list can still be served while it is being refreshed.
+type gvlLatestPointer struct {
+	Key               string    `json:"key"`
+	VendorListVersion int       `json:"vendorListVersion"`
+	Checksum          string    `json:"checksum"`
+	PromotedAt        time.Time `json:"promotedAt"`
+	Expires           time.Time `json:"expires"`
+	Source            gvlSource `json:"source"`
+}
+
+// gvlVersionIndex lists every versioned key written for a language so they can be garbage-collected
+type gvlVersionIndex struct {
+	Versions []gvlIndexedVersion `json:"versions"`
+}
+
+type gvlIndexedVersion struct {
+	Key               string    `json:"key"`
+	VendorListVersion int       `json:"vendorListVersion"`
+	StoredAt          time.Time `json:"storedAt"`
+}
+
+func gvlVersionKey(specVersion int, vendorListVersion int, language string) string {
+	return fmt.Sprintf("%s-spec%d-v%d-%s", gvlCacheKeyPrefix, specVersion, vendorListVersion, language)
+}
+
+func gvlLatestKey(language string) string {
+	return fmt.Sprintf("%s-latest-%s", gvlCacheKeyPrefix, language)
+}
+
+func gvlIndexKey(language string) string {
+	return fmt.Sprintf("%s-index-%s", gvlCacheKeyPrefix, language)
+}
+
+func checksumOf(gvl *GVLVersionTwoValue) (string, error) {
+	b, err := json.Marshal(gvl)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// storeVersion writes the list under its versioned key and reads it back to make sure the full value made it
+// into the cache: the checksum is computed again over the list that was read. It returns the key and the checksum
+// of the stored list.
+func storeVersion(gvl *GVLVersionTwoValue, language string) (string, string, error) {
+	key := gvlVersionKey(gvl.GVLSpecificationVersion, gvl.VendorListVersion, language)
+	checksum, err := checksumOf(gvl)
+	if err != nil {
+		return "", "", err
+	}
+	entry := gvlVersionEntry{GVL: *gvl, Checksum: checksum, StoredAt: time.Now().UTC()}
+	if err := cache.ReplaceKeyObject(cacheBucket, key, entry, versionKeyExpiry); err != nil {
+		return "", "", err
+	}
+
+	stored, err := loadVersionEntry(key)
+	if err != nil {
+		return "", "", fmt.Errorf("could not read back %s: %v", key, err)
+	}
+	if readBack, err := checksumOf(&stored.GVL); err != nil || stored.Checksum != checksum || readBack != checksum {
+		return "", "", fmt.Errorf("read back of %s does not match what was written", key)
+	}
+	return key, checksum, nil
+}
+
+// promoteVersion stores the list under its versioned key and then switches the latest pointer of the language
+// to it. The list is fresh until expires, and the pointer is kept in the cache for the stale windows after that.
+func promoteVersion(gvl *GVLVersionTwoValue, language string, expires time.Time, source gvlSource) (*gvlSnapshot, error) {
+	promoteMu.Lock()
+	defer promoteMu.Unlock()
+
+	key, checksum, err := storeVersion(gvl, language)
+	if err != nil {
+		return nil, err
+	}
+	pointer := gvlLatestPointer{
+		Key:               key,
+		VendorListVersion: gvl.VendorListVersion,
+		Checksum:          checksum,
+		PromotedAt:        time.Now().UTC(),
+		Expires:           expires,
+		Source:            source,
+	}
+	if err := cache.ReplaceKeyObject(cacheBucket, gvlLatestKey(language), pointer, pointerExpiry(pointer)); err != nil {
+		return nil, err
+	}
+
+	indexVersion(key, gvl.VendorListVersion, language, pointer.PromotedAt)
+	promotedLanguages[language] = true
+	l4g.Info("Promoted %s as the latest GVL for language %s", key, language)
+	return &gvlSnapshot{GVL: gvl, Language: language, StoredAt: pointer.PromotedAt, Expires: pointer.Expires, Source: source}, nil
+}
+
+// archiveVersion stores a past version of the list under its versioned key without touching the latest pointer
+func archiveVersion(gvl *GVLVersionTwoValue, language string) error {
+	promoteMu.Lock()
+	defer promoteMu.Unlock()
+
+	key, _, err := storeVersion(gvl, language)
+	if err != nil {
+		return err
+	}
+	indexVersion(key, gvl.VendorListVersion, language, time.Now().UTC())
+	return nil
+}
+
+// indexVersion adds a versioned key to the index of its language. promoteMu must be held. The index only drives
+// garbage collection, so failing to update it is logged rather than returned.
+//
+// The update is a read-modify-write, and memcached is only reached through loads and replaces, so there is one
+// writer per index: promoteMu covers this process only. When two instances store versions at once one of them
+// can be left out of the index; it is then not collected and expires after versionKeyExpiry like any other
+// versioned key.
+func indexVersion(key string, vendorListVersion int, language string, storedAt time.Time) {
+	index := gvlVersionIndex{}
+	cache.LoadKeyObject(cacheBucket, gvlIndexKey(language), &index)
+	if index.contains(key) {
+		return
+	}
+	index.Versions = append(index.Versions, gvlIndexedVersion{Key: key, VendorListVersion: vendorListVersion, StoredAt: storedAt})
+	if err := cache.ReplaceKeyObject(cacheBucket, gvlIndexKey(language), index, versionKeyExpiry); err != nil {
+		l4g.Warn("Could not update the GVL version index: %v", err)
+	}
+}
+
+// pointerExpiry is the number of seconds memcached should keep the pointer for: until the list expires and
+// then for as long as either stale window allows it to be served.
+func pointerExpiry(pointer gvlLatestPointer) int32 {
+	staleWindow := StaleWhileRevalidate
+	if StaleIfError > staleWindow {
+		staleWindow = StaleIfError
+	}
+	seconds := int64(time.Until(pointer.Expires.Add(staleWindow)) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	if seconds > int64(versionKeyExpiry) {
+		return versionKeyExpiry
+	}
+	return int32(seconds)
+}
+
+func loadVersionEntry(key string) (*gvlVersionEntry, error) {
+	entry := gvlVersionEntry{}
+	if err := cache.LoadKeyObject(cacheBucket, key, &entry); err != nil {
+		return nil, err
+	}
+	// Garbage-collected keys hold an empty value until memcached drops them
+	if entry.Checksum == "" {
+		return nil, fmt.Errorf("%s is not in the cache", key)
+	}
+	return &entry, nil
+}
+
+// loadLatestVersion follows the latest pointer of the language to the versioned key it references
+func loadLatestVersion(language string) (*gvlSnapshot, error) {
+	pointer := gvlLatestPointer{}
+	if err := cache.LoadKeyObject(cacheBucket, gvlLatestKey(language), &pointer); err != nil {
+		return nil, err
+	}
+	if pointer.Key == "" {
+		return nil, fmt.Errorf("there is no latest version for language %s", language)
+	}
+	entry, err := loadVersionEntry(pointer.Key)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Checksum != pointer.Checksum {
+		return nil, fmt.Errorf("%s does not hold the version the latest pointer references", pointer.Key)
+	}
+	return &gvlSnapshot{GVL: &entry.GVL, Language: language, StoredAt: pointer.PromotedAt, Expires: pointer.Expires, Source: pointer.Source}, nil
+}
+
+// loadVersion returns a version of the list that was previously stored in the cache
+func loadVersion(specVersion int, vendorListVersion int, language string) (*GVLVersionTwoValue, error) {
+	entry, err := loadVersionEntry(gvlVersionKey(specVersion, vendorListVersion, language))
+	if err != nil {
+		return nil, err
+	}
+	return &entry.GVL, nil
+}
+
+func (index *gvlVersionIndex) keys() []string {
+	keys := []string{}
+	for _, v := range index.Versions {
+		keys = append(keys, v.Key)
+	}
+	return keys
+}
+
+func (index *gvlVersionIndex) contains(key string) bool {
+	for _, v := range index.Versions {
+		if v.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// collectGarbage expires the versioned keys of a language that are neither referenced by the latest pointer
+// nor among the retainedVersions most recent versions. It returns the keys that were removed.
+func collectGarbage(language string) ([]string, error) {
+	promoteMu.Lock()
+	defer promoteMu.Unlock()
+
+	index := gvlVersionIndex{}
+	if err := cache.LoadKeyObject(cacheBucket, gvlIndexKey(language), &index); err != nil {
+		// Nothing was ever promoted for this language
+		return nil, nil
+	}
+	pointer := gvlLatestPointer{}
+	cache.LoadKeyObject(cacheBucket, gvlLatestKey(language), &pointer)
+
+	sort.Slice(index.Versions, func(i, j int) bool {
+		return index.Versions[i].VendorListVersion > index.Versions[j].VendorListVersion
+	})
+	kept := gvlVersionIndex{}
+	removed := []string{}
+	for i, v := range index.Versions {
+		if v.Key == pointer.Key || i < retainedVersions {
+			kept.Versions = append(kept.Versions, v)
+			continue
+		}
+		if err := expireKey(v.Key); err != nil {
+			kept.Versions = append(kept.Versions, v)
+			continue
+		}
+		removed = append(removed, v.Key)
+	}
+	if len(removed) == 0 {
+		return removed, nil
+	}
+	if err := cache.ReplaceKeyObject(cacheBucket, gvlIndexKey(language), kept, versionKeyExpiry); err != nil {
+		return removed, err
+	}
+	return removed, nil
+}
+
+// expireKey removes a key from the cache. ezcache has no delete, so the key is replaced with an empty value
+// that memcached expires right away.
+func expireKey(key string) error {
+	return cache.ReplaceKeyObject(cacheBucket, key, nil, 1)
+}
+
+// invalidateLanguage expires the latest pointer and every versioned key of a language. It returns the keys
+// that were removed.
+func invalidateLanguage(language string) ([]string, error) {
+	promoteMu.Lock()
+	defer promoteMu.Unlock()
+
+	index := gvlVersionIndex{}
+	cache.LoadKeyObject(cacheBucket, gvlIndexKey(language), &index)
+	removed := []string{}
+	for _, key := range append([]string{gvlLatestKey(language), gvlIndexKey(language)}, index.keys()...) {
+		if err := expireKey(key); err != nil {
+			return removed, err
+		}
+		removed = append(removed, key)
+	}
+	return removed, nil
+}
+
+// invalidateVersion expires one versioned key of a language, along with the latest pointer when it references
+// that version. It returns the keys that were removed.
+func invalidateVersion(specVersion int, vendorListVersion int, language string) ([]string, error) {
+	promoteMu.Lock()
+	defer promoteMu.Unlock()
+
+	key := gvlVersionKey(specVersion, vendorListVersion, language)
+	removed := []string{}
+	pointer := gvlLatestPointer{}
+	cache.LoadKeyObject(cacheBucket, gvlLatestKey(language), &pointer)
+	if pointer.Key == key {
+		if err := expireKey(gvlLatestKey(language)); err != nil {
+			return removed, err
+		}
+		removed = append(removed, gvlLatestKey(language))
+	}
+	if err := expireKey(key); err != nil {
+		return removed, err
+	}
+	removed = append(removed, key)
+
+	index := gvlVersionIndex{}
+	if err := cache.LoadKeyObject(cacheBucket, gvlIndexKey(language), &index); err == nil && index.contains(key) {
+		kept := gvlVersionIndex{}
+		for _, v := range index.Versions {
+			if v.Key != key {
+				kept.Versions = append(kept.Versions, v)
+			}
+		}
+		if err := cache.ReplaceKeyObject(cacheBucket, gvlIndexKey(language), kept, versionKeyExpiry); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+func languagesToCollect() []string {
+	promoteMu.Lock()
+	defer promoteMu.Unlock()
+	languages := []string{}
+	for language := range promotedLanguages {
+		languages = append(languages, language)
+	}
+	return languages
+}
+
+// StartVersionGC garbage-collects unreferenced versions of the GVL every interval until the returned function
+// is called.
+func StartVersionGC(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				for _, language := range languagesToCollect() {
+					removed, err := collectGarbage(language)
+					if err != nil {
+						l4g.Warn("GVL version garbage collection failed for %s: %v", language, err)
+					}
+					if len(removed) > 0 {
+						l4g.Info("Garbage-collected GVL versions %v", removed)
+					}
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
@@ -0,0 +1,167 @@
+package gvlcachev2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryCache is an in-process cacheBackend that stores values the way ezcache does, as encoded bytes
+type memoryCache struct {
+	mu    sync.Mutex
+	items map[string][]byte
+}
+
+func useMemoryCache(t *testing.T) *memoryCache {
+	m := &memoryCache{items: map[string][]byte{}}
+	previous := cache
+	cache = m
+	deltaMu.Lock()
+	deltaCache = map[string]*gvlDelta{}
+	deltaMu.Unlock()
+	dropArchivedVersions(0)
+	t.Cleanup(func() { cache = previous })
+	return m
+}
+
+func (m *memoryCache) LoadKeyObject(bucket string, key string, obj interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.items[bucket+"/"+key]
+	if !ok {
+		return errors.New("memcache: cache miss")
+	}
+	return json.Unmarshal(b, obj)
+}
+
+func (m *memoryCache) ReplaceKeyObject(bucket string, key string, obj interface{}, expiry int32) error {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.items[bucket+"/"+key] = b
+	return nil
+}
+
+func testGVL(vendorListVersion int) *GVLVersionTwoValue {
+	return &GVLVersionTwoValue{
+		GVLSpecificationVersion: 2,
+		VendorListVersion:       vendorListVersion,
+		TCFPolicyVersion:        2,
+		LastUpdated:             "2020-03-12T16:05:14Z",
+		Purposes: map[int]GVLVersionTwoPurpose{
+			1: {ID: 1, Name: "Store and/or access information on a device"},
+			2: {ID: 2, Name: "Select basic ads"},
+		},
+		Vendors: map[int]GVLVersionTwoVendor{
+			8: {ID: 8, Name: "Emerse Sverige AB", Purposes: []int{1}, LegIntPurposes: []int{2}},
+		},
+	}
+}
+
+func TestPromoteVersionSwitchesLatestPointer(t *testing.T) {
+	useMemoryCache(t)
+
+	for _, version := range []int{28, 29} {
+		if _, err := promoteVersion(testGVL(version), defaultLanguage, time.Now().Add(time.Minute), gvlSource{}); err != nil {
+			t.Fatalf("promoting version %d: %v", version, err)
+		}
+	}
+
+	latest, err := loadLatestVersion(defaultLanguage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.GVL.VendorListVersion != 29 {
+		t.Errorf("latest version = %d, want 29", latest.GVL.VendorListVersion)
+	}
+	archived, err := loadVersion(2, 28, defaultLanguage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archived.VendorListVersion != 28 {
+		t.Errorf("archived version = %d, want 28", archived.VendorListVersion)
+	}
+}
+
+// truncatingCache stores versioned lists without their vendors, keeping the checksum they were written with
+type truncatingCache struct {
+	*memoryCache
+}
+
+func (c truncatingCache) ReplaceKeyObject(bucket string, key string, obj interface{}, expiry int32) error {
+	if entry, ok := obj.(gvlVersionEntry); ok {
+		entry.GVL.Vendors = nil
+		obj = entry
+	}
+	return c.memoryCache.ReplaceKeyObject(bucket, key, obj, expiry)
+}
+
+func TestPromoteVersionChecksWhatWasStored(t *testing.T) {
+	m := useMemoryCache(t)
+	cache = truncatingCache{m}
+
+	if _, err := promoteVersion(testGVL(29), defaultLanguage, time.Now().Add(time.Minute), gvlSource{}); err == nil {
+		t.Fatal("a truncated list was promoted")
+	}
+	if _, err := loadLatestVersion(defaultLanguage); err == nil {
+		t.Error("the latest pointer was moved to the truncated list")
+	}
+}
+
+func TestLoadLatestVersionRejectsMismatchedVersion(t *testing.T) {
+	m := useMemoryCache(t)
+	if _, err := promoteVersion(testGVL(29), defaultLanguage, time.Now().Add(time.Minute), gvlSource{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwrite the versioned key behind the pointer's back
+	tampered := testGVL(29)
+	tampered.LastUpdated = "2020-03-19T16:05:14Z"
+	checksum, _ := checksumOf(tampered)
+	m.ReplaceKeyObject(cacheBucket, gvlVersionKey(2, 29, defaultLanguage), gvlVersionEntry{GVL: *tampered, Checksum: checksum}, 0)
+
+	if _, err := loadLatestVersion(defaultLanguage); err == nil {
+		t.Error("expected the mismatched version to be rejected")
+	}
+}
+
+func TestCollectGarbageKeepsReferencedAndRecentVersions(t *testing.T) {
+	useMemoryCache(t)
+	total := retainedVersions + 3
+	for version := 1; version <= total; version++ {
+		if _, err := promoteVersion(testGVL(version), defaultLanguage, time.Now().Add(time.Minute), gvlSource{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := collectGarbage(defaultLanguage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 3 {
+		t.Fatalf("removed %v, want the 3 oldest versions", removed)
+	}
+	for version := 1; version <= total; version++ {
+		_, err := loadVersion(2, version, defaultLanguage)
+		if collected := version <= 3; collected != (err != nil) {
+			t.Errorf("version %d: collected=%v, load error=%v", version, collected, err)
+		}
+	}
+	if _, err := loadLatestVersion(defaultLanguage); err != nil {
+		t.Errorf("latest version was collected: %v", err)
+	}
+}
+
+func TestVersionKeysIncludeSpecVersionAndLanguage(t *testing.T) {
+	got := gvlVersionKey(2, 29, "fr")
+	want := fmt.Sprintf("%s-spec2-v29-fr", gvlCacheKeyPrefix)
+	if got != want {
+		t.Errorf("gvlVersionKey = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,195 @@
+package gvlcachev2
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxCachedSubsets bounds the number of encoded subsets kept in memory. The cache is simply emptied when it
+// fills up, since the handful of vendor sets our publishers use are rebuilt on the next request anyway.
+const maxCachedSubsets = 512
+
+// subsetRequest is a request for the part of the list that concerns a set of vendors. Unless KeepAll is set
+// only the purposes, features and stacks those vendors reference are kept.
+type subsetRequest struct {
+	VendorIDs []int `json:"vendorIds"`
+	KeepAll   bool  `json:"keepAll"`
+}
+
+var (
+	subsetMu    sync.Mutex
+	subsetCache = map[string][]byte{}
+)
+
+func parseVendorIDs(raw string) ([]int, error) {
+	ids := []int{}
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, err := strconv.Atoi(field)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("%q is not a vendor id", field)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("vendorIds names no vendors")
+	}
+	return ids, nil
+}
+
+// parseSubsetRequest reads the vendorIds filter from the query string, or for a POST from the form or JSON
+// body. It returns nil when the whole list is asked for.
+func parseSubsetRequest(req *http.Request) (*subsetRequest, error) {
+	if req.Method == http.MethodPost {
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if mediaType == "application/json" {
+			subset := subsetRequest{}
+			if err := json.NewDecoder(req.Body).Decode(&subset); err != nil {
+				return nil, errors.New("the request body is not valid JSON")
+			}
+			if len(subset.VendorIDs) == 0 {
+				return nil, errors.New("vendorIds names no vendors")
+			}
+			for _, id := range subset.VendorIDs {
+				if id <= 0 {
+					return nil, fmt.Errorf("%q is not a vendor id", strconv.Itoa(id))
+				}
+			}
+			return &subset, nil
+		}
+		if err := req.ParseForm(); err != nil {
+			return nil, err
+		}
+	}
+
+	raw := req.FormValue("vendorIds")
+	if raw == "" {
+		if req.Method == http.MethodPost {
+			return nil, errors.New("vendorIds names no vendors")
+		}
+		return nil, nil
+	}
+	ids, err := parseVendorIDs(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &subsetRequest{VendorIDs: ids, KeepAll: req.FormValue("keepAll") == "true"}, nil
+}
+
+// key identifies a subset of a version of the list, whatever order the vendor ids were given in
+func (subset *subsetRequest) key(gvl *GVLVersionTwoValue) string {
+	ids := append([]int{}, subset.VendorIDs...)
+	sort.Ints(ids)
+	h := sha256.New()
+	fmt.Fprintf(h, "%v|%t", ids, subset.KeepAll)
+	return fmt.Sprintf("%s-subset-spec%d-v%d-%s", gvlCacheKeyPrefix, gvl.GVLSpecificationVersion,
+		gvl.VendorListVersion, hex.EncodeToString(h.Sum(nil)[:8]))
+}
+
+// encodedSubset returns the JSON encoding of the subset, building it the first time it is asked for
+func encodedSubset(gvl *GVLVersionTwoValue, subset *subsetRequest) ([]byte, error) {
+	key := subset.key(gvl)
+	subsetMu.Lock()
+	body, ok := subsetCache[key]
+	subsetMu.Unlock()
+	if ok {
+		return body, nil
+	}
+
+	b := &bytes.Buffer{}
+	if err := json.NewEncoder(b).Encode(gvl.subset(subset.VendorIDs, subset.KeepAll)); err != nil {
+		return nil, err
+	}
+	subsetMu.Lock()
+	if len(subsetCache) >= maxCachedSubsets {
+		subsetCache = map[string][]byte{}
+	}
+	subsetCache[key] = b.Bytes()
+	subsetMu.Unlock()
+	return b.Bytes(), nil
+}
+
+// subset returns a valid list holding only the given vendors. Unless keepAll is set, the purposes, special
+// purposes, features and special features are cut down to the ones those vendors declare, and the stacks to
+// the ones made only of what is left.
+func (gvl *GVLVersionTwoValue) subset(vendorIDs []int, keepAll bool) *GVLVersionTwoValue {
+	out := *gvl
+	out.Vendors = map[int]GVLVersionTwoVendor{}
+	purposes, specialPurposes, features, specialFeatures := map[int]bool{}, map[int]bool{}, map[int]bool{}, map[int]bool{}
+	for _, id := range vendorIDs {
+		vendor, ok := gvl.Vendors[id]
+		if !ok {
+			continue
+		}
+		out.Vendors[id] = vendor
+		markAll(purposes, vendor.Purposes, vendor.LegIntPurposes, vendor.FlexiblePurposes)
+		markAll(specialPurposes, vendor.SpecialPurposes)
+		markAll(features, vendor.Features)
+		markAll(specialFeatures, vendor.SpecialFeatures)
+	}
+	if keepAll {
+		return &out
+	}
+
+	out.Purposes = map[int]GVLVersionTwoPurpose{}
+	for id, purpose := range gvl.Purposes {
+		if purposes[id] {
+			out.Purposes[id] = purpose
+		}
+	}
+	out.SpecialPurposes = map[int]GVLVersionTwoSpecialPurpose{}
+	for id, purpose := range gvl.SpecialPurposes {
+		if specialPurposes[id] {
+			out.SpecialPurposes[id] = purpose
+		}
+	}
+	out.Features = map[int]GVLVersionTwoFeature{}
+	for id, feature := range gvl.Features {
+		if features[id] {
+			out.Features[id] = feature
+		}
+	}
+	out.SpecialFeatures = map[int]GVLVersionTwoSpecialFeature{}
+	for id, feature := range gvl.SpecialFeatures {
+		if specialFeatures[id] {
+			out.SpecialFeatures[id] = feature
+		}
+	}
+	out.Stacks = map[int]GVLVersionTwoStack{}
+	for id, stack := range gvl.Stacks {
+		if allMarked(purposes, stack.Purposes) && allMarked(specialFeatures, stack.SpecialFeatures) {
+			out.Stacks[id] = stack
+		}
+	}
+	return &out
+}
+
+func markAll(marked map[int]bool, lists ...[]int) {
+	for _, list := range lists {
+		for _, id := range list {
+			marked[id] = true
+		}
+	}
+}
+
+func allMarked(marked map[int]bool, ids []int) bool {
+	for _, id := range ids {
+		if !marked[id] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package gvlcachev2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// subsetTestGVL has two vendors that share purpose 1 and otherwise declare different things
+func subsetTestGVL() *GVLVersionTwoValue {
+	gvl := testGVL(29)
+	gvl.Purposes[3] = GVLVersionTwoPurpose{ID: 3, Name: "Create a personalised ads profile"}
+	gvl.SpecialFeatures = map[int]GVLVersionTwoSpecialFeature{1: {ID: 1}, 2: {ID: 2}}
+	gvl.Stacks = map[int]GVLVersionTwoStack{
+		1: {ID: 1, Purposes: []int{1, 2}},
+		2: {ID: 2, Purposes: []int{1, 3}},
+		3: {ID: 3, Purposes: []int{1}, SpecialFeatures: []int{2}},
+	}
+	gvl.Vendors[744] = GVLVersionTwoVendor{ID: 744, Name: "Vidazoo Ltd", Purposes: []int{1, 3}, SpecialFeatures: []int{2}}
+	return gvl
+}
+
+func TestSubsetKeepsOnlyReferencedDeclarations(t *testing.T) {
+	subset := subsetTestGVL().subset([]int{8, 999}, false)
+
+	if len(subset.Vendors) != 1 || subset.Vendors[8].ID != 8 {
+		t.Errorf("vendors = %v, want only vendor 8", subset.Vendors)
+	}
+	if len(subset.Purposes) != 2 || subset.Purposes[3].ID != 0 {
+		t.Errorf("purposes = %v, want 1 and 2", subset.Purposes)
+	}
+	if len(subset.SpecialFeatures) != 0 {
+		t.Errorf("special features = %v, want none", subset.SpecialFeatures)
+	}
+	if len(subset.Stacks) != 1 || subset.Stacks[1].ID != 1 {
+		t.Errorf("stacks = %v, want only stack 1", subset.Stacks)
+	}
+
+	all := subsetTestGVL().subset([]int{8}, true)
+	if len(all.Purposes) != 3 || len(all.Stacks) != 3 {
+		t.Errorf("keepAll dropped declarations: %d purposes, %d stacks", len(all.Purposes), len(all.Stacks))
+	}
+}
+
+func TestHandleRequestForGVLVersion2VendorSubset(t *testing.T) {
+	useUpstream(t, serveGVL(subsetTestGVL(), 3600))
+	full := getGVL(t)
+
+	rw := httptest.NewRecorder()
+	HandleRequestForGVLVersion2(rw, httptest.NewRequest(http.MethodGet, "/GVLV2?vendorIds=744", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rw.Code, rw.Body)
+	}
+	if rw.Header().Get("ETag") == full.Header().Get("ETag") {
+		t.Error("the subset has the same ETag as the full list")
+	}
+	body := rw.Body.String()
+	got := GVLVersionTwoValue{}
+	json.NewDecoder(rw.Body).Decode(&got)
+	if len(got.Vendors) != 1 || got.VendorListVersion != 29 {
+		t.Errorf("subset = %+v", got)
+	}
+
+	// The same subset POSTed as a form is the same body, but shared caches can't tell POSTs apart
+	form := url.Values{"vendorIds": {"744"}}
+	req := httptest.NewRequest(http.MethodPost, "/GVLV2", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	posted := httptest.NewRecorder()
+	HandleRequestForGVLVersion2(posted, req)
+	if posted.Body.String() != body {
+		t.Errorf("POST body differs from the GET body")
+	}
+	if posted.Header().Get("Cache-Control") != "no-store" || posted.Header().Get("ETag") != "" {
+		t.Errorf("POST headers = %v", posted.Header())
+	}
+}
+
+func TestHandleRequestForGVLVersion2RejectsBadVendorIds(t *testing.T) {
+	useUpstream(t, serveGVL(subsetTestGVL(), 3600))
+	for _, target := range []string{"/GVLV2?vendorIds=1,x", "/GVLV2?vendorIds=-4", "/GVLV2?vendorIds=,"} {
+		rw := httptest.NewRecorder()
+		HandleRequestForGVLVersion2(rw, httptest.NewRequest(http.MethodGet, target, nil))
+		if rw.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", target, rw.Code)
+		}
+	}
+	for _, body := range []string{`{"vendorIds":[0,-3]}`, `{"vendorIds":[744,0]}`, `{"vendorIds":[]}`} {
+		req := httptest.NewRequest(http.MethodPost, "/GVLV2", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rw := httptest.NewRecorder()
+		HandleRequestForGVLVersion2(rw, req)
+		if detail := decodeError(t, rw); rw.Code != http.StatusBadRequest || detail.Code != CodeValidationFailed {
+			t.Errorf("%s: status = %d, error = %+v", body, rw.Code, detail)
+		}
+	}
+}
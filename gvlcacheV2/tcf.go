@@ -0,0 +1,100 @@
+package gvlcachev2
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ezoic/gvlcache/tcstring"
+)
+
+// TCStringValidationError lists every id of a TC string that the version of the vendor list it names doesn't
+// declare
+type TCStringValidationError struct {
+	VendorListVersion int
+	Problems          []string
+}
+
+func (err *TCStringValidationError) Error() string {
+	return fmt.Sprintf("the TC string does not match vendor list version %d: %s", err.VendorListVersion, strings.Join(err.Problems, "; "))
+}
+
+// ValidateTCString checks that the purposes, special features and vendors of a TC string exist in gvl, which has
+// to be the version of the list the string names. Deleted vendors can't be given consent or legitimate interest, or
+// be disclosed to the user.
+func ValidateTCString(tc *tcstring.TCString, gvl *GVLVersionTwoValue) error {
+	problems := []string{}
+	if tc.VendorListVersion != gvl.VendorListVersion {
+		problems = append(problems, fmt.Sprintf("the string names vendor list version %d", tc.VendorListVersion))
+	}
+	for _, purposes := range []struct {
+		field string
+		ids   tcstring.IDs
+	}{{"purposesConsent", tc.PurposesConsent}, {"purposesLITransparency", tc.PurposesLITransparency}} {
+		for _, id := range purposes.ids {
+			if _, ok := gvl.Purposes[id]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: purpose %d does not exist", purposes.field, id))
+			}
+		}
+	}
+	for _, id := range tc.SpecialFeatureOptIns {
+		if _, ok := gvl.SpecialFeatures[id]; !ok {
+			problems = append(problems, fmt.Sprintf("specialFeatureOptIns: special feature %d does not exist", id))
+		}
+	}
+	checkVendors := func(field string, ids tcstring.IDs, deletedAllowed bool) {
+		problems = append(problems, vendorProblems(field, ids, gvl, deletedAllowed)...)
+	}
+	checkVendors("vendorConsents", tc.VendorConsents, false)
+	checkVendors("vendorLegitimateInterests", tc.VendorLegitimateInterests, false)
+	for i, restriction := range tc.PublisherRestrictions {
+		field := fmt.Sprintf("pubRestrictions[%d]", i)
+		if _, ok := gvl.Purposes[restriction.PurposeID]; !ok {
+			problems = append(problems, fmt.Sprintf("%s: purpose %d does not exist", field, restriction.PurposeID))
+		}
+		// Restricting a vendor that was deleted since is harmless
+		checkVendors(field, restriction.Vendors, true)
+	}
+	checkVendors("disclosedVendors", tc.DisclosedVendors, false)
+	// So is allowing one
+	checkVendors("allowedVendors", tc.AllowedVendors, true)
+	if publisher := tc.PublisherTC; publisher != nil {
+		for _, purposes := range []struct {
+			field string
+			ids   tcstring.IDs
+		}{{"pubPurposesConsent", publisher.PurposesConsent}, {"pubPurposesLITransparency", publisher.PurposesLITransparency}} {
+			for _, id := range purposes.ids {
+				if _, ok := gvl.Purposes[id]; !ok {
+					problems = append(problems, fmt.Sprintf("%s: purpose %d does not exist", purposes.field, id))
+				}
+			}
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return &TCStringValidationError{VendorListVersion: gvl.VendorListVersion, Problems: problems}
+}
+
+// vendorProblems lists the ids of a vendor field that gvl does not have, or has deleted unless deletedAllowed
+func vendorProblems(field string, ids tcstring.IDs, gvl *GVLVersionTwoValue, deletedAllowed bool) []string {
+	problems := []string{}
+	for _, id := range ids {
+		vendor, ok := gvl.Vendors[id]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s: vendor %d does not exist", field, id))
+		case vendor.DeletedDate != "" && !deletedAllowed:
+			problems = append(problems, fmt.Sprintf("%s: vendor %d was deleted on %s", field, id, vendor.DeletedDate))
+		}
+	}
+	return problems
+}
+
+// EncodeTCString writes a TC string after checking its ids against the version of the vendor list it names
+func EncodeTCString(tc *tcstring.TCString, gvl *GVLVersionTwoValue) (string, error) {
+	if err := ValidateTCString(tc, gvl); err != nil {
+		return "", err
+	}
+	return tcstring.Encode(tc)
+}
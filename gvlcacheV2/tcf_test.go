@@ -0,0 +1,73 @@
+package gvlcachev2
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ezoic/gvlcache/tcstring"
+)
+
+func tcfTestString() *tcstring.TCString {
+	return &tcstring.TCString{
+		Version:                   tcstring.Version,
+		Created:                   time.Date(2020, 3, 20, 12, 0, 0, 0, time.UTC),
+		LastUpdated:               time.Date(2020, 3, 20, 12, 0, 0, 0, time.UTC),
+		ConsentLanguage:           "EN",
+		PublisherCC:               "GB",
+		VendorListVersion:         29,
+		TCFPolicyVersion:          2,
+		PurposesConsent:           tcstring.IDs{1, 3},
+		PurposesLITransparency:    tcstring.IDs{2},
+		SpecialFeatureOptIns:      tcstring.IDs{2},
+		VendorConsents:            tcstring.IDs{8, 744},
+		VendorLegitimateInterests: tcstring.IDs{8},
+		PublisherRestrictions:     []tcstring.PublisherRestriction{},
+	}
+}
+
+func TestEncodeTCStringChecksIdsAgainstTheList(t *testing.T) {
+	gvl := subsetTestGVL()
+	encoded, err := EncodeTCString(tcfTestString(), gvl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, err := tcstring.Decode(encoded); err != nil || !decoded.VendorConsents.Has(744) {
+		t.Errorf("decoded %+v, %v", decoded, err)
+	}
+
+	deleted := gvl.Vendors[744]
+	deleted.DeletedDate = "2020-03-01T00:00:00Z"
+	gvl.Vendors[744] = deleted
+	tc := tcfTestString()
+	tc.VendorListVersion = 28
+	tc.PurposesConsent = append(tc.PurposesConsent, 10)
+	tc.VendorLegitimateInterests = append(tc.VendorLegitimateInterests, 999)
+	tc.PublisherRestrictions = []tcstring.PublisherRestriction{{PurposeID: 1, Vendors: tcstring.IDs{744}}}
+	tc.DisclosedVendors = tcstring.IDs{8, 744, 1000}
+	tc.AllowedVendors = tcstring.IDs{744}
+	tc.PublisherTC = &tcstring.PublisherTC{PurposesConsent: tcstring.IDs{1, 11}}
+	_, err = EncodeTCString(tc, gvl)
+	validationErr := &TCStringValidationError{}
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("err = %v", err)
+	}
+	want := []string{
+		"vendor list version 28",
+		"purposesConsent: purpose 10",
+		"vendorConsents: vendor 744 was deleted",
+		"vendorLegitimateInterests: vendor 999 does not exist",
+		"disclosedVendors: vendor 744 was deleted",
+		"disclosedVendors: vendor 1000 does not exist",
+		"pubPurposesConsent: purpose 11",
+	}
+	if len(validationErr.Problems) != len(want) {
+		t.Fatalf("problems = %q", validationErr.Problems)
+	}
+	for i, problem := range validationErr.Problems {
+		if !strings.Contains(problem, want[i]) {
+			t.Errorf("problem %d = %q, want it to mention %q", i, problem, want[i])
+		}
+	}
+}
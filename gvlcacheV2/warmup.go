@@ -0,0 +1,144 @@
+package gvlcachev2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	l4g "github.com/ezoic/log4go"
+)
+
+// SnapshotDir is the directory the L1 snapshot is written to whenever a new list is accepted, so that a restarted
+// instance can serve it before memcached or IAB answer. Nothing is written when it is empty.
+var SnapshotDir string
+
+func snapshotPath(language string) string {
+	return filepath.Join(SnapshotDir, fmt.Sprintf("%s-%s.json", gvlCacheKeyPrefix, language))
+}
+
+// persistSnapshot writes the snapshot to a temporary file first and renames it into place, so a crash never
+// leaves a half-written snapshot behind
+func persistSnapshot(snap *gvlSnapshot) error {
+	if SnapshotDir == "" {
+		return nil
+	}
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(SnapshotDir, "snapshot-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), snapshotPath(snap.Language))
+}
+
+func removePersistedSnapshot(language string) error {
+	if SnapshotDir == "" {
+		return nil
+	}
+	err := os.Remove(snapshotPath(language))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func loadPersistedSnapshot(language string) (*gvlSnapshot, error) {
+	if SnapshotDir == "" {
+		return nil, errors.New("no snapshot directory is configured")
+	}
+	b, err := ioutil.ReadFile(snapshotPath(language))
+	if err != nil {
+		return nil, err
+	}
+	snap := gvlSnapshot{}
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return nil, err
+	}
+	if snap.GVL == nil || snap.GVL.isMalformed() {
+		return nil, fmt.Errorf("%s does not hold a valid vendor list", snapshotPath(language))
+	}
+	snap.Language = language
+	return &snap, nil
+}
+
+// Warmup fills the L1 snapshot before the instance takes traffic. It tries the snapshot on disk, then memcached,
+// then IAB, and stops at the first source with a fresh list. When only expired lists are found within the
+// deadline of ctx, the most recent of them is used so that it can be served stale.
+func Warmup(ctx context.Context) error {
+	defer atomic.StoreInt32(&warmedUp, 1)
+	sources := []struct {
+		name string
+		load func() (*gvlSnapshot, error)
+	}{
+		{"disk", func() (*gvlSnapshot, error) { return loadPersistedSnapshot(defaultLanguage) }},
+		{"memcached", func() (*gvlSnapshot, error) { return loadLatestVersion(defaultLanguage) }},
+		{"IAB", refreshGVL},
+	}
+
+	var best *gvlSnapshot
+	for _, source := range sources {
+		snap, err := loadBefore(ctx, source.load)
+		if err != nil {
+			l4g.Info("Warmup could not load the GVL from %s: %v", source.name, err)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		l4g.Info("Warmup loaded GVL version %d from %s", snap.GVL.VendorListVersion, source.name)
+		if best == nil || snap.Expires.After(best.Expires) {
+			best = snap
+		}
+		if best.isFresh(time.Now()) {
+			break
+		}
+	}
+	if best == nil {
+		return errors.New("no vendor list could be loaded during warmup")
+	}
+	setSnapshot(best)
+	return nil
+}
+
+// warmedUp is set once the first warmup has run, whether or not it loaded a list. The server listens before
+// warming up, and /readyz fails until then.
+var warmedUp int32
+
+func hasWarmedUp() bool {
+	return atomic.LoadInt32(&warmedUp) == 1
+}
+
+// loadBefore runs load and gives up on it once ctx is done
+func loadBefore(ctx context.Context, load func() (*gvlSnapshot, error)) (*gvlSnapshot, error) {
+	type result struct {
+		snap *gvlSnapshot
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		snap, err := load()
+		done <- result{snap, err}
+	}()
+	select {
+	case r := <-done:
+		return r.snap, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
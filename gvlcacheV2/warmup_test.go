@@ -0,0 +1,127 @@
+package gvlcachev2
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func useSnapshotDir(t *testing.T) {
+	previous := SnapshotDir
+	SnapshotDir = t.TempDir()
+	t.Cleanup(func() { SnapshotDir = previous })
+}
+
+func readiness() int {
+	rw := httptest.NewRecorder()
+	HandleReadiness(rw, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	return rw.Code
+}
+
+func TestWarmupPrefersFreshSnapshotOnDisk(t *testing.T) {
+	var fetches int32
+	useUpstream(t, func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		serveGVL(testGVL(30), 3600)(rw, req)
+	})
+	useSnapshotDir(t)
+	onDisk := &gvlSnapshot{GVL: testGVL(29), Language: defaultLanguage, StoredAt: time.Now(), Expires: time.Now().Add(time.Hour)}
+	if err := persistSnapshot(onDisk); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := readiness(); code != http.StatusServiceUnavailable {
+		t.Errorf("readiness before warmup = %d, want 503", code)
+	}
+	if err := Warmup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentSnapshot(defaultLanguage).GVL.VendorListVersion; got != 29 || fetches != 0 {
+		t.Errorf("warmed up with version %d after %d fetches, want version 29 from disk", got, fetches)
+	}
+	if code := readiness(); code != http.StatusOK {
+		t.Errorf("readiness after warmup = %d, want 200", code)
+	}
+}
+
+func TestWarmupFallsBackToIAB(t *testing.T) {
+	useUpstream(t, serveGVL(testGVL(30), 3600))
+	useSnapshotDir(t)
+	stale := &gvlSnapshot{GVL: testGVL(29), Language: defaultLanguage, StoredAt: time.Now().Add(-2 * time.Hour), Expires: time.Now().Add(-time.Hour)}
+	persistSnapshot(stale)
+
+	if err := Warmup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentSnapshot(defaultLanguage).GVL.VendorListVersion; got != 30 {
+		t.Errorf("warmed up with version %d, want 30 from IAB", got)
+	}
+	if snap, err := loadPersistedSnapshot(defaultLanguage); err != nil || snap.GVL.VendorListVersion != 30 {
+		t.Errorf("snapshot on disk was not replaced: %v", err)
+	}
+}
+
+func TestWarmupFailsWithoutAnySource(t *testing.T) {
+	useUpstream(t, func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, "down", http.StatusServiceUnavailable)
+	})
+	useSnapshotDir(t)
+	if err := Warmup(context.Background()); err == nil {
+		t.Error("expected warmup to fail")
+	}
+	if code := readiness(); code != http.StatusServiceUnavailable {
+		t.Errorf("readiness = %d, want 503", code)
+	}
+}
+
+func TestReadinessWaitsForWarmup(t *testing.T) {
+	useUpstream(t, serveGVL(testGVL(30), 3600))
+	useSnapshotDir(t)
+	atomic.StoreInt32(&warmedUp, 0)
+	t.Cleanup(func() { atomic.StoreInt32(&warmedUp, 1) })
+
+	// A request can load the list while warmup is still running
+	getGVL(t)
+	if code := readiness(); code != http.StatusServiceUnavailable {
+		t.Errorf("readiness during warmup = %d, want 503", code)
+	}
+	if err := Warmup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if code := readiness(); code != http.StatusOK {
+		t.Errorf("readiness after warmup = %d, want 200", code)
+	}
+}
+
+func TestHandleHealthReportsSnapshotAge(t *testing.T) {
+	useUpstream(t, serveGVL(testGVL(29), 3600))
+	getGVL(t)
+
+	rw := httptest.NewRecorder()
+	HandleHealth(rw, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rw.Code != http.StatusOK {
+		t.Errorf("status = %d: %s", rw.Code, rw.Body)
+	}
+
+	old := *currentSnapshot(defaultLanguage)
+	old.StoredAt = time.Now().Add(-MaxSnapshotAge - time.Hour)
+	setSnapshot(&old)
+	rw = httptest.NewRecorder()
+	HandleHealth(rw, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("status with an old snapshot = %d, want 503", rw.Code)
+	}
+
+	dropSnapshot(defaultLanguage)
+	rw = httptest.NewRecorder()
+	HandleHealth(rw, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	report := healthReport{}
+	json.NewDecoder(rw.Body).Decode(&report)
+	if rw.Code != http.StatusServiceUnavailable || report.Status != "degraded" || len(report.Reasons) != 1 || report.Reasons[0] != "no snapshot loaded" {
+		t.Errorf("without a snapshot: status = %d, report = %+v", rw.Code, report)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ezoic/ezcache"
+	gvlcachev2 "github.com/ezoic/gvlcache/gvlcacheV2"
+)
+
+// gvldiff prints what changed between two versions of the vendor list, the same report /GVLV2/diff serves.
+// Versions already in memcached are read from there, the others are fetched from IAB's archive.
+//
+//	go run ./gvldiff -from 28 -to 29 [-text]
+func main() {
+	from := flag.Int("from", 0, "vendor list version to compare from")
+	to := flag.Int("to", 0, "vendor list version to compare to")
+	text := flag.Bool("text", false, "print a plain summary instead of JSON")
+	flag.Parse()
+	if *from <= 0 || *to <= 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ezcache.InitializeMemcachedForRegion()
+	diff, err := gvlcachev2.DiffVersions(*from, *to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *text {
+		fmt.Print(diff.Summary())
+		return
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(diff)
+}
@@ -1,7 +1,14 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/ezoic/ezcache"
 	gvlcachev2 "github.com/ezoic/gvlcache/gvlcacheV2"
@@ -12,30 +19,128 @@ import (
 // Reference documentation for this task can be found here
 // https://app.asana.com/0/1163157365763573/1164482186726660/f
 
-// ServerConfig is a struct representing an the configurations for this server
-type ServerConfig struct {
-	BindIPAddr string // The ip address for server to bind to.
-	BindIPPort int    // The port for the server ot listen to.
-	L4gConfig  string // Path of the configuration file for l4g
-	CertPath   string // Path where cert public key is
-	KeyPath    string // Path where cert private key is
-}
+const (
+	warmupDeadline      = 30 * time.Second
+	warmupRetryInterval = 30 * time.Second
+)
 
 func main() {
-	// 0. Set up logging
-	l4g.LoadConfiguration("/var/go/src/github.com/ezoic/gvlcache/l4gconfig.xml")
+	// 0. Load configuration for server, from the file, the environment and the flags
+	config, printConfig, err := loadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if printConfig {
+		config.print(os.Stdout)
+		return
+	}
+	config.apply()
+	auth, err := config.Auth.authenticator()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// 1. Set up logging
+	l4g.LoadConfiguration(config.L4gConfig)
 
-	// 1. Start memcache
+	// 2. Start memcache
 	ezcache.InitializeMemcachedForRegion()
-	// 2. Load configuration file for server
+	stopVersionGC := gvlcachev2.StartVersionGC(config.Cache.VersionGCInterval)
+	defer stopVersionGC()
+	for _, dir := range []string{gvlcachev2.SnapshotDir, gvlcachev2.RestrictionsDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			l4g.Error(err)
+		}
+	}
 
 	// 3. Set up router object
 	r := chi.NewRouter()
+	r.Use(gvlcachev2.RequestID)
+	r.Use(gvlcachev2.Metrics)
+	r.NotFound(gvlcachev2.HandleNotFound)
+	r.MethodNotAllowed(gvlcachev2.HandleMethodNotAllowed)
 	r.Get("/", HandleRoot)
+	r.Get("/readyz", gvlcachev2.HandleReadiness)
+	r.Get("/healthz", gvlcachev2.HandleHealth)
+	r.Get("/metrics", gvlcachev2.HandleMetrics)
 	r.Get("/GVLV2", gvlcachev2.HandleRequestForGVLVersion2)
-	r.Post("/GVLV2Cache/bustCache", gvlcachev2.HandleRequestForBustingCache)
-	http.ListenAndServe(":8054", r)
+	r.Head("/GVLV2", gvlcachev2.HandleRequestForGVLVersion2)
+	r.Post("/GVLV2", gvlcachev2.HandleRequestForGVLVersion2)
+	r.Get("/GVLV2/vendors", gvlcachev2.HandleVendorQuery)
+	r.Get("/GVLV2/vendors/{id}", gvlcachev2.HandleVendorResource)
+	r.Get("/GVLV2/purposes/{id}", gvlcachev2.HandlePurposeResource)
+	r.Get("/GVLV2/specialPurposes/{id}", gvlcachev2.HandleSpecialPurposeResource)
+	r.Get("/GVLV2/features/{id}", gvlcachev2.HandleFeatureResource)
+	r.Get("/GVLV2/specialFeatures/{id}", gvlcachev2.HandleSpecialFeatureResource)
+	r.Get("/GVLV2/stacks/{id}", gvlcachev2.HandleStackResource)
+	r.Get("/GVLV2/delta", gvlcachev2.HandleRequestForDelta)
+	r.Get("/GVLV2/diff", gvlcachev2.HandleVersionDiff)
+	r.Get("/GVLV2/reconsent", gvlcachev2.HandleReconsentCheck)
+	r.Post("/tcf/evaluate", gvlcachev2.HandleTCFEvaluate)
+	r.Post("/tcf/audit", gvlcachev2.HandleTCFAudit)
+	r.Post("/tcf/macros", gvlcachev2.HandleExpandMacros)
+	r.Post("/tcf/restrictions/validate", gvlcachev2.HandleValidateRestrictions)
+	r.Get("/tcf/publishers/{publisherId}/restrictions", gvlcachev2.HandleGetRestrictions)
+	r.With(auth.Require(gvlcachev2.ScopeAdmin)).Put("/tcf/publishers/{publisherId}/restrictions", gvlcachev2.HandlePutRestrictions)
+	r.With(auth.Require(gvlcachev2.ScopeRead)).Get("/GVLV2/admin/cache", gvlcachev2.HandleCacheIntrospection)
+	r.With(auth.Require(gvlcachev2.ScopeBust)).Post("/GVLV2Cache/bustCache", gvlcachev2.HandleRequestForBustingCache)
+
+	// 4. Listen, warm up the cache in the background, and serve until SIGTERM or SIGINT, then drain
+	server := newHTTPServer(config, r)
+	if config.CertPath != "" || config.KeyPath != "" {
+		reloader, err := newCertReloader(config.CertPath, config.KeyPath)
+		if err == nil {
+			server.TLSConfig, err = newTLSConfig(reloader, config.MinTLSVersion)
+		}
+		if err == nil && config.Auth.ClientCAPath != "" {
+			err = verifyClientCerts(server.TLSConfig, config.Auth.ClientCAPath)
+		}
+		if err != nil {
+			l4g.Critical("Could not set up TLS: %v", err)
+			l4g.Close()
+			os.Exit(1)
+		}
+		stopReloading := make(chan struct{})
+		defer close(stopReloading)
+		go reloader.watch(certReloadInterval, stopReloading)
+	}
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		l4g.Critical("Could not listen on %s: %v", server.Addr, err)
+		l4g.Close()
+		os.Exit(1)
+	}
+	// /readyz fails until the first warmup is over, so the instance only takes traffic once it has a list to serve
+	stopWarmup := make(chan struct{})
+	defer close(stopWarmup)
+	go func() {
+		for {
+			err := warmup()
+			if err == nil {
+				return
+			}
+			l4g.Warn("Warmup did not load a vendor list, retrying in %v: %v", warmupRetryInterval, err)
+			select {
+			case <-stopWarmup:
+				return
+			case <-time.After(warmupRetryInterval):
+			}
+		}
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	if err := serve(server, listener, config, signals); err != nil && err != http.ErrServerClosed {
+		l4g.Error(err)
+	}
+	l4g.Info("Server stopped")
+}
 
+func warmup() error {
+	ctx, cancel := context.WithTimeout(context.Background(), warmupDeadline)
+	defer cancel()
+	return gvlcachev2.Warmup(ctx)
 }
 
 // HandleRoot is a handler function for the root server that is used for testing
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	gvlcachev2 "github.com/ezoic/gvlcache/gvlcacheV2"
+	l4g "github.com/ezoic/log4go"
+)
+
+// newHTTPServer builds the server for the router with the timeouts and limits of the config
+func newHTTPServer(config ServerConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              net.JoinHostPort(config.BindIPAddr, strconv.Itoa(config.BindIPPort)),
+		Handler:           handler,
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+}
+
+// serve answers requests on the listener until a signal arrives, then drains: readiness fails right away, the
+// load balancer gets DrainDelay to stop sending traffic, and in-flight requests and the background work of
+// gvlcacheV2 get ShutdownGracePeriod to finish.
+func serve(server *http.Server, listener net.Listener, config ServerConfig, signals <-chan os.Signal) error {
+	errs := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			// The certificate comes from TLSConfig, ServeTLS also sets up HTTP/2
+			errs <- server.ServeTLS(listener, "", "")
+			return
+		}
+		errs <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		l4g.Info("Received %v, draining connections", sig)
+	}
+	gvlcachev2.StartDraining()
+	time.Sleep(config.DrainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownGracePeriod)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		l4g.Error("Connections were still open at the end of the grace period: %v", err)
+	}
+	if shutdownErr := gvlcachev2.Shutdown(ctx); shutdownErr != nil {
+		l4g.Error("Background work did not stop cleanly: %v", shutdownErr)
+		if err == nil {
+			err = shutdownErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func testServerConfig() ServerConfig {
+	config := defaultServerConfig()
+	config.BindIPAddr = "127.0.0.1"
+	config.BindIPPort = 0
+	config.DrainDelay = 10 * time.Millisecond
+	config.ShutdownGracePeriod = 2 * time.Second
+	return config
+}
+
+func TestNewHTTPServerAppliesConfig(t *testing.T) {
+	config := testServerConfig()
+	server := newHTTPServer(config, http.NotFoundHandler())
+	if server.Addr != "127.0.0.1:0" || server.ReadHeaderTimeout != config.ReadHeaderTimeout || server.WriteTimeout != config.WriteTimeout ||
+		server.IdleTimeout != config.IdleTimeout || server.MaxHeaderBytes != config.MaxHeaderBytes {
+		t.Errorf("server = %+v", server)
+	}
+}
+
+func TestServeDrainsInFlightRequestsOnSignal(t *testing.T) {
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		rw.Write([]byte("done"))
+	})
+	config := testServerConfig()
+	server := newHTTPServer(config, handler)
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signals := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() { served <- serve(server, listener, config, signals) }()
+
+	response := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/")
+		if err != nil {
+			response <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		response <- string(body)
+	}()
+	<-started
+	signals <- syscall.SIGTERM
+
+	if body := <-response; body != "done" {
+		t.Errorf("in-flight request got %q", body)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve returned %v", err)
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Errorf("the server still accepts connections after shutdown")
+	}
+}
@@ -0,0 +1,230 @@
+package tcstring
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// bitReader reads the fields of a segment most significant bit first. The first failure is kept in err, and every
+// read after it returns zero values, so a decoder reads all of its fields and checks err once.
+type bitReader struct {
+	segment string
+	data    []byte
+	pos     int
+	err     error
+	// expanded is how many ids the ranges of the segment have covered so far, counting overlaps
+	expanded int
+}
+
+// maxExpandedIDs bounds the ids the ranges of one segment may cover. A few bits describe a range of thousands of
+// ids, so without it a short string could keep the decoder busy for seconds and allocate gigabytes.
+const maxExpandedIDs = 4 << 16
+
+func newBitReader(segment string, encoded string) (*bitReader, error) {
+	// The spec leaves the padding out, some CMPs put it in anyway
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil, &DecodeError{Segment: segment, Field: "base64", Err: fmt.Errorf("%w: %v", ErrBase64, err)}
+	}
+	return &bitReader{segment: segment, data: data}, nil
+}
+
+// fail keeps the first failure, for the field that started at bit
+func (r *bitReader) fail(field string, bit int, err error) {
+	if r.err == nil {
+		r.err = &DecodeError{Segment: r.segment, Field: field, Bit: bit, Err: err}
+	}
+}
+
+func (r *bitReader) int(field string, bits int) int {
+	if r.err != nil {
+		return 0
+	}
+	if r.pos+bits > len(r.data)*8 {
+		r.fail(field, r.pos, fmt.Errorf("%w: %d bits are needed and %d are left", ErrTruncated, bits, len(r.data)*8-r.pos))
+		return 0
+	}
+	value := 0
+	for i := 0; i < bits; i++ {
+		value <<= 1
+		if r.data[r.pos/8]&(0x80>>uint(r.pos%8)) != 0 {
+			value |= 1
+		}
+		r.pos++
+	}
+	return value
+}
+
+func (r *bitReader) bool(field string) bool {
+	return r.int(field, 1) == 1
+}
+
+// date reads a time in deciseconds since the epoch
+func (r *bitReader) date(field string) time.Time {
+	deciseconds := r.int(field, 36)
+	return time.Unix(0, int64(deciseconds)*int64(100*time.Millisecond)).UTC()
+}
+
+// letters reads two letters of six bits each, A being 0
+func (r *bitReader) letters(field string) string {
+	at := r.pos
+	first, second := r.int(field, 6), r.int(field, 6)
+	if r.err != nil {
+		return ""
+	}
+	if first > 25 || second > 25 {
+		r.fail(field, at, fmt.Errorf("%w: %d and %d are not both letters", ErrInvalidValue, first, second))
+		return ""
+	}
+	return string([]byte{'A' + byte(first), 'A' + byte(second)})
+}
+
+// bitfield reads bits flags, the first of them for id 1
+func (r *bitReader) bitfield(field string, bits int) IDs {
+	ids := IDs{}
+	for id := 1; id <= bits; id++ {
+		if r.bool(field) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// ranges reads a number of entries, each a single id or a range of them. No id may be 0 or above max. Entries may
+// overlap; the ids are collected in a set no larger than max.
+func (r *bitReader) ranges(field string, max int) IDs {
+	set := make([]bool, max+1)
+	entries := r.int(field, 12)
+	for i := 0; i < entries && r.err == nil; i++ {
+		at := r.pos
+		isRange := r.bool(field)
+		start := r.int(field, 16)
+		end := start
+		if isRange {
+			end = r.int(field, 16)
+		}
+		if r.err != nil {
+			break
+		}
+		switch {
+		case start == 0:
+			r.fail(field, at, fmt.Errorf("%w: entry %d starts at id 0", ErrInvalidValue, i))
+		case end < start:
+			r.fail(field, at, fmt.Errorf("%w: entry %d ends at %d before its start %d", ErrInvalidValue, i, end, start))
+		case end > max:
+			r.fail(field, at, fmt.Errorf("%w: entry %d ends at %d, past the maximum id %d", ErrInvalidValue, i, end, max))
+		case r.expanded+end-start+1 > maxExpandedIDs:
+			r.fail(field, at, fmt.Errorf("%w: the ranges of the segment cover more than %d ids", ErrInvalidValue, maxExpandedIDs))
+		}
+		if r.err != nil {
+			break
+		}
+		r.expanded += end - start + 1
+		for id := start; id <= end; id++ {
+			set[id] = true
+		}
+	}
+	ids := IDs{}
+	for id := 1; id <= max && r.err == nil; id++ {
+		if set[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// vendors reads a vendor section: the largest id, then either a flag per vendor or ranges of vendors
+func (r *bitReader) vendors(field string) IDs {
+	maxVendorID := r.int(field+".maxVendorId", 16)
+	if r.bool(field + ".isRangeEncoding") {
+		return r.ranges(field, maxVendorID)
+	}
+	return r.bitfield(field, maxVendorID)
+}
+
+// bitWriter writes fields most significant bit first
+type bitWriter struct {
+	data []byte
+	pos  int
+}
+
+func (w *bitWriter) int(value int, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		if w.pos%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		if value&(1<<uint(i)) != 0 {
+			w.data[w.pos/8] |= 0x80 >> uint(w.pos%8)
+		}
+		w.pos++
+	}
+}
+
+func (w *bitWriter) bool(value bool) {
+	if value {
+		w.int(1, 1)
+	} else {
+		w.int(0, 1)
+	}
+}
+
+func (w *bitWriter) date(t time.Time) {
+	w.int(int(t.UnixNano()/int64(100*time.Millisecond)), 36)
+}
+
+func (w *bitWriter) letters(letters string) {
+	w.int(int(letters[0]-'A'), 6)
+	w.int(int(letters[1]-'A'), 6)
+}
+
+func (w *bitWriter) bitfield(ids IDs, bits int) {
+	for id := 1; id <= bits; id++ {
+		w.bool(ids.Has(id))
+	}
+}
+
+func (w *bitWriter) ranges(ranges [][2]int) {
+	w.int(len(ranges), 12)
+	for _, r := range ranges {
+		w.bool(r[0] != r[1])
+		w.int(r[0], 16)
+		if r[0] != r[1] {
+			w.int(r[1], 16)
+		}
+	}
+}
+
+// vendors writes a vendor section as a bitfield or as ranges, whichever is shorter
+func (w *bitWriter) vendors(ids IDs) {
+	maxVendorID := 0
+	if len(ids) > 0 {
+		maxVendorID = ids[len(ids)-1]
+	}
+	w.int(maxVendorID, 16)
+	ranges := ids.ranges()
+	if rangesLength(ranges) < maxVendorID {
+		w.bool(true)
+		w.ranges(ranges)
+		return
+	}
+	w.bool(false)
+	w.bitfield(ids, maxVendorID)
+}
+
+// rangesLength is the number of bits ranges take
+func rangesLength(ranges [][2]int) int {
+	bits := 12
+	for _, r := range ranges {
+		bits += 17
+		if r[0] != r[1] {
+			bits += 16
+		}
+	}
+	return bits
+}
+
+func (w *bitWriter) encode() string {
+	return base64.RawURLEncoding.EncodeToString(w.data)
+}
@@ -0,0 +1,169 @@
+package tcstring
+
+import (
+	"fmt"
+	"time"
+)
+
+// The largest ids the fields of the core segment hold
+const (
+	maxPurposeID        = 24
+	maxSpecialFeatureID = 12
+)
+
+// maxDate is the last time 36 bits of deciseconds hold
+var maxDate = time.Unix(0, (1<<36-1)*int64(100*time.Millisecond))
+
+// Encode writes a TC string: the core segment, then the disclosed vendors, allowed vendors and publisher TC segments
+// it carries. Each vendor section is written as a bitfield or as ranges,
+// whichever is shorter. Times are truncated to the decisecond the string holds.
+func Encode(tc *TCString) (string, error) {
+	if err := tc.validate(); err != nil {
+		return "", err
+	}
+	w := &bitWriter{}
+	w.int(Version, 6)
+	w.date(tc.Created)
+	w.date(tc.LastUpdated)
+	w.int(tc.CmpID, 12)
+	w.int(tc.CmpVersion, 12)
+	w.int(tc.ConsentScreen, 6)
+	w.letters(tc.ConsentLanguage)
+	w.int(tc.VendorListVersion, 12)
+	w.int(tc.TCFPolicyVersion, 6)
+	w.bool(tc.IsServiceSpecific)
+	w.bool(tc.UseNonStandardStacks)
+	w.bitfield(tc.SpecialFeatureOptIns.normalized(), maxSpecialFeatureID)
+	w.bitfield(tc.PurposesConsent.normalized(), maxPurposeID)
+	w.bitfield(tc.PurposesLITransparency.normalized(), maxPurposeID)
+	w.bool(tc.PurposeOneTreatment)
+	w.letters(tc.PublisherCC)
+	w.vendors(tc.VendorConsents.normalized())
+	w.vendors(tc.VendorLegitimateInterests.normalized())
+	encodePublisherRestrictions(w, tc.PublisherRestrictions)
+	return w.encode() + encodeSegments(tc), nil
+}
+
+// EncodeError says which field of a TC string can't be encoded
+type EncodeError struct {
+	Field string
+	Err   error
+}
+
+func (err *EncodeError) Error() string {
+	return fmt.Sprintf("tcstring: %s: %v", err.Field, err.Err)
+}
+
+func (err *EncodeError) Unwrap() error {
+	return err.Err
+}
+
+func invalid(field string, format string, args ...interface{}) error {
+	return &EncodeError{Field: field, Err: fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidValue}, args...)...)}
+}
+
+// validate checks that every field fits the bits the spec gives it
+func (tc *TCString) validate() error {
+	if tc.Version != Version {
+		return &EncodeError{Field: "version", Err: fmt.Errorf("%w: the string is version %d", ErrUnsupportedVersion, tc.Version)}
+	}
+	for field, t := range map[string]time.Time{"created": tc.Created, "lastUpdated": tc.LastUpdated} {
+		if t.Before(time.Unix(0, 0)) || t.After(maxDate) {
+			return invalid(field, "%v is out of range", t)
+		}
+	}
+	for _, field := range []struct {
+		name  string
+		value int
+		bits  uint
+	}{
+		{"cmpId", tc.CmpID, 12},
+		{"cmpVersion", tc.CmpVersion, 12},
+		{"consentScreen", tc.ConsentScreen, 6},
+		{"vendorListVersion", tc.VendorListVersion, 12},
+		{"tcfPolicyVersion", tc.TCFPolicyVersion, 6},
+	} {
+		if field.value < 0 || field.value >= 1<<field.bits {
+			return invalid(field.name, "%d does not fit in %d bits", field.value, field.bits)
+		}
+	}
+	for field, letters := range map[string]string{"consentLanguage": tc.ConsentLanguage, "publisherCC": tc.PublisherCC} {
+		if len(letters) != 2 || letters[0] < 'A' || letters[0] > 'Z' || letters[1] < 'A' || letters[1] > 'Z' {
+			return invalid(field, "%q is not two upper case letters", letters)
+		}
+	}
+	for _, field := range []struct {
+		name string
+		ids  IDs
+		max  int
+	}{
+		{"specialFeatureOptIns", tc.SpecialFeatureOptIns, maxSpecialFeatureID},
+		{"purposesConsent", tc.PurposesConsent, maxPurposeID},
+		{"purposesLITransparency", tc.PurposesLITransparency, maxPurposeID},
+		{"vendorConsents", tc.VendorConsents, maxVendorID},
+		{"vendorLegitimateInterests", tc.VendorLegitimateInterests, maxVendorID},
+		{"disclosedVendors", tc.DisclosedVendors, maxVendorID},
+		{"allowedVendors", tc.AllowedVendors, maxVendorID},
+	} {
+		if err := checkIDs(field.name, field.ids, field.max); err != nil {
+			return err
+		}
+	}
+	if len(tc.PublisherRestrictions) >= 1<<12 {
+		return invalid("pubRestrictions", "%d restrictions do not fit in 12 bits", len(tc.PublisherRestrictions))
+	}
+	for i, restriction := range tc.PublisherRestrictions {
+		field := fmt.Sprintf("pubRestrictions[%d]", i)
+		if restriction.PurposeID < 1 || restriction.PurposeID > maxPurposeID {
+			return invalid(field+".purposeId", "purpose %d does not exist", restriction.PurposeID)
+		}
+		if restriction.RestrictionType < NotAllowed || restriction.RestrictionType > RequireLegitimateInterest {
+			return invalid(field+".restrictionType", "restriction type %d is undefined", restriction.RestrictionType)
+		}
+		if err := checkIDs(field+".vendors", restriction.Vendors, maxVendorID); err != nil {
+			return err
+		}
+		if err := checkRanges(field+".vendors", restriction.Vendors); err != nil {
+			return err
+		}
+	}
+	// Restrictions on the same purpose and type are written as one entry
+	for _, restriction := range MergeRestrictions(tc.PublisherRestrictions) {
+		if err := checkRanges("pubRestrictions", restriction.Vendors); err != nil {
+			return err
+		}
+	}
+	// Whichever way the vendor sections are written, the decoder must be able to expand them
+	expanded := len(tc.VendorConsents.normalized()) + len(tc.VendorLegitimateInterests.normalized())
+	for _, restriction := range MergeRestrictions(tc.PublisherRestrictions) {
+		expanded += len(restriction.Vendors)
+	}
+	if expanded > maxExpandedIDs {
+		return invalid("pubRestrictions", "the vendor sections hold %d ids, more than the %d a segment may", expanded, maxExpandedIDs)
+	}
+	if conflicts := Conflicts(tc.PublisherRestrictions); len(conflicts) > 0 {
+		return invalid("pubRestrictions", "vendors are given more than one restriction type, by purpose: %v", conflicts)
+	}
+	if tc.PublisherTC != nil {
+		return tc.PublisherTC.validate()
+	}
+	return nil
+}
+
+func checkIDs(field string, ids IDs, max int) error {
+	for _, id := range ids {
+		if id < 1 || id > max {
+			return invalid(field, "id %d is not between 1 and %d", id, max)
+		}
+	}
+	return nil
+}
+
+// checkRanges checks that ids fit a ranges section. Vendor sections don't need it: the encoder writes a bitfield
+// whenever it is shorter, and it always is with that many ranges.
+func checkRanges(field string, ids IDs) error {
+	if len(ids.normalized().ranges()) >= 1<<12 {
+		return invalid(field, "the ids make more than %d ranges", 1<<12-1)
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package tcstring
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func randomIDs(rng *rand.Rand, max int) IDs {
+	ids := IDs{}
+	density := rng.Float64()
+	// Runs of consecutive ids favour ranges, scattered ones the bitfield
+	for id := 1; id <= max; id++ {
+		if rng.Float64() < density {
+			ids = append(ids, id)
+		} else if rng.Intn(4) == 0 {
+			id += rng.Intn(max/4 + 1)
+		}
+	}
+	return ids
+}
+
+func randomTCString(rng *rand.Rand) *TCString {
+	letters := func() string { return string([]byte{byte('A' + rng.Intn(26)), byte('A' + rng.Intn(26))}) }
+	created := time.Unix(0, rng.Int63n(int64(maxDate.Sub(time.Unix(0, 0))/(100*time.Millisecond)))*int64(100*time.Millisecond)).UTC()
+	tc := &TCString{
+		Version:                   Version,
+		Created:                   created,
+		LastUpdated:               created.Add(time.Duration(rng.Intn(1000)) * 100 * time.Millisecond),
+		CmpID:                     rng.Intn(1 << 12),
+		CmpVersion:                rng.Intn(1 << 12),
+		ConsentScreen:             rng.Intn(1 << 6),
+		ConsentLanguage:           letters(),
+		VendorListVersion:         rng.Intn(1 << 12),
+		TCFPolicyVersion:          rng.Intn(1 << 6),
+		IsServiceSpecific:         rng.Intn(2) == 0,
+		UseNonStandardStacks:      rng.Intn(2) == 0,
+		SpecialFeatureOptIns:      randomIDs(rng, maxSpecialFeatureID),
+		PurposesConsent:           randomIDs(rng, maxPurposeID),
+		PurposesLITransparency:    randomIDs(rng, maxPurposeID),
+		PurposeOneTreatment:       rng.Intn(2) == 0,
+		PublisherCC:               letters(),
+		VendorConsents:            randomIDs(rng, 1+rng.Intn(1500)),
+		VendorLegitimateInterests: randomIDs(rng, 1+rng.Intn(1500)),
+		PublisherRestrictions:     []PublisherRestriction{},
+	}
+	// One restriction per purpose, in the order the encoder merges them into
+	purposes := rng.Perm(maxPurposeID)[:rng.Intn(4)]
+	sort.Ints(purposes)
+	for _, purpose := range purposes {
+		tc.PublisherRestrictions = append(tc.PublisherRestrictions, PublisherRestriction{
+			PurposeID:       1 + purpose,
+			RestrictionType: RestrictionType(rng.Intn(3)),
+			Vendors:         randomIDs(rng, 1+rng.Intn(300)),
+		})
+	}
+	// Each optional segment is carried by about half the strings
+	if rng.Intn(2) == 0 {
+		tc.DisclosedVendors = randomIDs(rng, 1+rng.Intn(1500))
+	}
+	if rng.Intn(2) == 0 {
+		tc.AllowedVendors = randomIDs(rng, 1+rng.Intn(1500))
+	}
+	if rng.Intn(2) == 0 {
+		custom := rng.Intn(maxCustomPurposeID + 1)
+		tc.PublisherTC = &PublisherTC{
+			PurposesConsent:              randomIDs(rng, maxPurposeID),
+			PurposesLITransparency:       randomIDs(rng, maxPurposeID),
+			NumCustomPurposes:            custom,
+			CustomPurposesConsent:        randomIDs(rng, custom),
+			CustomPurposesLITransparency: randomIDs(rng, custom),
+		}
+	}
+	return tc
+}
+
+func TestEncodeRoundTrips(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		tc := randomTCString(rng)
+		encoded, err := Encode(tc)
+		if err != nil {
+			t.Fatalf("encoding %+v: %v", tc, err)
+		}
+		decoded, err := Decode(encoded)
+		if err != nil {
+			t.Fatalf("decoding %s: %v", encoded, err)
+		}
+		if !reflect.DeepEqual(decoded, tc) {
+			t.Fatalf("%s decoded to\n%+v\nwant\n%+v", encoded, decoded, tc)
+		}
+		// Encoding is deterministic, so decoding and encoding again gives the same string
+		if again, _ := Encode(decoded); again != encoded {
+			t.Fatalf("%s encoded again to %s", encoded, again)
+		}
+	}
+}
+
+func TestEncodeReferenceStrings(t *testing.T) {
+	for _, reference := range []string{"COvFyGBOvFyGBAbAAAENAPCAAOAAAAAAAAAAAEEUACCKAAA", "COw4XqLOw4XqLAAAAAENAXCAAAAAAAAAAAAAAAAAAAAA"} {
+		tc, err := Decode(reference)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := Encode(tc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded, err := Decode(encoded); err != nil || !reflect.DeepEqual(decoded, tc) {
+			t.Errorf("%s encoded to %s, which decodes to %+v, %v", reference, encoded, decoded, err)
+		}
+	}
+}
+
+func TestEncodeChoosesShorterVendorEncoding(t *testing.T) {
+	consecutive := IDs{}
+	for id := 1; id <= 600; id++ {
+		consecutive = append(consecutive, id)
+	}
+	for _, test := range []struct {
+		ids        IDs
+		wantRanges bool
+	}{
+		{IDs{}, false},
+		{IDs{1, 3, 5, 7}, false},
+		{consecutive, true},
+		{IDs{700}, true},
+	} {
+		w := &bitWriter{}
+		w.vendors(test.ids)
+		r := &bitReader{data: w.data}
+		r.int("maxVendorId", 16)
+		if isRange := r.bool("isRangeEncoding"); isRange != test.wantRanges {
+			t.Errorf("%d ids up to %v: range encoding = %t", len(test.ids), test.ids[len(test.ids)-1:], isRange)
+		}
+		bitfieldLength, rangeLength := 17, 17+rangesLength(test.ids.ranges())
+		if len(test.ids) > 0 {
+			bitfieldLength += test.ids[len(test.ids)-1]
+		}
+		if shortest := min(bitfieldLength, rangeLength); w.pos != shortest {
+			t.Errorf("%d ids: section is %d bits, the shortest encoding takes %d", len(test.ids), w.pos, shortest)
+		}
+	}
+}
+
+func TestEncodeRejectsFieldsThatDoNotFit(t *testing.T) {
+	valid := func() *TCString {
+		return &TCString{Version: Version, ConsentLanguage: "EN", PublisherCC: "DE", Created: time.Unix(1600000000, 0), LastUpdated: time.Unix(1600000000, 0)}
+	}
+	for _, test := range []struct {
+		field  string
+		change func(*TCString)
+	}{
+		{"version", func(tc *TCString) { tc.Version = 1 }},
+		{"cmpId", func(tc *TCString) { tc.CmpID = 4096 }},
+		{"consentLanguage", func(tc *TCString) { tc.ConsentLanguage = "en" }},
+		{"purposesConsent", func(tc *TCString) { tc.PurposesConsent = IDs{25} }},
+		{"vendorConsents", func(tc *TCString) { tc.VendorConsents = IDs{0} }},
+		{"pubRestrictions[0].restrictionType", func(tc *TCString) {
+			tc.PublisherRestrictions = []PublisherRestriction{{PurposeID: 1, RestrictionType: 3}}
+		}},
+		{"disclosedVendors", func(tc *TCString) { tc.DisclosedVendors = IDs{1 << 16} }},
+		{"publisherTC.customPurposesConsent", func(tc *TCString) {
+			tc.PublisherTC = &PublisherTC{NumCustomPurposes: 2, CustomPurposesConsent: IDs{3}}
+		}},
+	} {
+		tc := valid()
+		test.change(tc)
+		_, err := Encode(tc)
+		encodeErr := &EncodeError{}
+		if !errors.As(err, &encodeErr) || encodeErr.Field != test.field {
+			t.Errorf("%s: err = %v", test.field, err)
+		}
+	}
+	if _, err := Encode(valid()); err != nil {
+		t.Errorf("valid string: %v", err)
+	}
+}
+
+func TestEncodeSparseVendorSections(t *testing.T) {
+	odd := IDs{}
+	for id := 1; id < 10000; id += 2 {
+		odd = append(odd, id)
+	}
+	tc := &TCString{Version: Version, ConsentLanguage: "EN", PublisherCC: "DE", Created: time.Unix(1600000000, 0), LastUpdated: time.Unix(1600000000, 0),
+		VendorConsents: odd, DisclosedVendors: odd}
+	encoded, err := Encode(tc)
+	if err != nil {
+		t.Fatalf("%d separate vendors: %v", len(odd), err)
+	}
+	decoded, err := Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.VendorConsents, odd) || !reflect.DeepEqual(decoded.DisclosedVendors, odd) {
+		t.Errorf("the vendors did not round-trip")
+	}
+
+	// Restrictions are always written as ranges
+	tc.PublisherRestrictions = []PublisherRestriction{{PurposeID: 1, RestrictionType: NotAllowed, Vendors: odd}}
+	encodeErr := &EncodeError{}
+	if _, err := Encode(tc); !errors.As(err, &encodeErr) || encodeErr.Field != "pubRestrictions[0].vendors" {
+		t.Errorf("restriction over 4095 ranges: err = %v", err)
+	}
+}
+
+func TestEncodeMergesRestrictionsAndRefusesConflicts(t *testing.T) {
+	tc := &TCString{Version: Version, ConsentLanguage: "EN", PublisherCC: "DE", Created: time.Unix(1600000000, 0), LastUpdated: time.Unix(1600000000, 0), PublisherRestrictions: []PublisherRestriction{
+		{PurposeID: 4, RestrictionType: RequireConsent, Vendors: IDs{9}},
+		{PurposeID: 2, RestrictionType: NotAllowed, Vendors: IDs{3}},
+		{PurposeID: 4, RestrictionType: RequireConsent, Vendors: IDs{7, 8}},
+	}}
+	encoded, err := Encode(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _ := Decode(encoded)
+	want := []PublisherRestriction{
+		{PurposeID: 2, RestrictionType: NotAllowed, Vendors: IDs{3}},
+		{PurposeID: 4, RestrictionType: RequireConsent, Vendors: IDs{7, 8, 9}},
+	}
+	if !reflect.DeepEqual(decoded.PublisherRestrictions, want) {
+		t.Errorf("restrictions = %+v", decoded.PublisherRestrictions)
+	}
+
+	tc.PublisherRestrictions = append(tc.PublisherRestrictions, PublisherRestriction{PurposeID: 4, RestrictionType: NotAllowed, Vendors: IDs{8}})
+	if _, err := Encode(tc); err == nil {
+		t.Error("vendor 8 was given two restrictions on purpose 4")
+	}
+}
+
+func TestEncodeSortsUnsortedIDs(t *testing.T) {
+	tc := &TCString{Version: Version, ConsentLanguage: "EN", PublisherCC: "DE", Created: time.Unix(1600000000, 0), LastUpdated: time.Unix(1600000000, 0),
+		PurposesConsent: IDs{3, 1, 2, 1}, VendorConsents: IDs{700, 8, 12}, DisclosedVendors: IDs{12, 8},
+		PublisherTC: &PublisherTC{
+			PurposesConsent:              IDs{10, 2, 7},
+			PurposesLITransparency:       IDs{9, 4},
+			NumCustomPurposes:            5,
+			CustomPurposesConsent:        IDs{5, 1, 3},
+			CustomPurposesLITransparency: IDs{4, 2, 4},
+		},
+	}
+	encoded, err := Encode(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &PublisherTC{
+		PurposesConsent:              IDs{2, 7, 10},
+		PurposesLITransparency:       IDs{4, 9},
+		NumCustomPurposes:            5,
+		CustomPurposesConsent:        IDs{1, 3, 5},
+		CustomPurposesLITransparency: IDs{2, 4},
+	}
+	if !reflect.DeepEqual(decoded.PublisherTC, want) || !reflect.DeepEqual(decoded.PurposesConsent, IDs{1, 2, 3}) ||
+		!reflect.DeepEqual(decoded.VendorConsents, IDs{8, 12, 700}) || !reflect.DeepEqual(decoded.DisclosedVendors, IDs{8, 12}) {
+		t.Errorf("decoded %+v with publisher TC %+v", decoded, decoded.PublisherTC)
+	}
+}
@@ -0,0 +1,141 @@
+package tcstring
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// RestrictionType is how a publisher restricts the legal basis vendors may use for a purpose
+type RestrictionType int
+
+// The restriction types of the spec. The fourth value is undefined.
+const (
+	NotAllowed RestrictionType = iota
+	RequireConsent
+	RequireLegitimateInterest
+)
+
+var restrictionTypeNames = []string{"notAllowed", "requireConsent", "requireLegitimateInterest"}
+
+func (restriction RestrictionType) String() string {
+	if restriction >= NotAllowed && restriction <= RequireLegitimateInterest {
+		return restrictionTypeNames[restriction]
+	}
+	return fmt.Sprintf("RestrictionType(%d)", int(restriction))
+}
+
+// MarshalText writes the restriction type by name, so that restriction configs read as JSON
+func (restriction RestrictionType) MarshalText() ([]byte, error) {
+	if restriction < NotAllowed || restriction > RequireLegitimateInterest {
+		return nil, fmt.Errorf("tcstring: restriction type %d is undefined", int(restriction))
+	}
+	return []byte(restriction.String()), nil
+}
+
+// UnmarshalText reads a restriction type by name, or by its value in the spec
+func (restriction *RestrictionType) UnmarshalText(text []byte) error {
+	for value, name := range restrictionTypeNames {
+		if string(text) == name || string(text) == strconv.Itoa(value) {
+			*restriction = RestrictionType(value)
+			return nil
+		}
+	}
+	return fmt.Errorf("tcstring: %q is not a restriction type, use notAllowed, requireConsent or requireLegitimateInterest", text)
+}
+
+// PublisherRestriction restricts the legal basis the listed vendors may use for a purpose
+type PublisherRestriction struct {
+	PurposeID       int             `json:"purposeId"`
+	RestrictionType RestrictionType `json:"restrictionType"`
+	Vendors         IDs             `json:"vendors"`
+}
+
+// maxVendorID is the largest id 16 bits hold. Restriction ranges have no maximum of their own.
+const maxVendorID = 1<<16 - 1
+
+func decodePublisherRestrictions(r *bitReader) []PublisherRestriction {
+	restrictions := []PublisherRestriction{}
+	seen := map[[2]int]bool{}
+	count := r.int("numPubRestrictions", 12)
+	for i := 0; i < count && r.err == nil; i++ {
+		field := fmt.Sprintf("pubRestrictions[%d]", i)
+		at := r.pos
+		restriction := PublisherRestriction{
+			PurposeID:       r.int(field+".purposeId", 6),
+			RestrictionType: RestrictionType(r.int(field+".restrictionType", 2)),
+		}
+		if r.err == nil && restriction.PurposeID == 0 {
+			r.fail(field+".purposeId", at, fmt.Errorf("%w: purpose 0 does not exist", ErrInvalidValue))
+		}
+		if r.err == nil && restriction.RestrictionType > RequireLegitimateInterest {
+			r.fail(field+".restrictionType", at+6, fmt.Errorf("%w: restriction type %d is undefined", ErrInvalidValue, restriction.RestrictionType))
+		}
+		// The spec has one entry per purpose and type, which also keeps the entries from each holding every vendor
+		key := [2]int{restriction.PurposeID, int(restriction.RestrictionType)}
+		if r.err == nil && seen[key] {
+			r.fail(field+".purposeId", at, fmt.Errorf("%w: purpose %d already has a %s entry", ErrInvalidValue, restriction.PurposeID, restriction.RestrictionType))
+		}
+		seen[key] = true
+		restriction.Vendors = r.ranges(field+".vendors", maxVendorID)
+		restrictions = append(restrictions, restriction)
+	}
+	return restrictions
+}
+
+// MergeRestrictions combines the restrictions of the same purpose and type, the form the spec expects them in, and
+// sorts them by purpose and then type
+func MergeRestrictions(restrictions []PublisherRestriction) []PublisherRestriction {
+	merged := []PublisherRestriction{}
+	at := map[[2]int]int{}
+	for _, restriction := range restrictions {
+		key := [2]int{restriction.PurposeID, int(restriction.RestrictionType)}
+		i, ok := at[key]
+		if !ok {
+			i = len(merged)
+			at[key] = i
+			merged = append(merged, PublisherRestriction{PurposeID: restriction.PurposeID, RestrictionType: restriction.RestrictionType})
+		}
+		merged[i].Vendors = append(merged[i].Vendors, restriction.Vendors...)
+	}
+	for i := range merged {
+		merged[i].Vendors = merged[i].Vendors.normalized()
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		if merged[i].PurposeID != merged[j].PurposeID {
+			return merged[i].PurposeID < merged[j].PurposeID
+		}
+		return merged[i].RestrictionType < merged[j].RestrictionType
+	})
+	return merged
+}
+
+// Conflicts returns, by purpose, the vendors given more than one type of restriction for it
+func Conflicts(restrictions []PublisherRestriction) map[int]IDs {
+	types := map[[2]int]RestrictionType{}
+	conflicts := map[int]IDs{}
+	for _, restriction := range restrictions {
+		for _, id := range restriction.Vendors {
+			key := [2]int{restriction.PurposeID, id}
+			if previous, ok := types[key]; !ok {
+				types[key] = restriction.RestrictionType
+			} else if previous != restriction.RestrictionType && !conflicts[restriction.PurposeID].Has(id) {
+				conflicts[restriction.PurposeID] = append(conflicts[restriction.PurposeID], id)
+			}
+		}
+	}
+	for purpose, ids := range conflicts {
+		conflicts[purpose] = ids.normalized()
+	}
+	return conflicts
+}
+
+func encodePublisherRestrictions(w *bitWriter, restrictions []PublisherRestriction) {
+	restrictions = MergeRestrictions(restrictions)
+	w.int(len(restrictions), 12)
+	for _, restriction := range restrictions {
+		w.int(restriction.PurposeID, 6)
+		w.int(int(restriction.RestrictionType), 2)
+		w.ranges(restriction.Vendors.ranges())
+	}
+}
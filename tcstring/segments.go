@@ -0,0 +1,135 @@
+package tcstring
+
+import "fmt"
+
+// The segment types segments start with. The core segment starts with its version instead, whose first three bits
+// are 0.
+const (
+	SegmentTypeCore = iota
+	SegmentTypeDisclosedVendors
+	SegmentTypeAllowedVendors
+	SegmentTypePublisherTC
+)
+
+// maxCustomPurposeID is the largest number of custom purposes 6 bits hold
+const maxCustomPurposeID = 1<<6 - 1
+
+// PublisherTC is the publisher's own transparency and consent: the standard purposes it processes for itself, and
+// the custom purposes it defines, numbered from 1 to NumCustomPurposes
+type PublisherTC struct {
+	PurposesConsent              IDs `json:"pubPurposesConsent"`
+	PurposesLITransparency       IDs `json:"pubPurposesLITransparency"`
+	NumCustomPurposes            int `json:"numCustomPurposes"`
+	CustomPurposesConsent        IDs `json:"customPurposesConsent"`
+	CustomPurposesLITransparency IDs `json:"customPurposesLITransparency"`
+}
+
+// SegmentType returns the type of an encoded segment, read from its first three bits
+func SegmentType(segment string) (int, error) {
+	r, err := newBitReader("segment", segment)
+	if err != nil {
+		return 0, err
+	}
+	segmentType := r.int("segmentType", 3)
+	return segmentType, r.err
+}
+
+// decodeSegment reads the optional segment at index, which says its type in its first three bits
+func decodeSegment(tc *TCString, index int, segment string) error {
+	r, err := newBitReader(fmt.Sprintf("segment %d", index), segment)
+	if err != nil {
+		return err
+	}
+	segmentType := r.int("segmentType", 3)
+	if r.err != nil {
+		return r.err
+	}
+	switch segmentType {
+	case SegmentTypeDisclosedVendors:
+		r.segment = segmentDisclosedVendors
+		if tc.DisclosedVendors == nil {
+			tc.DisclosedVendors = r.vendors("disclosedVendors")
+			return r.err
+		}
+	case SegmentTypeAllowedVendors:
+		r.segment = segmentAllowedVendors
+		if tc.AllowedVendors == nil {
+			tc.AllowedVendors = r.vendors("allowedVendors")
+			return r.err
+		}
+	case SegmentTypePublisherTC:
+		r.segment = segmentPublisherTC
+		if tc.PublisherTC == nil {
+			tc.PublisherTC = decodePublisherTC(r)
+			return r.err
+		}
+	default:
+		r.fail("segmentType", 0, fmt.Errorf("%w: segment type %d is undefined after the core segment", ErrInvalidValue, segmentType))
+		return r.err
+	}
+	r.fail("segmentType", 0, fmt.Errorf("%w: the string has two %s segments", ErrInvalidValue, r.segment))
+	return r.err
+}
+
+func decodePublisherTC(r *bitReader) *PublisherTC {
+	publisher := &PublisherTC{
+		PurposesConsent:        r.bitfield("pubPurposesConsent", maxPurposeID),
+		PurposesLITransparency: r.bitfield("pubPurposesLITransparency", maxPurposeID),
+		NumCustomPurposes:      r.int("numCustomPurposes", 6),
+	}
+	publisher.CustomPurposesConsent = r.bitfield("customPurposesConsent", publisher.NumCustomPurposes)
+	publisher.CustomPurposesLITransparency = r.bitfield("customPurposesLITransparency", publisher.NumCustomPurposes)
+	return publisher
+}
+
+// encodeSegments writes the optional segments the string carries, each after a dot
+func encodeSegments(tc *TCString) string {
+	encoded := ""
+	for _, vendors := range []struct {
+		segmentType int
+		ids         IDs
+	}{{SegmentTypeDisclosedVendors, tc.DisclosedVendors}, {SegmentTypeAllowedVendors, tc.AllowedVendors}} {
+		if vendors.ids == nil {
+			continue
+		}
+		w := &bitWriter{}
+		w.int(vendors.segmentType, 3)
+		w.vendors(vendors.ids.normalized())
+		encoded += "." + w.encode()
+	}
+	if publisher := tc.PublisherTC; publisher != nil {
+		w := &bitWriter{}
+		w.int(SegmentTypePublisherTC, 3)
+		w.bitfield(publisher.PurposesConsent.normalized(), maxPurposeID)
+		w.bitfield(publisher.PurposesLITransparency.normalized(), maxPurposeID)
+		w.int(publisher.NumCustomPurposes, 6)
+		w.bitfield(publisher.CustomPurposesConsent.normalized(), publisher.NumCustomPurposes)
+		w.bitfield(publisher.CustomPurposesLITransparency.normalized(), publisher.NumCustomPurposes)
+		encoded += "." + w.encode()
+	}
+	return encoded
+}
+
+// validate checks that the custom purposes are all among the ones the segment numbers
+func (publisher *PublisherTC) validate() error {
+	if publisher.NumCustomPurposes < 0 || publisher.NumCustomPurposes > maxCustomPurposeID {
+		return invalid("publisherTC.numCustomPurposes", "%d does not fit in 6 bits", publisher.NumCustomPurposes)
+	}
+	for _, field := range []struct {
+		name string
+		ids  IDs
+		max  int
+	}{
+		{"publisherTC.pubPurposesConsent", publisher.PurposesConsent, maxPurposeID},
+		{"publisherTC.pubPurposesLITransparency", publisher.PurposesLITransparency, maxPurposeID},
+		{"publisherTC.customPurposesConsent", publisher.CustomPurposesConsent, publisher.NumCustomPurposes},
+		{"publisherTC.customPurposesLITransparency", publisher.CustomPurposesLITransparency, publisher.NumCustomPurposes},
+	} {
+		for _, id := range field.ids {
+			if id < 1 || id > field.max {
+				return invalid(field.name, "id %d is not between 1 and %d", id, field.max)
+			}
+		}
+	}
+	return nil
+}
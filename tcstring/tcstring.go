@@ -0,0 +1,167 @@
+// Package tcstring reads the TC strings of the IAB's Transparency and Consent Framework v2, as CMPs store them in
+// the euconsent-v2 cookie and pass them to vendors.
+package tcstring
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The spec version of TC strings this package reads
+const Version = 2
+
+// The names of the segments, as errors report them
+const (
+	segmentCore             = "core"
+	segmentDisclosedVendors = "disclosedVendors"
+	segmentAllowedVendors   = "allowedVendors"
+	segmentPublisherTC      = "publisherTC"
+)
+
+// The errors a DecodeError wraps, to be told apart with errors.Is
+var (
+	ErrEmpty              = errors.New("the TC string is empty")
+	ErrBase64             = errors.New("the segment is not base64url")
+	ErrTruncated          = errors.New("the segment ends early")
+	ErrUnsupportedVersion = errors.New("only version 2 TC strings are supported")
+	ErrInvalidValue       = errors.New("the value is not valid")
+)
+
+// DecodeError says where in a TC string decoding failed. Bit is the offset of the field in its segment.
+type DecodeError struct {
+	Segment string
+	Field   string
+	Bit     int
+	Err     error
+}
+
+func (err *DecodeError) Error() string {
+	return fmt.Sprintf("tcstring: %s segment: %s at bit %d: %v", err.Segment, err.Field, err.Bit, err.Err)
+}
+
+func (err *DecodeError) Unwrap() error {
+	return err.Err
+}
+
+// IDs is a set of purpose, special feature or vendor ids in ascending order
+type IDs []int
+
+// Has reports whether id is in the set
+func (ids IDs) Has(id int) bool {
+	i := sort.SearchInts(ids, id)
+	return i < len(ids) && ids[i] == id
+}
+
+// normalized returns the ids sorted, without the repeated ones
+func (ids IDs) normalized() IDs {
+	sorted := append(IDs{}, ids...)
+	sort.Ints(sorted)
+	out := IDs{}
+	for i, id := range sorted {
+		if i == 0 || id != sorted[i-1] {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// TCString is a TC string: the core segment with the user's choices and the CMP that recorded them, and the optional
+// segments after it. DisclosedVendors and AllowedVendors are nil, and PublisherTC is nil, when the string does not
+// carry their segment.
+type TCString struct {
+	Version              int       `json:"version"`
+	Created              time.Time `json:"created"`
+	LastUpdated          time.Time `json:"lastUpdated"`
+	CmpID                int       `json:"cmpId"`
+	CmpVersion           int       `json:"cmpVersion"`
+	ConsentScreen        int       `json:"consentScreen"`
+	ConsentLanguage      string    `json:"consentLanguage"`
+	VendorListVersion    int       `json:"vendorListVersion"`
+	TCFPolicyVersion     int       `json:"tcfPolicyVersion"`
+	IsServiceSpecific    bool      `json:"isServiceSpecific"`
+	UseNonStandardStacks bool      `json:"useNonStandardStacks"`
+	SpecialFeatureOptIns IDs       `json:"specialFeatureOptIns"`
+	PurposesConsent      IDs       `json:"purposesConsent"`
+	// PurposesLITransparency holds the purposes the user did not object to under legitimate interest
+	PurposesLITransparency    IDs                    `json:"purposesLITransparency"`
+	PurposeOneTreatment       bool                   `json:"purposeOneTreatment"`
+	PublisherCC               string                 `json:"publisherCC"`
+	VendorConsents            IDs                    `json:"vendorConsents"`
+	VendorLegitimateInterests IDs                    `json:"vendorLegitimateInterests"`
+	PublisherRestrictions     []PublisherRestriction `json:"publisherRestrictions"`
+	// DisclosedVendors are the vendors the CMP showed the user
+	DisclosedVendors IDs `json:"disclosedVendors,omitempty"`
+	// AllowedVendors are the vendors the publisher allows to use the legal bases the user gave globally
+	AllowedVendors IDs          `json:"allowedVendors,omitempty"`
+	PublisherTC    *PublisherTC `json:"publisherTC,omitempty"`
+}
+
+// Decode reads a TC string: the core segment, then the disclosed vendors, allowed vendors and publisher TC segments
+// that may follow it in any order
+func Decode(tcString string) (*TCString, error) {
+	tcString = strings.TrimSpace(tcString)
+	if tcString == "" {
+		return nil, &DecodeError{Segment: segmentCore, Field: "version", Err: ErrEmpty}
+	}
+	segments := strings.Split(tcString, ".")
+	tc, err := decodeCore(segments[0])
+	if err != nil {
+		return nil, err
+	}
+	for i, segment := range segments[1:] {
+		if err := decodeSegment(tc, i+1, segment); err != nil {
+			return nil, err
+		}
+	}
+	return tc, nil
+}
+
+func decodeCore(segment string) (*TCString, error) {
+	r, err := newBitReader(segmentCore, segment)
+	if err != nil {
+		return nil, err
+	}
+	tc := &TCString{}
+	tc.Version = r.int("version", 6)
+	if r.err == nil && tc.Version != Version {
+		return nil, &DecodeError{Segment: segmentCore, Field: "version", Err: fmt.Errorf("%w: the string is version %d", ErrUnsupportedVersion, tc.Version)}
+	}
+	tc.Created = r.date("created")
+	tc.LastUpdated = r.date("lastUpdated")
+	tc.CmpID = r.int("cmpId", 12)
+	tc.CmpVersion = r.int("cmpVersion", 12)
+	tc.ConsentScreen = r.int("consentScreen", 6)
+	tc.ConsentLanguage = r.letters("consentLanguage")
+	tc.VendorListVersion = r.int("vendorListVersion", 12)
+	tc.TCFPolicyVersion = r.int("tcfPolicyVersion", 6)
+	tc.IsServiceSpecific = r.bool("isServiceSpecific")
+	tc.UseNonStandardStacks = r.bool("useNonStandardStacks")
+	tc.SpecialFeatureOptIns = r.bitfield("specialFeatureOptIns", 12)
+	tc.PurposesConsent = r.bitfield("purposesConsent", 24)
+	tc.PurposesLITransparency = r.bitfield("purposesLITransparency", 24)
+	tc.PurposeOneTreatment = r.bool("purposeOneTreatment")
+	tc.PublisherCC = r.letters("publisherCC")
+	tc.VendorConsents = r.vendors("vendorConsents")
+	tc.VendorLegitimateInterests = r.vendors("vendorLegitimateInterests")
+	tc.PublisherRestrictions = decodePublisherRestrictions(r)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return tc, nil
+}
+
+// ranges groups the ids into runs of consecutive ids
+func (ids IDs) ranges() [][2]int {
+	ranges := [][2]int{}
+	for _, id := range ids {
+		if n := len(ranges); n > 0 && ranges[n-1][1] == id-1 {
+			ranges[n-1][1] = id
+			continue
+		}
+		ranges = append(ranges, [2]int{id, id})
+	}
+	return ranges
+}
@@ -0,0 +1,247 @@
+package tcstring
+
+import (
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fields builds a segment from values and their widths in bits, as a test oracle independent of the decoder
+type fields struct {
+	bits strings.Builder
+}
+
+func (f *fields) add(value int, width int) *fields {
+	for i := width - 1; i >= 0; i-- {
+		if value&(1<<uint(i)) != 0 {
+			f.bits.WriteByte('1')
+		} else {
+			f.bits.WriteByte('0')
+		}
+	}
+	return f
+}
+
+func (f *fields) flags(width int, ids ...int) *fields {
+	set := map[int]bool{}
+	for _, id := range ids {
+		set[id] = true
+	}
+	for id := 1; id <= width; id++ {
+		if set[id] {
+			f.add(1, 1)
+		} else {
+			f.add(0, 1)
+		}
+	}
+	return f
+}
+
+func (f *fields) encode() string {
+	bits := f.bits.String()
+	b := make([]byte, (len(bits)+7)/8)
+	for i, bit := range bits {
+		if bit == '1' {
+			b[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// coreHeader writes every core field up to the vendor sections
+func coreHeader() *fields {
+	f := &fields{}
+	f.add(2, 6)                                        // version
+	f.add(15826254000, 36).add(15826254000, 36)        // created and lastUpdated, 2020-02-25 in deciseconds
+	f.add(7, 12).add(3, 12).add(1, 6)                  // cmpId, cmpVersion, consentScreen
+	f.add('F'-'A', 6).add('R'-'A', 6)                  // consentLanguage
+	f.add(48, 12).add(2, 6)                            // vendorListVersion, tcfPolicyVersion
+	f.add(0, 1).add(1, 1)                              // isServiceSpecific, useNonStandardStacks
+	f.flags(12, 1).flags(24, 1, 3, 24).flags(24, 2, 7) // special features, purpose consents and LI
+	f.add(0, 1).add('F'-'A', 6).add('R'-'A', 6)        // purposeOneTreatment, publisherCC
+	return f
+}
+
+func TestDecodeReferenceStrings(t *testing.T) {
+	// Published as examples by the IAB
+	tc, err := Decode("COvFyGBOvFyGBAbAAAENAPCAAOAAAAAAAAAAAEEUACCKAAA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &TCString{
+		Version:                   2,
+		Created:                   time.Date(2020, 2, 20, 23, 57, 39, 300000000, time.UTC),
+		LastUpdated:               time.Date(2020, 2, 20, 23, 57, 39, 300000000, time.UTC),
+		CmpID:                     27,
+		ConsentLanguage:           "EN",
+		VendorListVersion:         15,
+		TCFPolicyVersion:          2,
+		SpecialFeatureOptIns:      IDs{},
+		PurposesConsent:           IDs{1, 2, 3},
+		PurposesLITransparency:    IDs{},
+		PublisherCC:               "AA",
+		VendorConsents:            IDs{2, 6, 8},
+		VendorLegitimateInterests: IDs{2, 6, 8},
+		PublisherRestrictions:     []PublisherRestriction{},
+	}
+	if !reflect.DeepEqual(tc, want) {
+		t.Errorf("decoded\n%+v\nwant\n%+v", tc, want)
+	}
+
+	tc, err = Decode("COw4XqLOw4XqLAAAAAENAXCAAAAAAAAAAAAAAAAAAAAA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.VendorListVersion != 23 || tc.CmpID != 0 || len(tc.VendorConsents) != 0 || tc.Created.Year() != 2020 || tc.DisclosedVendors != nil {
+		t.Errorf("decoded %+v", tc)
+	}
+	// The example's disclosed vendors segment declares vendors up to 733 but only holds flags for the first 29
+	_, err = Decode("COw4XqLOw4XqLAAAAAENAXCAAAAAAAAAAAAAAAAAAAAA.IFukWSQh")
+	decodeErr := &DecodeError{}
+	if !errors.Is(err, ErrTruncated) || !errors.As(err, &decodeErr) || decodeErr.Segment != segmentDisclosedVendors {
+		t.Errorf("truncated disclosed vendors: err = %v", err)
+	}
+}
+
+func TestDecodeOptionalSegments(t *testing.T) {
+	core := coreHeader().add(0, 16).add(0, 1).add(0, 16).add(0, 1).add(0, 12).encode()
+	disclosed := (&fields{}).add(1, 3).add(8, 16).add(0, 1).flags(8, 2, 6, 8).encode()
+	// Allowed vendors as ranges: 100-102
+	allowed := (&fields{}).add(2, 3).add(102, 16).add(1, 1).add(1, 12).add(1, 1).add(100, 16).add(102, 16).encode()
+	// Publisher purposes 1 and 2 on consent, 7 on LI, and custom purpose 2 of 3 on consent
+	publisher := (&fields{}).add(3, 3).flags(24, 1, 2).flags(24, 7).add(3, 6).flags(3, 2).flags(3).encode()
+
+	tc, err := Decode(strings.Join([]string{core, publisher, disclosed, allowed}, "."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tc.DisclosedVendors, IDs{2, 6, 8}) || !reflect.DeepEqual(tc.AllowedVendors, IDs{100, 101, 102}) {
+		t.Errorf("disclosed = %v, allowed = %v", tc.DisclosedVendors, tc.AllowedVendors)
+	}
+	want := &PublisherTC{
+		PurposesConsent:              IDs{1, 2},
+		PurposesLITransparency:       IDs{7},
+		NumCustomPurposes:            3,
+		CustomPurposesConsent:        IDs{2},
+		CustomPurposesLITransparency: IDs{},
+	}
+	if !reflect.DeepEqual(tc.PublisherTC, want) {
+		t.Errorf("publisher TC = %+v", tc.PublisherTC)
+	}
+
+	for name, tcString := range map[string]string{
+		"twice":          core + "." + disclosed + "." + disclosed,
+		"undefined type": core + "." + (&fields{}).add(5, 3).add(0, 16).encode(),
+		"the core again": core + "." + core,
+	} {
+		if _, err := Decode(tcString); !errors.Is(err, ErrInvalidValue) {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+}
+
+func TestDecodeRangesAndRestrictions(t *testing.T) {
+	f := coreHeader()
+	// Vendor consents as ranges: 1-3 and 10
+	f.add(10, 16).add(1, 1).add(2, 12).add(1, 1).add(1, 16).add(3, 16).add(0, 1).add(10, 16)
+	// Vendor LI as a bitfield
+	f.add(4, 16).add(0, 1).flags(4, 4)
+	// Purpose 2 requires consent of vendors 5 and 6
+	f.add(1, 12).add(2, 6).add(int(RequireConsent), 2).add(1, 12).add(1, 1).add(5, 16).add(6, 16)
+
+	tc, err := Decode(f.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.CmpID != 7 || tc.CmpVersion != 3 || tc.ConsentScreen != 1 || tc.ConsentLanguage != "FR" || tc.VendorListVersion != 48 ||
+		!tc.UseNonStandardStacks || tc.IsServiceSpecific || tc.PublisherCC != "FR" {
+		t.Errorf("header = %+v", tc)
+	}
+	if !reflect.DeepEqual(tc.SpecialFeatureOptIns, IDs{1}) || !reflect.DeepEqual(tc.PurposesConsent, IDs{1, 3, 24}) ||
+		!reflect.DeepEqual(tc.PurposesLITransparency, IDs{2, 7}) {
+		t.Errorf("purposes = %v %v %v", tc.SpecialFeatureOptIns, tc.PurposesConsent, tc.PurposesLITransparency)
+	}
+	if !reflect.DeepEqual(tc.VendorConsents, IDs{1, 2, 3, 10}) || !reflect.DeepEqual(tc.VendorLegitimateInterests, IDs{4}) {
+		t.Errorf("vendors = %v %v", tc.VendorConsents, tc.VendorLegitimateInterests)
+	}
+	want := []PublisherRestriction{{PurposeID: 2, RestrictionType: RequireConsent, Vendors: IDs{5, 6}}}
+	if !reflect.DeepEqual(tc.PublisherRestrictions, want) {
+		t.Errorf("restrictions = %+v", tc.PublisherRestrictions)
+	}
+	if !tc.VendorConsents.Has(10) || tc.VendorConsents.Has(4) {
+		t.Error("Has does not match the set")
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	noRestrictions := func(f *fields) *fields { return f.add(0, 12) }
+	for _, test := range []struct {
+		name     string
+		tcString string
+		err      error
+		field    string
+	}{
+		{"empty", " ", ErrEmpty, "version"},
+		{"not base64", "CO!vFyGB", ErrBase64, "base64"},
+		{"version 1", "BOEFEAyOEFEAyAHABDENAI4AAAB9vABAASA", ErrUnsupportedVersion, "version"},
+		{"truncated", "COvFyGBOvFyGBAbAAAENAPCAAOAAAAAAAAAAAEEU", ErrTruncated, "vendorLegitimateInterests.maxVendorId"},
+		{"not a letter", coreHeader().encode()[:18] + "_" + coreHeader().encode()[19:], ErrInvalidValue, "consentLanguage"},
+		{"range ends before it starts", noRestrictions(coreHeader().add(9, 16).add(1, 1).add(1, 12).add(1, 1).add(5, 16).add(3, 16).add(0, 16).add(0, 1)).encode(),
+			ErrInvalidValue, "vendorConsents"},
+		{"range past the maximum", noRestrictions(coreHeader().add(9, 16).add(1, 1).add(1, 12).add(0, 1).add(12, 16).add(0, 16).add(0, 1)).encode(),
+			ErrInvalidValue, "vendorConsents"},
+		{"undefined restriction", coreHeader().add(0, 16).add(0, 1).add(0, 16).add(0, 1).add(1, 12).add(1, 6).add(3, 2).add(0, 12).encode(),
+			ErrInvalidValue, "pubRestrictions[0].restrictionType"},
+	} {
+		_, err := Decode(test.tcString)
+		decodeErr := &DecodeError{}
+		if !errors.Is(err, test.err) || !errors.As(err, &decodeErr) || decodeErr.Field != test.field {
+			t.Errorf("%s: err = %v, want %v in %s", test.name, err, test.err, test.field)
+		}
+	}
+}
+
+func TestDecodeBoundsOverlappingRanges(t *testing.T) {
+	// Overlapping entries are one set of vendors
+	f := coreHeader().add(10, 16).add(1, 1).add(3, 12)
+	f.add(1, 1).add(1, 16).add(8, 16).add(1, 1).add(5, 16).add(10, 16).add(0, 1).add(6, 16)
+	tc, err := Decode(f.add(0, 16).add(0, 1).add(0, 12).encode())
+	if err != nil || !reflect.DeepEqual(tc.VendorConsents, IDs{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}) {
+		t.Fatalf("decoded %+v, %v", tc, err)
+	}
+
+	// 4095 entries of vendors 1 to 65535 each would be 268M ids to go through
+	f = coreHeader().add(65535, 16).add(1, 1).add(4095, 12)
+	for i := 0; i < 4095; i++ {
+		f.add(1, 1).add(1, 16).add(65535, 16)
+	}
+	_, err = Decode(f.add(0, 16).add(0, 1).add(0, 12).encode())
+	decodeErr := &DecodeError{}
+	if !errors.Is(err, ErrInvalidValue) || !errors.As(err, &decodeErr) || decodeErr.Field != "vendorConsents" {
+		t.Errorf("overlapping full ranges: err = %v", err)
+	}
+
+	// Restrictions can't repeat a purpose and type to hold every vendor again and again
+	f = coreHeader().add(0, 16).add(0, 1).add(0, 16).add(0, 1).add(4095, 12)
+	for i := 0; i < 4095; i++ {
+		f.add(1, 6).add(int(NotAllowed), 2).add(1, 12).add(1, 1).add(1, 16).add(65535, 16)
+	}
+	_, err = Decode(f.encode())
+	if !errors.Is(err, ErrInvalidValue) || !errors.As(err, &decodeErr) || decodeErr.Field != "pubRestrictions[1].purposeId" {
+		t.Errorf("repeated restrictions: err = %v", err)
+	}
+
+	// Nor can distinct ones add up to more ids than a segment may hold
+	f = coreHeader().add(0, 16).add(0, 1).add(0, 16).add(0, 1).add(72, 12)
+	for purpose := 1; purpose <= 24; purpose++ {
+		for restriction := 0; restriction < 3; restriction++ {
+			f.add(purpose, 6).add(restriction, 2).add(1, 12).add(1, 1).add(1, 16).add(65535, 16)
+		}
+	}
+	if _, err := Decode(f.encode()); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("too many ids: err = %v", err)
+	}
+}
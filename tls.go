@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	l4g "github.com/ezoic/log4go"
+)
+
+// certReloadInterval is how often the certificate files are checked for changes
+const certReloadInterval = 30 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	if parsed, ok := tlsVersions[version]; ok {
+		return parsed, nil
+	}
+	return 0, fmt.Errorf("%q is not a TLS version, use 1.0, 1.1, 1.2 or 1.3", version)
+}
+
+// certReloader serves the certificate at CertPath and KeyPath, and loads it again when either file changes so
+// that a rotated certificate is picked up without a restart
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+func newCertReloader(certPath string, keyPath string) (*certReloader, error) {
+	reloader := &certReloader{certPath: certPath, keyPath: keyPath}
+	if _, err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (reloader *certReloader) fileModTimes() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, path := range []string{reloader.certPath, reloader.keyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// reload loads the certificate again if either file changed since it was last loaded. A certificate that does not
+// load leaves the previous one in use.
+func (reloader *certReloader) reload() (bool, error) {
+	modTimes, err := reloader.fileModTimes()
+	if err != nil {
+		return false, err
+	}
+	reloader.mu.RLock()
+	unchanged := reloader.cert != nil && modTimes == reloader.modTimes
+	reloader.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(reloader.certPath, reloader.keyPath)
+	if err != nil {
+		return false, fmt.Errorf("loading the certificate from %s and %s: %v", reloader.certPath, reloader.keyPath, err)
+	}
+	reloader.mu.Lock()
+	reloader.cert = &cert
+	reloader.modTimes = modTimes
+	reloader.mu.Unlock()
+	return true, nil
+}
+
+// watch checks the files every interval until stop is closed
+func (reloader *certReloader) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			reloaded, err := reloader.reload()
+			if err != nil {
+				l4g.Error("Keeping the current certificate: %v", err)
+			} else if reloaded {
+				l4g.Info("Reloaded the certificate from %s", reloader.certPath)
+			}
+		}
+	}
+}
+
+func (reloader *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mu.RLock()
+	defer reloader.mu.RUnlock()
+	return reloader.cert, nil
+}
+
+// newTLSConfig serves the reloader's certificate over HTTP/2 or HTTP/1.1, with nothing older than minVersion
+func newTLSConfig(reloader *certReloader, minVersion string) (*tls.Config, error) {
+	version, err := parseTLSVersion(minVersion)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     version,
+		GetCertificate: reloader.getCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}, nil
+}
+
+// verifyClientCerts asks clients for a certificate and verifies the ones given against the CAs in caPath. Clients
+// without a certificate are still served, the endpoints that need one refuse them.
+func verifyClientCerts(config *tls.Config, caPath string) error {
+	b, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return fmt.Errorf("%s holds no PEM certificates", caPath)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 with the given common name, and returns it for
+// clients to trust
+func writeTestCert(t *testing.T, dir string, commonName string, modTime time.Time) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	// Rewrites within the file system's timestamp resolution would otherwise look unchanged
+	os.Chtimes(certPath, modTime, modTime)
+	os.Chtimes(keyPath, modTime, modTime)
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// serveTLS runs the server with a TLS config for the certificates in dir and stops it when the test ends
+func serveTLS(t *testing.T, dir string, minVersion string) (string, *certReloader) {
+	reloader, err := newCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testServerConfig()
+	server := newHTTPServer(config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(req.Proto))
+	}))
+	if server.TLSConfig, err = newTLSConfig(reloader, minVersion); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signals := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() { served <- serve(server, listener, config, signals) }()
+	t.Cleanup(func() {
+		signals <- os.Interrupt
+		<-served
+	})
+	return "https://" + listener.Addr().String() + "/", reloader
+}
+
+func clientTrusting(certs ...*x509.Certificate) *http.Client {
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: pool},
+		ForceAttemptHTTP2: true,
+	}}
+}
+
+func TestTLSServesHTTP2AndReloadsCertificate(t *testing.T) {
+	dir := t.TempDir()
+	first := writeTestCert(t, dir, "first", time.Now().Add(-time.Minute))
+	url, reloader := serveTLS(t, dir, "1.2")
+
+	resp, err := clientTrusting(first).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 || string(body) != "HTTP/2.0" {
+		t.Errorf("protocol = %s, body = %s, want HTTP/2", resp.Proto, body)
+	}
+
+	second := writeTestCert(t, dir, "second", time.Now())
+	if reloaded, err := reloader.reload(); err != nil || !reloaded {
+		t.Fatalf("reloaded = %v, err = %v", reloaded, err)
+	}
+	resp, err = clientTrusting(second).Get(url)
+	if err != nil {
+		t.Fatalf("the reloaded certificate is not served: %v", err)
+	}
+	resp.Body.Close()
+	if resp.TLS.PeerCertificates[0].Subject.CommonName != "second" {
+		t.Errorf("served certificate = %s", resp.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+	if reloaded, err := reloader.reload(); err != nil || reloaded {
+		t.Errorf("unchanged files: reloaded = %v, err = %v", reloaded, err)
+	}
+}
+
+func TestCertReloaderKeepsCertificateWhenFilesAreBroken(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCert(t, dir, "first", time.Now().Add(-time.Minute))
+	reloader, err := newCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "cert.pem"), []byte("not a certificate"), 0600)
+
+	if _, err := reloader.reload(); err == nil {
+		t.Errorf("a broken certificate was accepted")
+	}
+	if cert, _ := reloader.getCertificate(nil); cert == nil {
+		t.Errorf("the previous certificate was dropped")
+	}
+	if _, err := newCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")); err == nil {
+		t.Errorf("a server started with a broken certificate")
+	}
+}
+
+func TestMinTLSVersionIsEnforced(t *testing.T) {
+	dir := t.TempDir()
+	cert := writeTestCert(t, dir, "first", time.Now())
+	url, _ := serveTLS(t, dir, "1.3")
+
+	client := clientTrusting(cert)
+	client.Transport.(*http.Transport).TLSClientConfig.MaxVersion = tls.VersionTLS12
+	if resp, err := client.Get(url); err == nil {
+		resp.Body.Close()
+		t.Errorf("a TLS 1.2 client was accepted")
+	}
+	if _, err := parseTLSVersion("1.4"); err == nil {
+		t.Errorf("TLS 1.4 was accepted")
+	}
+}